@@ -0,0 +1,371 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package balancer selects the node serving a call among the nodes of a
+// registered service.
+//
+// A Balancer keeps the node list of a service up to date, from Watch if the
+// registry supports it and by polling otherwise. A failed watch is established
+// again with backoff and the list refreshed. It picks a node per call
+// with a Selector. Nodes failing MaxFailures consecutive calls are ejected for
+// a while, the time doubling with every repeated ejection. If all nodes are
+// ejected, calls are spread over all of them again rather than failing.
+// Among the nodes left, only those with the lowest registry.Node.Priority
+// serve calls, the others are backups.
+package balancer
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"airman.com/airfk/pkg/event"
+	"airman.com/airfk/pkg/registry"
+)
+
+const (
+	DefaultMaxFailures     = 5
+	DefaultEjectionTime    = 30 * time.Second
+	DefaultMaxEjectionTime = 5 * time.Minute
+	DefaultRefreshInterval = 30 * time.Second
+)
+
+var (
+	ErrNoNodes        = errors.New("no nodes available")
+	ErrBalancerClosed = errors.New("balancer closed")
+)
+
+// Config contains the settings of a Balancer.
+type Config struct {
+	Selector        Selector      // defaults to round-robin
+	MaxFailures     int           // consecutive failures ejecting a node, negative disables ejection
+	EjectionTime    time.Duration // time a node stays ejected the first time
+	MaxEjectionTime time.Duration // limit of the doubled ejection time
+	RefreshInterval time.Duration // polling interval for registries that can't watch
+}
+
+// nodeState is a node and its call statistics.
+type nodeState struct {
+	node      *registry.Node
+	failures  int // consecutive failures
+	ejections int // consecutive ejections
+	ejected   time.Time
+}
+
+// Balancer picks nodes of a service.
+type Balancer struct {
+	config Config
+	now    func() time.Time
+
+	mu     sync.Mutex
+	nodes  map[string]*nodeState
+	sorted []*registry.Node // all nodes sorted by id, nil if outdated
+	closed bool
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New creates a balancer over a static node list, see Update.
+func New(config Config) *Balancer {
+	if config.Selector == nil {
+		config.Selector = NewRoundRobin()
+	}
+	if config.MaxFailures == 0 {
+		config.MaxFailures = DefaultMaxFailures
+	}
+	if config.EjectionTime <= 0 {
+		config.EjectionTime = DefaultEjectionTime
+	}
+	if config.MaxEjectionTime < config.EjectionTime {
+		config.MaxEjectionTime = DefaultMaxEjectionTime
+		if config.MaxEjectionTime < config.EjectionTime {
+			config.MaxEjectionTime = config.EjectionTime
+		}
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = DefaultRefreshInterval
+	}
+	return &Balancer{
+		config: config,
+		now:    time.Now,
+		nodes:  make(map[string]*nodeState),
+		quit:   make(chan struct{}),
+	}
+}
+
+// NewWithRegistry creates a balancer over the nodes registered under name,
+// restricted to the nodes with tag if it is not empty. The node list follows
+// the registry until the balancer is closed.
+func NewWithRegistry(r registry.Registry, name, tag string, config Config) (*Balancer, error) {
+	services, err := r.GetService(name, tag)
+	if err != nil {
+		return nil, err
+	}
+	b := New(config)
+	b.Update(flatten(services))
+
+	if w, ok := r.(registry.Watcher); ok {
+		ch := make(chan *registry.Event)
+		sub, err := w.Watch(name, ch)
+		if err != nil {
+			return nil, err
+		}
+		resub := event.Resubscribe(func(ctx context.Context) (event.Subscription, error) {
+			if first := sub; first != nil {
+				sub = nil
+				return first, nil
+			}
+			// Events may have been missed while the watch was down.
+			s, err := w.Watch(name, ch)
+			if err == nil {
+				b.refresh(r, name, tag)
+			}
+			return s, err
+		})
+		b.wg.Add(1)
+		go b.watchLoop(resub, ch, tag)
+	} else {
+		b.wg.Add(1)
+		go b.pollLoop(r, name, tag)
+	}
+	return b, nil
+}
+
+// Update replaces the node list. The statistics of known nodes are kept.
+func (b *Balancer) Update(nodes []*registry.Node) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	known := make(map[string]*nodeState, len(nodes))
+	for _, node := range nodes {
+		st, ok := b.nodes[node.Id]
+		if !ok {
+			st = &nodeState{}
+		}
+		st.node = node
+		known[node.Id] = st
+	}
+	b.nodes = known
+	b.sorted = nil
+}
+
+// Nodes returns all nodes, including the ejected ones, sorted by id.
+func (b *Balancer) Nodes() []*registry.Node {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*registry.Node(nil), b.all()...)
+}
+
+// Pick returns the node that should serve a call. The key is passed to the
+// selector, e.g. to route calls of the same user to the same node with a
+// consistent-hash selector. The outcome of the call should be passed to Report.
+func (b *Balancer) Pick(key string) (*registry.Node, error) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil, ErrBalancerClosed
+	}
+	all := b.all()
+	now := b.now()
+	available := make([]*registry.Node, 0, len(all))
+	for _, node := range all {
+		if now.After(b.nodes[node.Id].ejected) {
+			available = append(available, node)
+		}
+	}
+	b.mu.Unlock()
+
+	if len(all) == 0 {
+		return nil, ErrNoNodes
+	}
+	if len(available) == 0 {
+		available = all
+	}
+	return b.config.Selector.Select(preferred(available), key), nil
+}
+
+// Report records the outcome of a call served by node.
+func (b *Balancer) Report(node *registry.Node, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st, ok := b.nodes[node.Id]
+	if !ok {
+		return
+	}
+	if err == nil {
+		st.failures, st.ejections = 0, 0
+		return
+	}
+	st.failures++
+	if b.config.MaxFailures < 0 || st.failures < b.config.MaxFailures {
+		return
+	}
+	ejection := b.config.EjectionTime << uint(st.ejections)
+	if ejection > b.config.MaxEjectionTime || ejection <= 0 {
+		ejection = b.config.MaxEjectionTime
+	}
+	st.failures = 0
+	st.ejections++
+	st.ejected = b.now().Add(ejection)
+	log.Warnf("balancer ejected node %s for %v after %d failures", node.Id, ejection, b.config.MaxFailures)
+}
+
+// Call picks a node for key, runs fn with it and reports the result.
+func (b *Balancer) Call(key string, fn func(node *registry.Node) error) error {
+	node, err := b.Pick(key)
+	if err != nil {
+		return err
+	}
+	err = fn(node)
+	b.Report(node, err)
+	return err
+}
+
+// Close stops following the registry.
+func (b *Balancer) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	close(b.quit)
+	b.mu.Unlock()
+
+	b.wg.Wait()
+}
+
+// all returns the nodes sorted by id, b.mu must be held.
+func (b *Balancer) all() []*registry.Node {
+	if b.sorted == nil {
+		b.sorted = make([]*registry.Node, 0, len(b.nodes))
+		for _, st := range b.nodes {
+			b.sorted = append(b.sorted, st.node)
+		}
+		sort.Slice(b.sorted, func(i, j int) bool { return b.sorted[i].Id < b.sorted[j].Id })
+	}
+	return b.sorted
+}
+
+func (b *Balancer) watchLoop(sub event.Subscription, ch <-chan *registry.Event, tag string) {
+	defer b.wg.Done()
+	defer sub.Unsubscribe()
+
+	for {
+		select {
+		case ev := <-ch:
+			b.apply(ev, tag)
+		case <-sub.Err():
+			return
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// apply updates the node list with a watch event.
+func (b *Balancer) apply(ev *registry.Event, tag string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ev.Type == registry.EventRemove || (tag != "" && !hasTag(ev.Node, tag)) {
+		if _, ok := b.nodes[ev.Node.Id]; ok {
+			delete(b.nodes, ev.Node.Id)
+			b.sorted = nil
+		}
+		return
+	}
+	st, ok := b.nodes[ev.Node.Id]
+	if !ok {
+		st = &nodeState{}
+		b.nodes[ev.Node.Id] = st
+	}
+	st.node = ev.Node
+	b.sorted = nil
+}
+
+func (b *Balancer) pollLoop(r registry.Registry, name, tag string) {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.config.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.refresh(r, name, tag)
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// refresh replaces the node list with the nodes currently registered.
+func (b *Balancer) refresh(r registry.Registry, name, tag string) {
+	services, err := r.GetService(name, tag)
+	if err != nil {
+		log.Warnf("balancer refresh of %s failed: %v", name, err)
+		return
+	}
+	b.Update(flatten(services))
+}
+
+// preferred returns the nodes with the lowest priority, keeping their order.
+func preferred(nodes []*registry.Node) []*registry.Node {
+	min := nodes[0].Priority()
+	mixed := false
+	for _, node := range nodes[1:] {
+		if p := node.Priority(); p != min {
+			mixed = true
+			if p < min {
+				min = p
+			}
+		}
+	}
+	if !mixed {
+		return nodes
+	}
+	best := make([]*registry.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if node.Priority() == min {
+			best = append(best, node)
+		}
+	}
+	return best
+}
+
+// flatten returns the nodes of all versions of a service.
+func flatten(services []*registry.Service) []*registry.Node {
+	var nodes []*registry.Node
+	for _, s := range services {
+		nodes = append(nodes, s.Nodes...)
+	}
+	return nodes
+}
+
+func hasTag(node *registry.Node, tag string) bool {
+	for _, t := range node.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
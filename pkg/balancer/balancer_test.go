@@ -0,0 +1,324 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"airman.com/airfk/pkg/event"
+	"airman.com/airfk/pkg/registry"
+)
+
+func testNodes(weights ...int) []*registry.Node {
+	nodes := make([]*registry.Node, len(weights))
+	for i, w := range weights {
+		nodes[i] = &registry.Node{Id: fmt.Sprintf("node-%d", i), Host: "10.0.0.1", Port: 8080 + i, Weight: w}
+	}
+	return nodes
+}
+
+func countPicks(t *testing.T, b *Balancer, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		node, err := b.Pick(fmt.Sprint(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[node.Id]++
+	}
+	return counts
+}
+
+func TestRoundRobin(t *testing.T) {
+	b := New(Config{})
+	defer b.Close()
+	if _, err := b.Pick(""); err != ErrNoNodes {
+		t.Fatalf("got %v, want ErrNoNodes", err)
+	}
+
+	b.Update(testNodes(0, 0, 0))
+	for i := 0; i < 6; i++ {
+		node, _ := b.Pick("")
+		if want := fmt.Sprintf("node-%d", i%3); node.Id != want {
+			t.Fatalf("pick %d: got %s, want %s", i, node.Id, want)
+		}
+	}
+}
+
+func TestRandom(t *testing.T) {
+	b := New(Config{Selector: NewRandom()})
+	defer b.Close()
+	b.Update(testNodes(0, 0, 0))
+
+	for id, n := range countPicks(t, b, 3000) {
+		if n < 800 || n > 1200 {
+			t.Errorf("%s picked %d times out of 3000", id, n)
+		}
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	b := New(Config{Selector: NewWeighted()})
+	defer b.Close()
+	b.Update(testNodes(5, 1, 1))
+
+	// smooth weighted round-robin interleaves the heavy node
+	var order []string
+	for i := 0; i < 7; i++ {
+		node, _ := b.Pick("")
+		order = append(order, node.Id)
+	}
+	if got := fmt.Sprint(order); got != "[node-0 node-0 node-1 node-0 node-2 node-0 node-0]" {
+		t.Fatalf("unexpected order %s", got)
+	}
+	if counts := countPicks(t, b, 700); counts["node-0"] != 500 || counts["node-1"] != 100 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	b := New(Config{Selector: NewConsistentHash(0)})
+	defer b.Close()
+	nodes := testNodes(0, 0, 0, 0)
+	b.Update(nodes)
+
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		node, _ := b.Pick(key)
+		before[key] = node.Id
+		if again, _ := b.Pick(key); again.Id != node.Id {
+			t.Fatalf("key %s moved from %s to %s", key, node.Id, again.Id)
+		}
+	}
+	if counts := countPicks(t, b, 1000); len(counts) != 4 {
+		t.Fatalf("keys spread over %d nodes, want 4", len(counts))
+	}
+
+	// removing a node moves only its keys
+	b.Update(nodes[1:])
+	for key, id := range before {
+		node, _ := b.Pick(key)
+		if id != "node-0" && node.Id != id {
+			t.Fatalf("key %s moved from %s to %s", key, id, node.Id)
+		}
+		if node.Id == "node-0" {
+			t.Fatalf("key %s picked removed node", key)
+		}
+	}
+}
+
+func TestConsistentHashLargeWeight(t *testing.T) {
+	// weights sharing a divisor take as many points as their ratio
+	if points := ringPoints(10, []int{1000, 3000}); points[0] != 10 || points[1] != 30 {
+		t.Fatalf("got ring points %v, want [10 30]", points)
+	}
+
+	s := NewConsistentHash(0).(*consistentHash)
+	nodes := testNodes(1<<30-1, 1, 1)
+	start := time.Now()
+	s.Select(nodes, "key")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("building the ring took %v", elapsed)
+	}
+	if n := len(s.ring); n > MaxRingPoints+2 {
+		t.Fatalf("ring has %d points, want at most %d", n, MaxRingPoints+2)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		counts[s.Select(nodes, fmt.Sprint(i)).Id]++
+	}
+	if counts["node-0"] < 990 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	b := New(Config{Selector: NewWeighted(), MaxFailures: 1, EjectionTime: time.Minute})
+	defer b.Close()
+	nodes := testNodes(1, 1, 100)
+	nodes[2].Metadata = map[string]string{registry.MetaPriority: "20"}
+	b.Update(nodes)
+
+	// the backups get no calls while a preferred node is available
+	if counts := countPicks(t, b, 100); counts["node-0"] != 50 || counts["node-1"] != 50 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+	b.Report(nodes[0], errors.New("down"))
+	b.Report(nodes[1], errors.New("down"))
+	if counts := countPicks(t, b, 10); counts["node-2"] != 10 {
+		t.Fatalf("backup not picked with preferred nodes ejected: %v", counts)
+	}
+}
+
+func TestEjection(t *testing.T) {
+	now := time.Now()
+	b := New(Config{MaxFailures: 2, EjectionTime: time.Second, MaxEjectionTime: 3 * time.Second})
+	b.now = func() time.Time { return now }
+	defer b.Close()
+	nodes := testNodes(0, 0)
+	b.Update(nodes)
+
+	fail := errors.New("call failed")
+	b.Report(nodes[0], fail)
+	b.Report(nodes[0], nil)
+	b.Report(nodes[0], fail)
+	if counts := countPicks(t, b, 4); counts["node-0"] != 2 {
+		t.Fatalf("node ejected before consecutive failures: %v", counts)
+	}
+	b.Report(nodes[0], fail)
+	if counts := countPicks(t, b, 4); counts["node-1"] != 4 {
+		t.Fatalf("failing node not ejected: %v", counts)
+	}
+
+	// all nodes ejected, calls go to all of them
+	b.Report(nodes[1], fail)
+	b.Report(nodes[1], fail)
+	if counts := countPicks(t, b, 4); counts["node-0"] != 2 || counts["node-1"] != 2 {
+		t.Fatalf("unexpected picks with all nodes ejected: %v", counts)
+	}
+
+	// the ejection ends and doubles when the node fails again
+	now = now.Add(1500 * time.Millisecond)
+	if counts := countPicks(t, b, 4); counts["node-0"] != 2 {
+		t.Fatalf("node not back after ejection: %v", counts)
+	}
+	b.Report(nodes[0], fail)
+	b.Report(nodes[0], fail)
+	now = now.Add(1500 * time.Millisecond)
+	if counts := countPicks(t, b, 4); counts["node-1"] != 4 {
+		t.Fatalf("ejection time not doubled: %v", counts)
+	}
+	now = now.Add(time.Second)
+	b.Call("", func(node *registry.Node) error { return nil })
+	if counts := countPicks(t, b, 4); counts["node-0"] != 2 {
+		t.Fatalf("node not back after second ejection: %v", counts)
+	}
+}
+
+func TestRegistryWatch(t *testing.T) {
+	r := registry.NewMemoryRegistry()
+	defer r.Close()
+	v1 := registry.NewService("task", "1.0.0", "10.0.0.1", 8080)
+	v2 := registry.NewService("task", "2.0.0", "10.0.0.2", 8080)
+	r.Register(v1)
+
+	b, err := NewWithRegistry(r, "task", "", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if nodes := b.Nodes(); len(nodes) != 1 || nodes[0].Id != v1.GetId() {
+		t.Fatalf("unexpected nodes %v", nodes)
+	}
+
+	waitNodes := func(want int) {
+		deadline := time.Now().Add(time.Second)
+		for len(b.Nodes()) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("got %d nodes, want %d", len(b.Nodes()), want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	r.Register(v2)
+	waitNodes(2)
+	r.Deregister(v1)
+	waitNodes(1)
+	if node, _ := b.Pick(""); node.Id != v2.GetId() {
+		t.Fatalf("picked %s, want %s", node.Id, v2.GetId())
+	}
+}
+
+// failingWatcher hands out watches that fail when an error is sent on fail.
+type failingWatcher struct {
+	*registry.MemoryRegistry
+	fail    chan error
+	watches int32
+}
+
+type failingSub struct {
+	event.Subscription
+	err <-chan error
+}
+
+func (s *failingSub) Err() <-chan error {
+	return s.err
+}
+
+func (w *failingWatcher) Watch(name string, ch chan<- *registry.Event) (event.Subscription, error) {
+	sub, err := w.MemoryRegistry.Watch(name, ch)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&w.watches, 1)
+	return &failingSub{sub, w.fail}, nil
+}
+
+func TestRegistryWatchFailure(t *testing.T) {
+	r := &failingWatcher{MemoryRegistry: registry.NewMemoryRegistry(), fail: make(chan error, 1)}
+	defer r.Close()
+	v1 := registry.NewService("task", "1.0.0", "10.0.0.1", 8080)
+	v2 := registry.NewService("task", "2.0.0", "10.0.0.2", 8080)
+	r.Register(v1)
+
+	b, err := NewWithRegistry(r, "task", "", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// The balancer watches again and catches up with the registry.
+	r.fail <- errors.New("watch failed")
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&r.watches) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("watch not established again")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	r.Register(v2)
+	for len(b.Nodes()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d nodes, want 2", len(b.Nodes()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRegistryTag(t *testing.T) {
+	r := registry.NewMemoryRegistry()
+	defer r.Close()
+	v1 := registry.NewService("task", "1.0.0", "10.0.0.1", 8080)
+	v2 := registry.NewService("task", "2.0.0", "10.0.0.2", 8080)
+	r.Register(v1)
+	r.Register(v2)
+
+	b, err := NewWithRegistry(r, "task", "v-2.0.0", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	time.Sleep(50 * time.Millisecond) // let the watch deliver the registered nodes
+	if nodes := b.Nodes(); len(nodes) != 1 || nodes[0].Id != v2.GetId() {
+		t.Fatalf("unexpected nodes %v", nodes)
+	}
+}
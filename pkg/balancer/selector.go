@@ -0,0 +1,237 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+package balancer
+
+import (
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"airman.com/airfk/pkg/registry"
+)
+
+const DefaultReplicas = 100
+
+// MaxRingPoints is the maximum number of points a node takes on the ring of a
+// consistent hash selector, however large its weight.
+const MaxRingPoints = 10000
+
+// Selector chooses the node serving a call among a non-empty list of nodes.
+// The nodes are sorted by id. Selectors must be safe for concurrent use.
+type Selector interface {
+	Select(nodes []*registry.Node, key string) *registry.Node
+}
+
+// nodeWeight returns the weight of node, nodes without a weight count as 1.
+func nodeWeight(node *registry.Node) int {
+	if node.Weight <= 0 {
+		return 1
+	}
+	return node.Weight
+}
+
+// roundRobin selects the nodes in turn.
+type roundRobin struct {
+	next uint64
+}
+
+// NewRoundRobin returns a selector cycling through the nodes.
+func NewRoundRobin() Selector {
+	return &roundRobin{}
+}
+
+func (s *roundRobin) Select(nodes []*registry.Node, key string) *registry.Node {
+	n := atomic.AddUint64(&s.next, 1) - 1
+	return nodes[n%uint64(len(nodes))]
+}
+
+// random selects a node uniformly at random.
+type random struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// NewRandom returns a selector picking a random node.
+func NewRandom() Selector {
+	return &random{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (s *random) Select(nodes []*registry.Node, key string) *registry.Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return nodes[s.rnd.Intn(len(nodes))]
+}
+
+// weighted is a smooth weighted round-robin, it spreads the picks of heavy
+// nodes instead of selecting them in bursts.
+type weighted struct {
+	mu      sync.Mutex
+	current map[string]int // node id -> current weight
+}
+
+// NewWeighted returns a selector picking nodes in proportion to their weight.
+func NewWeighted() Selector {
+	return &weighted{current: make(map[string]int)}
+}
+
+func (s *weighted) Select(nodes []*registry.Node, key string) *registry.Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		best  *registry.Node
+		total int
+	)
+	for _, node := range nodes {
+		w := nodeWeight(node)
+		total += w
+		s.current[node.Id] += w
+		if best == nil || s.current[node.Id] > s.current[best.Id] {
+			best = node
+		}
+	}
+	s.current[best.Id] -= total
+
+	// forget the nodes that are gone
+	if len(s.current) > len(nodes) {
+		known := make(map[string]bool, len(nodes))
+		for _, node := range nodes {
+			known[node.Id] = true
+		}
+		for id := range s.current {
+			if !known[id] {
+				delete(s.current, id)
+			}
+		}
+	}
+	return best
+}
+
+// consistentHash maps keys onto a hash ring of the nodes.
+type consistentHash struct {
+	replicas int
+
+	mu      sync.Mutex
+	ids     []string // node ids the ring was built from
+	weights []int
+	ring    []ringPoint // sorted by hash
+}
+
+// ringPoint is a replica of the node at index in the node list.
+type ringPoint struct {
+	hash  uint32
+	index int
+}
+
+// NewConsistentHash returns a selector sending equal keys to the same node.
+// When nodes come and go only the keys of the affected nodes move. Every node
+// is placed on the ring replicas times its weight, replicas defaults to
+// DefaultReplicas. Weights are reduced by their greatest common divisor and
+// scaled down together so no node takes more than MaxRingPoints points.
+func NewConsistentHash(replicas int) Selector {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	return &consistentHash{replicas: replicas}
+}
+
+func (s *consistentHash) Select(nodes []*registry.Node, key string) *registry.Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.built(nodes) {
+		s.build(nodes)
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return nodes[s.ring[i].index]
+}
+
+// built reports whether the ring was built from nodes.
+func (s *consistentHash) built(nodes []*registry.Node) bool {
+	if len(s.ids) != len(nodes) {
+		return false
+	}
+	for i, node := range nodes {
+		if s.ids[i] != node.Id || s.weights[i] != nodeWeight(node) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *consistentHash) build(nodes []*registry.Node) {
+	s.ids = make([]string, len(nodes))
+	s.weights = make([]int, len(nodes))
+	s.ring = s.ring[:0]
+	for i, node := range nodes {
+		s.ids[i], s.weights[i] = node.Id, nodeWeight(node)
+	}
+	for i, points := range ringPoints(s.replicas, s.weights) {
+		node := nodes[i]
+		for r := 0; r < points; r++ {
+			h := crc32.ChecksumIEEE([]byte(node.Id + "#" + strconv.Itoa(r)))
+			s.ring = append(s.ring, ringPoint{h, i})
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool {
+		if s.ring[i].hash != s.ring[j].hash {
+			return s.ring[i].hash < s.ring[j].hash
+		}
+		return s.ring[i].index < s.ring[j].index
+	})
+}
+
+// ringPoints returns the number of ring points of every weight.
+func ringPoints(replicas int, weights []int) []int {
+	g := 0
+	for _, w := range weights {
+		g = gcd(g, w)
+	}
+	var max float64
+	for _, w := range weights {
+		if p := float64(replicas) * float64(w/g); p > max {
+			max = p
+		}
+	}
+	scale := 1.0
+	if max > MaxRingPoints {
+		scale = MaxRingPoints / max
+	}
+	points := make([]int, len(weights))
+	for i, w := range weights {
+		points[i] = int(float64(replicas) * float64(w/g) * scale)
+		if points[i] < 1 {
+			points[i] = 1
+		}
+	}
+	return points
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,44 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+package bus
+
+import (
+	"context"
+
+	"airman.com/airfk/pkg/server"
+)
+
+// PublicBusAPI is the RPC API peers use to receive the messages published on
+// this node.
+type PublicBusAPI struct {
+	b *Bus
+}
+
+// Messages subscribes to the messages published on this node. A peer that
+// reconnects passes the instance and sequence number of the last notification
+// it has seen to receive the buffered messages it missed. If this node was
+// restarted in the meantime, all buffered messages are replayed.
+func (api *PublicBusAPI) Messages(ctx context.Context, instance string, from *uint64) (*server.Subscription, error) {
+	notifier, supported := server.NotifierFromContext(ctx)
+	if !supported {
+		return nil, server.ErrNotificationsUnsupported
+	}
+	if instance != "" && instance != api.b.instance {
+		from = new(uint64)
+	}
+	return api.b.replay.Subscribe(notifier, from)
+}
@@ -0,0 +1,326 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package bus federates topic-based events across nodes.
+//
+// Every node serves its locally published messages as a resumable JSON-RPC
+// subscription (bus_subscribe "messages") and subscribes to the same stream
+// of every peer over WebSocket. Messages received from peers are delivered to
+// local subscribers only and are never forwarded again, so the mesh can't
+// loop. Links resume from the last sequence number they have seen after a
+// reconnect, which gives at-least-once delivery as long as the peer still
+// buffers the missed messages, or still has them in its event log if it keeps
+// one. Duplicates are dropped by message id.
+package bus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"airman.com/airfk/pkg/event"
+	"airman.com/airfk/pkg/leveldb"
+	"airman.com/airfk/pkg/server"
+	ts "airman.com/airfk/pkg/types"
+)
+
+const (
+	DefaultSeenCacheSize     = 4096
+	DefaultReconnectInterval = time.Second
+	DefaultOrigin            = "http://localhost"
+)
+
+var ErrBusClosed = errors.New("bus closed")
+
+// Message is a published event.
+type Message struct {
+	ID       string          `json:"id"`       // unique message id
+	Origin   string          `json:"origin"`   // node that published the message
+	Instance string          `json:"instance"` // process instance of the origin, changes on restart
+	Topic    string          `json:"topic"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// Decode unmarshals the message payload into v.
+func (m *Message) Decode(v interface{}) error {
+	return json.Unmarshal(m.Data, v)
+}
+
+// Config contains the settings of a Bus.
+type Config struct {
+	NodeID            string        // id of this node, should match its registry node id
+	ReplaySize        int           // number of published messages buffered for reconnecting peers
+	SeenCacheSize     int           // number of message ids remembered for deduplication
+	ReconnectInterval time.Duration // delay between connection attempts to a peer
+	Origin            string        // origin header sent to peers
+
+	// Log, if set, stores the published messages so reconnecting peers can
+	// catch up beyond ReplaySize. It must not be shared with other writers.
+	Log *leveldb.EventLog
+	// Keepalive contains the ping and deadline settings of the links to
+	// peers, server.DefaultWSConfig if zero.
+	Keepalive server.WSConfig
+}
+
+// Bus is a node of a federated event bus.
+type Bus struct {
+	config    Config
+	instance  string
+	published uint64 // number of published messages, accessed atomically
+	mux       event.Mux
+	replay    *server.ReplayBuffer
+	pubMu     sync.Mutex // keeps the sequence numbers of replay and log aligned
+	logBase   uint64     // offset of the log before the first message of this instance
+
+	seenMu   sync.Mutex
+	seen     map[string]struct{}
+	seenRing []string
+	seenPos  int
+
+	mu        sync.Mutex
+	peers     map[string]*peer
+	discovery chan struct{} // closed to stop discovery
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// New creates a bus node. Its RPC API must be served over WebSocket for peers
+// to receive the messages published on this node, see APIs.
+func New(config Config) *Bus {
+	if config.NodeID == "" {
+		config.NodeID = string(server.NewID())
+	}
+	if config.ReplaySize <= 0 {
+		config.ReplaySize = server.DefaultReplaySize
+	}
+	if config.SeenCacheSize <= 0 {
+		config.SeenCacheSize = DefaultSeenCacheSize
+	}
+	if config.ReconnectInterval <= 0 {
+		config.ReconnectInterval = DefaultReconnectInterval
+	}
+	if config.Origin == "" {
+		config.Origin = DefaultOrigin
+	}
+	if config.Keepalive == (server.WSConfig{}) {
+		config.Keepalive = server.DefaultWSConfig
+	}
+	b := &Bus{
+		config:    config,
+		instance:  string(server.NewID()),
+		replay:    server.NewReplayBuffer(config.ReplaySize),
+		seen:      make(map[string]struct{}, config.SeenCacheSize),
+		seenRing:  make([]string, config.SeenCacheSize),
+		peers:     make(map[string]*peer),
+		discovery: make(chan struct{}),
+	}
+	if config.Log != nil {
+		b.logBase = config.Log.Last()
+		b.replay.SetSource(b.loadMessages)
+	}
+	return b
+}
+
+// NodeID returns the id of this node.
+func (b *Bus) NodeID() string {
+	return b.config.NodeID
+}
+
+// APIs returns the RPC API peers subscribe to.
+func (b *Bus) APIs() []ts.API {
+	return []ts.API{
+		{
+			Namespace: "bus",
+			Version:   "1.0",
+			Service:   &PublicBusAPI{b},
+			Public:    true,
+		},
+	}
+}
+
+// Publish delivers data under topic to the local subscribers and to the
+// subscribers of all peers. Data is encoded as JSON.
+func (b *Bus) Publish(topic string, data interface{}) error {
+	b.mu.Lock()
+	closed := b.closed
+	b.mu.Unlock()
+	if closed {
+		return ErrBusClosed
+	}
+
+	enc, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	msg := &Message{
+		ID:       messageID(b.instance, atomic.AddUint64(&b.published, 1)),
+		Origin:   b.config.NodeID,
+		Instance: b.instance,
+		Topic:    topic,
+		Data:     enc,
+	}
+	if err := b.send(msg); err != nil {
+		return err
+	}
+	b.mux.Post(topic, msg)
+	return nil
+}
+
+// send appends msg to the log, if any, and queues it for the peers. The n-th
+// message of this instance has sequence number n in the replay buffer and
+// offset logBase+n in the log.
+func (b *Bus) send(msg *Message) error {
+	b.pubMu.Lock()
+	defer b.pubMu.Unlock()
+
+	if b.config.Log != nil {
+		enc, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if _, err := b.config.Log.Append(enc); err != nil {
+			return err
+		}
+	}
+	b.replay.Send(msg)
+	return nil
+}
+
+// loadMessages reads the messages with sequence numbers from first to last
+// from the log, for peers that missed more than the replay buffer holds.
+func (b *Bus) loadMessages(first, last uint64) (uint64, []interface{}, error) {
+	events, err := b.config.Log.Read(b.logBase+first, int(last-first+1))
+	if err != nil || len(events) == 0 {
+		return first, nil, err
+	}
+	msgs := make([]interface{}, 0, len(events))
+	for _, ev := range events {
+		msg := new(Message)
+		if err := json.Unmarshal(ev.Data, msg); err != nil {
+			return first, nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return events[0].Offset - b.logBase, msgs, nil
+}
+
+// Subscribe delivers the messages whose topic matches pattern on channel, see
+// event.Mux for the pattern syntax. The channel element type must be *Message
+// or event.TopicEvent.
+func (b *Bus) Subscribe(pattern string, channel interface{}) event.Subscription {
+	return b.mux.Subscribe(pattern, channel)
+}
+
+// Join connects to the peer with the given id, listening at the WebSocket url.
+// Joining a known peer or this node itself does nothing.
+func (b *Bus) Join(id, url string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed || id == b.config.NodeID {
+		return
+	}
+	if _, ok := b.peers[id]; ok {
+		return
+	}
+	p := newPeer(b, id, url)
+	b.peers[id] = p
+	b.wg.Add(1)
+	go p.loop()
+	log.Infof("bus %s joined peer %s at %s", b.config.NodeID, id, url)
+}
+
+// Leave disconnects from the peer with the given id.
+func (b *Bus) Leave(id string) {
+	b.mu.Lock()
+	p, ok := b.peers[id]
+	delete(b.peers, id)
+	b.mu.Unlock()
+
+	if ok {
+		p.close()
+		log.Infof("bus %s left peer %s", b.config.NodeID, id)
+	}
+}
+
+// Peers returns the ids of the joined peers.
+func (b *Bus) Peers() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ids := make([]string, 0, len(b.peers))
+	for id := range b.peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Close disconnects from all peers and ends all local subscriptions.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	close(b.discovery)
+	peers := b.peers
+	b.peers = make(map[string]*peer)
+	b.mu.Unlock()
+
+	// Closing the mux first unblocks links delivering to slow subscribers.
+	b.mux.Close()
+	for _, p := range peers {
+		p.close()
+	}
+	b.wg.Wait()
+}
+
+// receive delivers a message received from a peer to the local subscribers.
+func (b *Bus) receive(msg *Message) {
+	if msg.Origin == b.config.NodeID || !b.markSeen(msg.ID) {
+		return
+	}
+	b.mux.Post(msg.Topic, msg)
+}
+
+// markSeen records a message id and reports whether it was new.
+func (b *Bus) markSeen(id string) bool {
+	b.seenMu.Lock()
+	defer b.seenMu.Unlock()
+
+	if _, ok := b.seen[id]; ok {
+		return false
+	}
+	if old := b.seenRing[b.seenPos]; old != "" {
+		delete(b.seen, old)
+	}
+	b.seenRing[b.seenPos] = id
+	b.seenPos = (b.seenPos + 1) % len(b.seenRing)
+	b.seen[id] = struct{}{}
+	return true
+}
+
+func messageID(instance string, seq uint64) string {
+	return fmt.Sprintf("%s-%d", instance, seq)
+}
@@ -0,0 +1,297 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+package bus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"airman.com/airfk/pkg/leveldb"
+	"airman.com/airfk/pkg/registry"
+	"airman.com/airfk/pkg/server"
+)
+
+type testNode struct {
+	*Bus
+	url  string
+	host string
+	port int
+}
+
+func newTestNode(t *testing.T, id string) (*testNode, func()) {
+	return newTestNodeWithConfig(t, Config{NodeID: id, ReconnectInterval: 20 * time.Millisecond})
+}
+
+func newTestNodeWithConfig(t *testing.T, config Config) (*testNode, func()) {
+	b := New(config)
+	listener, srv, err := server.StartWSEndpoint("127.0.0.1:0", b.APIs(), nil, []string{"*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	node := &testNode{
+		Bus:  b,
+		url:  "ws://" + addr.String(),
+		host: addr.IP.String(),
+		port: addr.Port,
+	}
+	return node, func() {
+		b.Close()
+		listener.Close()
+		srv.Stop()
+	}
+}
+
+// connect joins all nodes to each other and waits until the links are up.
+func connect(t *testing.T, nodes ...*testNode) {
+	for _, a := range nodes {
+		for _, b := range nodes {
+			a.Join(b.NodeID(), b.url)
+		}
+	}
+	for _, n := range nodes {
+		waitLinks(t, n, len(nodes)-1)
+	}
+}
+
+// waitLinks waits until n links are subscribed to the messages of node.
+func waitLinks(t *testing.T, node *testNode, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for node.replay.Count() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("node %s has %d links, want %d", node.NodeID(), node.replay.Count(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func expectMessages(t *testing.T, ch <-chan *Message, topic string, values ...int) {
+	for _, want := range values {
+		select {
+		case msg := <-ch:
+			var v int
+			if err := msg.Decode(&v); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Topic != topic || v != want {
+				t.Fatalf("got message %s %d, want %s %d", msg.Topic, v, topic, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for message %d", want)
+		}
+	}
+}
+
+func expectNoMessage(t *testing.T, ch <-chan *Message) {
+	select {
+	case msg := <-ch:
+		t.Fatalf("unexpected message %s %s from %s", msg.Topic, msg.Data, msg.Origin)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBusFederation(t *testing.T) {
+	var (
+		nodes []*testNode
+		chans []chan *Message
+	)
+	for i := 0; i < 3; i++ {
+		node, cleanup := newTestNode(t, fmt.Sprintf("node%d", i))
+		defer cleanup()
+		ch := make(chan *Message, 10)
+		node.Subscribe("orders.*", ch)
+		nodes, chans = append(nodes, node), append(chans, ch)
+	}
+	connect(t, nodes...)
+
+	if err := nodes[0].Publish("orders.created", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[1].Publish("orders.created", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[2].Publish("users.created", 3); err != nil {
+		t.Fatal(err)
+	}
+	for i, ch := range chans {
+		got := make(map[int]bool)
+		for j := 0; j < 2; j++ {
+			select {
+			case msg := <-ch:
+				var v int
+				msg.Decode(&v)
+				if got[v] {
+					t.Fatalf("node %d received message %d twice", i, v)
+				}
+				got[v] = true
+			case <-time.After(2 * time.Second):
+				t.Fatalf("node %d received %d of 2 messages", i, j)
+			}
+		}
+		// Nothing is forwarded again or delivered for other topics.
+		expectNoMessage(t, ch)
+	}
+}
+
+func TestBusReconnect(t *testing.T) {
+	testBusReconnect(t, Config{NodeID: "a"})
+}
+
+func TestBusReconnectFromLog(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "bus_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirname)
+	db, err := leveldb.NewLDBDatabase(dirname, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	evlog, err := leveldb.NewEventLog(db, "bus", leveldb.EventLogConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer evlog.Close()
+
+	// The outage is longer than the replay buffer, the rest comes from the log.
+	testBusReconnect(t, Config{NodeID: "a", ReplaySize: 3, Log: evlog})
+	if last := evlog.Last(); last != 11 {
+		t.Fatalf("log has %d messages, want 11", last)
+	}
+}
+
+func testBusReconnect(t *testing.T, config Config) {
+	a, cleanupA := newTestNodeWithConfig(t, config)
+	defer cleanupA()
+	b, cleanupB := newTestNodeWithConfig(t, Config{NodeID: "b", ReconnectInterval: 500 * time.Millisecond})
+	defer cleanupB()
+
+	ch := make(chan *Message, 100)
+	b.Subscribe("counter", ch)
+	b.Join(a.NodeID(), a.url)
+	waitLinks(t, a, 1)
+
+	a.Publish("counter", 0)
+	expectMessages(t, ch, "counter", 0)
+
+	// Messages published while the link is down are replayed on reconnect.
+	b.mu.Lock()
+	link := b.peers[a.NodeID()]
+	b.mu.Unlock()
+	link.disconnect()
+	waitLinks(t, a, 0)
+	for i := 1; i <= 10; i++ {
+		a.Publish("counter", i)
+	}
+	expectNoMessage(t, ch)
+	expectMessages(t, ch, "counter", 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+	expectNoMessage(t, ch)
+}
+
+func TestBusLinkKeepalive(t *testing.T) {
+	// The peer accepts links but never reads, so pings are not answered.
+	var upgrades int32
+	upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&upgrades, 1)
+		<-r.Context().Done()
+		conn.Close()
+	}))
+	defer srv.Close()
+
+	b := New(Config{
+		NodeID:            "b",
+		ReconnectInterval: 10 * time.Millisecond,
+		Keepalive:         server.WSConfig{PingInterval: 20 * time.Millisecond, PongTimeout: 20 * time.Millisecond},
+	})
+	defer b.Close()
+	b.Join("silent", "ws"+strings.TrimPrefix(srv.URL, "http"))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&upgrades) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("dead link was not reconnected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBusLoopPrevention(t *testing.T) {
+	a, cleanup := newTestNode(t, "a")
+	defer cleanup()
+
+	// A link to itself under another id must not deliver own messages twice.
+	ch := make(chan *Message, 10)
+	a.Subscribe(">", ch)
+	a.Join("alias", a.url)
+	waitLinks(t, a, 1)
+
+	a.Publish("topic", 1)
+	expectMessages(t, ch, "topic", 1)
+	expectNoMessage(t, ch)
+}
+
+type testDiscovery struct {
+	nodes []*registry.Node
+}
+
+func (d *testDiscovery) GetService(name, tag string) ([]*registry.Service, error) {
+	return []*registry.Service{{Name: name, Nodes: d.nodes}}, nil
+}
+
+func TestBusDiscovery(t *testing.T) {
+	a, cleanupA := newTestNode(t, "a")
+	defer cleanupA()
+	b, cleanupB := newTestNode(t, "b")
+	defer cleanupB()
+
+	d := &testDiscovery{nodes: []*registry.Node{
+		{Id: "a", Host: a.host, Port: a.port},
+		{Id: "b", Host: b.host, Port: b.port},
+	}}
+	if err := a.Sync(d, "bus"); err != nil {
+		t.Fatal(err)
+	}
+	if peers := a.Peers(); len(peers) != 1 || peers[0] != "b" {
+		t.Fatalf("got peers %v after join, want [b]", peers)
+	}
+	waitLinks(t, b, 1)
+
+	d.nodes = d.nodes[:1]
+	if err := a.Sync(d, "bus"); err != nil {
+		t.Fatal(err)
+	}
+	if peers := a.Peers(); len(peers) != 0 {
+		t.Fatalf("got peers %v after leave, want none", peers)
+	}
+	waitLinks(t, b, 0)
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+package bus
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"airman.com/airfk/pkg/registry"
+)
+
+const DefaultDiscoveryInterval = 10 * time.Second
+
+// Discovery finds the nodes of a service. It is implemented by the registries
+// of package registry.
+type Discovery interface {
+	GetService(name, tag string) ([]*registry.Service, error)
+}
+
+// Sync joins the nodes registered for service that are not peers yet and
+// leaves the peers that are no longer registered. Nodes are expected to serve
+// the bus API at their websocket endpoint, or at their registered address if
+// they don't advertise one.
+func (b *Bus) Sync(d Discovery, service string) error {
+	services, err := d.GetService(service, "")
+	if err != nil {
+		return err
+	}
+	nodes := make(map[string]*registry.Node)
+	for _, svc := range services {
+		for _, node := range svc.Nodes {
+			if node.Id != b.config.NodeID {
+				nodes[node.Id] = node
+			}
+		}
+	}
+	for _, id := range b.Peers() {
+		if _, ok := nodes[id]; !ok {
+			b.Leave(id)
+		}
+	}
+	for id, node := range nodes {
+		url, ok := node.Endpoint(registry.ProtocolWS)
+		if !ok {
+			url = fmt.Sprintf("ws://%s:%d", node.Host, node.Port)
+		}
+		b.Join(id, url)
+	}
+	return nil
+}
+
+// Discover keeps the peers in sync with the nodes registered for service,
+// polling d at the given interval until the bus is closed.
+func (b *Bus) Discover(d Discovery, service string, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultDiscoveryInterval
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := b.Sync(d, service); err != nil {
+				log.Errorf("bus %s discovery of %s failed: %v", b.config.NodeID, service, err)
+			}
+			select {
+			case <-ticker.C:
+			case <-b.discovery:
+				return
+			}
+		}
+	}()
+}
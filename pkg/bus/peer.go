@@ -0,0 +1,235 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+package bus
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"airman.com/airfk/pkg/codec"
+)
+
+const peerHandshakeTimeout = 10 * time.Second
+
+// peer is the link to another node. It subscribes to the messages published
+// on the node and reconnects until the peer is left.
+type peer struct {
+	bus *Bus
+	id  string
+	url string
+
+	// position in the message stream of the peer, used to resume
+	instance string
+	seq      *uint64
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+
+	quitOnce sync.Once
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+func newPeer(b *Bus, id, url string) *peer {
+	return &peer{
+		bus:  b,
+		id:   id,
+		url:  url,
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// close disconnects from the peer and waits for the link to shut down.
+func (p *peer) close() {
+	p.quitOnce.Do(func() {
+		close(p.quit)
+		p.disconnect()
+	})
+	<-p.done
+}
+
+// disconnect closes the current connection, the link reconnects unless it
+// is closed.
+func (p *peer) disconnect() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+	}
+}
+
+func (p *peer) loop() {
+	defer p.bus.wg.Done()
+	defer close(p.done)
+
+	for {
+		err := p.run()
+		select {
+		case <-p.quit:
+			return
+		default:
+		}
+		log.Warnf("bus %s link to peer %s failed: %v", p.bus.config.NodeID, p.id, err)
+
+		timer := time.NewTimer(p.bus.config.ReconnectInterval)
+		select {
+		case <-timer.C:
+		case <-p.quit:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// run connects to the peer and receives messages until the connection fails.
+func (p *peer) run() error {
+	dialer := websocket.Dialer{HandshakeTimeout: peerHandshakeTimeout}
+	header := http.Header{"Origin": []string{p.bus.config.Origin}}
+	conn, _, err := dialer.Dial(p.url, header)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.conn = conn
+	p.mu.Unlock()
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	defer func() {
+		p.mu.Lock()
+		p.conn = nil
+		p.mu.Unlock()
+		conn.Close()
+		close(stop)
+		<-stopped
+	}()
+	p.extendDeadline(conn)
+	conn.SetPongHandler(func(string) error {
+		p.extendDeadline(conn)
+		return nil
+	})
+	go p.keepalive(conn, stop, stopped)
+
+	// The link may have been closed while dialing.
+	select {
+	case <-p.quit:
+		return nil
+	default:
+	}
+
+	request := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "bus_subscribe",
+		"params":  []interface{}{"messages", p.instance, p.seq},
+	}
+	if timeout := p.bus.config.Keepalive.WriteTimeout; timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	if err := conn.WriteJSON(request); err != nil {
+		return err
+	}
+	var response struct {
+		Result string           `json:"result"`
+		Error  *codec.JsonError `json:"error"`
+	}
+	if err := conn.ReadJSON(&response); err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return errors.New(response.Error.Message)
+	}
+
+	for {
+		var notification struct {
+			Params struct {
+				Subscription string   `json:"subscription"`
+				Seq          uint64   `json:"seq"`
+				Result       *Message `json:"result"`
+			} `json:"params"`
+		}
+		if err := conn.ReadJSON(&notification); err != nil {
+			return err
+		}
+		p.extendDeadline(conn)
+		params := notification.Params
+		if params.Subscription != response.Result || params.Result == nil {
+			continue
+		}
+		msg := params.Result
+		if err := p.advance(msg.Instance, params.Seq); err != nil {
+			log.Warnf("bus %s link to peer %s: %v", p.bus.config.NodeID, p.id, err)
+		}
+		p.bus.receive(msg)
+	}
+}
+
+// keepalive pings the peer until stop is closed. A failed ping closes the
+// connection, which ends the read loop of run.
+func (p *peer) keepalive(conn *websocket.Conn, stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+
+	config := p.bus.config.Keepalive
+	if config.PingInterval <= 0 {
+		<-stop
+		return
+	}
+	ticker := time.NewTicker(config.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			deadline := time.Time{}
+			if config.WriteTimeout > 0 {
+				deadline = time.Now().Add(config.WriteTimeout)
+			}
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				conn.Close()
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// extendDeadline gives the peer until the next ping is answered to send the
+// next message or pong, so a dead connection fails the read instead of
+// hanging it.
+func (p *peer) extendDeadline(conn *websocket.Conn) {
+	config := p.bus.config.Keepalive
+	if config.PingInterval > 0 && config.PongTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(config.PingInterval + config.PongTimeout))
+	}
+}
+
+// advance records the position of a received notification. It returns an
+// error if notifications were lost.
+func (p *peer) advance(instance string, seq uint64) error {
+	var err error
+	if instance == p.instance && p.seq != nil && seq > *p.seq+1 {
+		err = fmt.Errorf("lost %d messages", seq-*p.seq-1)
+	}
+	p.instance = instance
+	p.seq = &seq
+	return err
+}
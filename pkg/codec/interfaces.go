@@ -45,3 +45,11 @@ type ServerCodec interface {
 	// Closed when underlying connection is closed
 	Closed() <-chan interface{}
 }
+
+// SeqNotifier is implemented by server codecs that can number notifications
+// so resumed subscriptions can tell which ones they missed. Codecs without it
+// send sequenced notifications as plain ones.
+type SeqNotifier interface {
+	// Create notification response carrying a sequence number
+	CreateNotificationWithSeq(id, namespace string, seq uint64, event interface{}) interface{}
+}
@@ -64,6 +64,7 @@ type JsonErrResponse struct {
 
 type JsonSubscription struct {
 	Subscription string      `json:"subscription"`
+	Seq          uint64      `json:"seq,omitempty"`
 	Result       interface{} `json:"result,omitempty"`
 }
 
@@ -85,6 +86,8 @@ type JsonCodec struct {
 	rw     io.ReadWriteCloser        // connection
 }
 
+var _ SeqNotifier = (*JsonCodec)(nil)
+
 func (err *JsonError) Error() string {
 	if err.Message == "" {
 		return fmt.Sprintf("json-rpc error %d", err.Code)
@@ -341,6 +344,13 @@ func (c *JsonCodec) CreateNotification(subid, namespace string, event interface{
 		Params: JsonSubscription{Subscription: subid, Result: event}}
 }
 
+// CreateNotificationWithSeq will create a JSON-RPC notification with the given subscription id,
+// sequence number and event as params.
+func (c *JsonCodec) CreateNotificationWithSeq(subid, namespace string, seq uint64, event interface{}) interface{} {
+	return &JsonNotification{Version: jsonrpcVersion, Method: namespace + notificationMethodSuffix,
+		Params: JsonSubscription{Subscription: subid, Seq: seq, Result: event}}
+}
+
 // Write message to client
 func (c *JsonCodec) Write(res interface{}) error {
 	c.encMu.Lock()
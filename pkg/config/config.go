@@ -0,0 +1,272 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package config keeps the configuration of a service in sync with a
+// registry and delivers typed updates to running code.
+//
+// The values are stored by key in a registry.ConfigSource, e.g. under
+// /airman/_config/<service>/http_modules in etcd. A value is JSON, a value
+// that isn't valid JSON is read as a plain string. The keys of a Store match
+// the json field names of a configuration struct, so Decode can overlay the
+// values on a configuration read from a file.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"airman.com/airfk/pkg/event"
+	"airman.com/airfk/pkg/registry"
+)
+
+var ErrNotFound = errors.New("config value not found")
+
+// feedKey identifies the feed delivering the values of a key as one type.
+type feedKey struct {
+	key string
+	typ reflect.Type
+}
+
+// Store is the configuration of a service, updated from its source.
+type Store struct {
+	source  registry.ConfigSource
+	service string
+
+	mu     sync.RWMutex
+	values map[string][]byte
+	feeds  map[feedKey]*event.Feed
+	scope  event.SubscriptionScope
+
+	sub     event.Subscription
+	updates chan map[string][]byte
+
+	closeOnce sync.Once
+	quit      chan struct{}
+	done      chan struct{}
+}
+
+// New reads the configuration of service from source and keeps it up to date
+// until the store is closed.
+func New(source registry.ConfigSource, service string) (*Store, error) {
+	values, err := source.GetConfig(service)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		source:  source,
+		service: service,
+		values:  values,
+		feeds:   make(map[feedKey]*event.Feed),
+		updates: make(chan map[string][]byte, 1),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if s.sub, err = source.WatchConfig(service, s.updates); err != nil {
+		return nil, err
+	}
+	go s.loop()
+	return s, nil
+}
+
+func (s *Store) loop() {
+	defer close(s.done)
+	for {
+		select {
+		case values := <-s.updates:
+			s.apply(values)
+		case err := <-s.sub.Err():
+			if err != nil {
+				log.Errorf("config watch %s failed: %v", s.service, err)
+			}
+			return
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// apply replaces the values and announces the changed keys to their
+// subscribers. Removed keys are announced as zero values.
+func (s *Store) apply(values map[string][]byte) {
+	s.mu.Lock()
+	changed := make(map[string]bool)
+	for key, value := range values {
+		if old, ok := s.values[key]; !ok || string(old) != string(value) {
+			changed[key] = true
+		}
+	}
+	for key := range s.values {
+		if _, ok := values[key]; !ok {
+			changed[key] = true
+		}
+	}
+	s.values = values
+	type delivery struct {
+		typ  reflect.Type
+		feed *event.Feed
+		data []byte
+	}
+	var deliveries []delivery
+	for fk, feed := range s.feeds {
+		if changed[fk.key] {
+			deliveries = append(deliveries, delivery{fk.typ, feed, values[fk.key]})
+		}
+	}
+	s.mu.Unlock()
+
+	for _, d := range deliveries {
+		v := reflect.New(d.typ)
+		if d.data != nil {
+			if err := decode(d.data, v.Interface()); err != nil {
+				log.Warnf("config %s: invalid value for %s: %v", s.service, d.typ, err)
+				continue
+			}
+		}
+		d.feed.Send(v.Elem().Interface())
+	}
+}
+
+// decode unmarshals data into v. A value that isn't JSON is taken as a
+// string.
+func decode(data []byte, v interface{}) error {
+	if p, ok := v.(*string); ok && !json.Valid(data) {
+		*p = string(data)
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Get decodes the value of key into v.
+func (s *Store) Get(key string, v interface{}) error {
+	s.mu.RLock()
+	data, ok := s.values[key]
+	s.mu.RUnlock()
+	if !ok {
+		return ErrNotFound
+	}
+	return decode(data, v)
+}
+
+// Keys returns the keys with a value.
+func (s *Store) Keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Decode overlays the values on v, a pointer to a struct whose json field
+// names are the keys. Fields without a value keep their contents.
+func (s *Store) Decode(v interface{}) error {
+	s.mu.RLock()
+	object := make(map[string]json.RawMessage, len(s.values))
+	for key, data := range s.values {
+		if json.Valid(data) {
+			object[key] = data
+		} else {
+			object[key], _ = json.Marshal(string(data))
+		}
+	}
+	s.mu.RUnlock()
+
+	enc, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(enc, v)
+}
+
+// Put stores v encoded as JSON under key.
+func (s *Store) Put(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.source.PutConfig(s.service, key, data)
+}
+
+// Delete removes the value of key.
+func (s *Store) Delete(key string) error {
+	return s.source.DeleteConfig(s.service, key)
+}
+
+// Subscribe delivers the value of key on ch whenever it changes, decoded into
+// the element type of ch, e.g. a chan []string for a list of modules. A
+// removed value is delivered as the zero value. Use Get for the current
+// value. Subscribe panics if ch isn't a channel that can be sent to.
+func (s *Store) Subscribe(key string, ch interface{}) event.Subscription {
+	chanval := reflect.ValueOf(ch)
+	chantyp := chanval.Type()
+	if chantyp.Kind() != reflect.Chan || chantyp.ChanDir()&reflect.SendDir == 0 {
+		panic("config: Subscribe argument does not have sendable channel type")
+	}
+	fk := feedKey{key, chantyp.Elem()}
+
+	s.mu.Lock()
+	feed, ok := s.feeds[fk]
+	if !ok {
+		feed = new(event.Feed)
+		s.feeds[fk] = feed
+	}
+	s.mu.Unlock()
+	return s.scope.Track(feed.Subscribe(ch))
+}
+
+// FollowList calls fn with the list stored under key, e.g. http_modules, and
+// again whenever it changes, until the returned subscription ends. A removed
+// list is passed as nil. Running endpoints can be updated this way, e.g. with
+// server.Server.SetModules. FollowList returns nil if the store is closed.
+func (s *Store) FollowList(key string, fn func([]string)) event.Subscription {
+	ch := make(chan []string)
+	sub := s.Subscribe(key, ch)
+	if sub == nil {
+		return nil
+	}
+	go func() {
+		var list []string
+		if err := s.Get(key, &list); err == nil {
+			fn(list)
+		}
+		for {
+			select {
+			case list := <-ch:
+				fn(list)
+			case <-sub.Err():
+				return
+			}
+		}
+	}()
+	return sub
+}
+
+// Close stops following the source and ends all subscriptions.
+func (s *Store) Close() {
+	s.closeOnce.Do(func() {
+		close(s.quit)
+		s.sub.Unsubscribe()
+		<-s.done
+		s.scope.Close()
+	})
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"airman.com/airfk/pkg/registry"
+)
+
+type testConfig struct {
+	Name        string   `json:"name"`
+	HTTPPort    int      `json:"http_port"`
+	HTTPModules []string `json:"http_modules"`
+}
+
+func TestStore(t *testing.T) {
+	r := registry.NewMemoryRegistry()
+	r.PutConfig("task", "http_modules", []byte(`["admin"]`))
+	r.PutConfig("task", "name", []byte("task-1"))
+
+	s, err := New(r, "task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var modules []string
+	if err := s.Get("http_modules", &modules); err != nil || !reflect.DeepEqual(modules, []string{"admin"}) {
+		t.Fatalf("modules %v %v", modules, err)
+	}
+	var name string
+	if err := s.Get("name", &name); err != nil || name != "task-1" {
+		t.Fatalf("plain string %q %v", name, err)
+	}
+	if err := s.Get("http_port", new(int)); err != ErrNotFound {
+		t.Fatalf("missing value: %v", err)
+	}
+	if keys := s.Keys(); !reflect.DeepEqual(keys, []string{"http_modules", "name"}) {
+		t.Fatalf("keys %v", keys)
+	}
+
+	conf := testConfig{Name: "file", HTTPPort: 5050}
+	if err := s.Decode(&conf); err != nil {
+		t.Fatal(err)
+	}
+	want := testConfig{Name: "task-1", HTTPPort: 5050, HTTPModules: []string{"admin"}}
+	if !reflect.DeepEqual(conf, want) {
+		t.Fatalf("decoded %+v", conf)
+	}
+}
+
+func TestStoreSubscribe(t *testing.T) {
+	r := registry.NewMemoryRegistry()
+	s, err := New(r, "task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	modules := make(chan []string, 4)
+	ports := make(chan int, 4)
+	defer s.Subscribe("http_modules", modules).Unsubscribe()
+	defer s.Subscribe("http_port", ports).Unsubscribe()
+
+	if err := s.Put("http_modules", []string{"admin", "task"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-modules:
+		if !reflect.DeepEqual(got, []string{"admin", "task"}) {
+			t.Fatalf("modules %v", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no modules update")
+	}
+
+	if err := s.Put("http_port", 6060); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-ports:
+		if got != 6060 {
+			t.Fatalf("port %d", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no port update")
+	}
+	select {
+	case got := <-modules:
+		t.Fatalf("unchanged modules delivered: %v", got)
+	default:
+	}
+
+	// A removed value is delivered as the zero value.
+	if err := s.Delete("http_modules"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-modules:
+		if got != nil {
+			t.Fatalf("modules after delete %v", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no delete update")
+	}
+}
+
+func TestStoreFollowList(t *testing.T) {
+	r := registry.NewMemoryRegistry()
+	r.PutConfig("task", "http_origins", []byte(`["http://a.com"]`))
+	s, err := New(r, "task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	origins := make(chan []string, 4)
+	sub := s.FollowList("http_origins", func(list []string) { origins <- list })
+	defer sub.Unsubscribe()
+	expect := func(want []string) {
+		select {
+		case got := <-origins:
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("origins %v, want %v", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no origins %v", want)
+		}
+	}
+
+	// The current value is passed first.
+	expect([]string{"http://a.com"})
+	if err := s.Put("http_origins", []string{"http://b.com"}); err != nil {
+		t.Fatal(err)
+	}
+	expect([]string{"http://b.com"})
+	if err := s.Delete("http_origins"); err != nil {
+		t.Fatal(err)
+	}
+	expect(nil)
+
+	s.Close()
+	if sub := s.FollowList("http_origins", func([]string) {}); sub != nil {
+		t.Fatal("followed a closed store")
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2016 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package event
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSlowSubscriber is sent on the error channel of an AsyncFeed subscription
+// that didn't accept a value within the send timeout.
+var ErrSlowSubscriber = errors.New("event: subscriber too slow")
+
+// OverflowPolicy determines what AsyncFeed does when the queue of a
+// subscriber is full.
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest queued value to make room
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the value that doesn't fit
+	DropNewest
+	// Block waits for the subscriber to make room, at most SendTimeout
+	Block
+)
+
+// DefaultAsyncQueueSize is the number of values buffered per subscriber when
+// no size is configured.
+const DefaultAsyncQueueSize = 256
+
+// AsyncFeedConfig holds the delivery settings of an AsyncFeed.
+type AsyncFeedConfig struct {
+	QueueSize       int            // maximum number of undelivered values per subscriber
+	Overflow        OverflowPolicy // what to do when a queue is full
+	SendTimeout     time.Duration  // with Block, how long Send waits for slow subscribers, zero waits forever
+	UnsubscribeSlow bool           // with Block, unsubscribe slow subscribers instead of skipping them
+}
+
+// AsyncFeed is like Feed but delivers asynchronously: every subscriber has a
+// bounded queue drained by its own goroutine, so a stuck consumer doesn't
+// freeze the producers. What happens when a queue is full is determined by
+// the overflow policy of the feed.
+//
+// AsyncFeeds can only be used with a single type, like Feed.
+//
+// The zero value is ready to use and drops the oldest values of subscribers
+// that fall behind.
+type AsyncFeed struct {
+	Config AsyncFeedConfig
+
+	mu    sync.RWMutex
+	subs  map[*AsyncSubscription]struct{}
+	etype reflect.Type
+}
+
+// NewAsyncFeed creates a feed with the given delivery settings.
+func NewAsyncFeed(config AsyncFeedConfig) *AsyncFeed {
+	return &AsyncFeed{Config: config}
+}
+
+// Subscribe adds a channel to the feed. Future sends will be queued for the
+// channel until the subscription is canceled. All channels added must have the
+// same element type.
+func (f *AsyncFeed) Subscribe(channel interface{}) *AsyncSubscription {
+	chanval := reflect.ValueOf(channel)
+	chantyp := chanval.Type()
+	if chantyp.Kind() != reflect.Chan || chantyp.ChanDir()&reflect.SendDir == 0 {
+		panic(errBadChannel)
+	}
+	size := f.Config.QueueSize
+	if size <= 0 {
+		size = DefaultAsyncQueueSize
+	}
+	sub := &AsyncSubscription{
+		feed:    f,
+		channel: chanval,
+		size:    size,
+		wakeup:  make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		err:     make(chan error, 1),
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.typecheck(chantyp.Elem()) {
+		panic(feedTypeError{op: "Subscribe", got: chantyp, want: reflect.ChanOf(reflect.SendDir, f.etype)})
+	}
+	if f.subs == nil {
+		f.subs = make(map[*AsyncSubscription]struct{})
+	}
+	f.subs[sub] = struct{}{}
+	go sub.loop()
+	return sub
+}
+
+// note: callers must hold f.mu
+func (f *AsyncFeed) typecheck(typ reflect.Type) bool {
+	if f.etype == nil {
+		f.etype = typ
+		return true
+	}
+	return f.etype == typ
+}
+
+func (f *AsyncFeed) remove(sub *AsyncSubscription) {
+	f.mu.Lock()
+	delete(f.subs, sub)
+	f.mu.Unlock()
+}
+
+// Send queues the value for all subscribers. It returns the number of
+// subscribers the value was queued for, values dropped by the overflow policy
+// are not counted.
+//
+// Send only blocks with the Block policy, for at most SendTimeout in total.
+func (f *AsyncFeed) Send(value interface{}) (nsent int) {
+	rvalue := reflect.ValueOf(value)
+
+	f.mu.Lock()
+	if !f.typecheck(rvalue.Type()) {
+		f.mu.Unlock()
+		panic(feedTypeError{op: "Send", got: rvalue.Type(), want: f.etype})
+	}
+	subs := make([]*AsyncSubscription, 0, len(f.subs))
+	for sub := range f.subs {
+		subs = append(subs, sub)
+	}
+	f.mu.Unlock()
+
+	// The timeout is shared by all subscribers, closing it releases every
+	// sender that is still blocked once the time is up.
+	var timeout chan struct{}
+	if f.Config.Overflow == Block && f.Config.SendTimeout > 0 {
+		timeout = make(chan struct{})
+		timer := time.AfterFunc(f.Config.SendTimeout, func() { close(timeout) })
+		defer timer.Stop()
+	}
+	for _, sub := range subs {
+		if sub.enqueue(rvalue, f.Config, timeout) {
+			nsent++
+		}
+	}
+	return nsent
+}
+
+// AsyncSubscription is a subscription of an AsyncFeed.
+type AsyncSubscription struct {
+	dropped uint64 // number of discarded values, accessed atomically
+
+	feed    *AsyncFeed
+	channel reflect.Value
+	size    int
+
+	mu     sync.Mutex      // guards queue
+	queue  []reflect.Value // undelivered values, oldest first
+	wakeup chan struct{}   // signals the delivery loop about new values
+	space  chan struct{}   // signals blocked senders that the queue shrunk
+	quit   chan struct{}   // closed when the subscription ends
+
+	errOnce sync.Once
+	err     chan error
+}
+
+// Unsubscribe cancels the delivery of values and closes the error channel.
+// Values that were not delivered yet are discarded.
+func (sub *AsyncSubscription) Unsubscribe() {
+	sub.end(nil)
+}
+
+// Err returns the error channel of the subscription. It receives
+// ErrSlowSubscriber if the subscriber was unsubscribed for being too slow.
+func (sub *AsyncSubscription) Err() <-chan error {
+	return sub.err
+}
+
+// Dropped returns the number of values that were discarded for this
+// subscriber because its queue was full.
+func (sub *AsyncSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// end removes the subscription from the feed. The error channel is closed if
+// err is nil, otherwise err is sent on it.
+func (sub *AsyncSubscription) end(err error) {
+	sub.errOnce.Do(func() {
+		sub.feed.remove(sub)
+		close(sub.quit)
+		if err != nil {
+			sub.err <- err
+		} else {
+			close(sub.err)
+		}
+	})
+}
+
+// enqueue adds a value to the queue and applies the overflow policy. It
+// returns whether the value was queued.
+func (sub *AsyncSubscription) enqueue(value reflect.Value, config AsyncFeedConfig, timeout <-chan struct{}) bool {
+	for {
+		sub.mu.Lock()
+		if len(sub.queue) < sub.size {
+			sub.queue = append(sub.queue, value)
+			sub.mu.Unlock()
+
+			select {
+			case sub.wakeup <- struct{}{}:
+			default:
+			}
+			return true
+		}
+		switch config.Overflow {
+		case DropOldest:
+			copy(sub.queue, sub.queue[1:])
+			sub.queue[len(sub.queue)-1] = value
+			sub.mu.Unlock()
+			atomic.AddUint64(&sub.dropped, 1)
+			return true
+		case DropNewest:
+			sub.mu.Unlock()
+			atomic.AddUint64(&sub.dropped, 1)
+			return false
+		}
+		sub.mu.Unlock()
+
+		// Block until the delivery loop made room.
+		select {
+		case <-sub.space:
+		case <-sub.quit:
+			return false
+		case <-timeout:
+			atomic.AddUint64(&sub.dropped, 1)
+			if config.UnsubscribeSlow {
+				sub.end(ErrSlowSubscriber)
+			}
+			return false
+		}
+	}
+}
+
+// dequeue removes and returns the oldest queued value.
+func (sub *AsyncSubscription) dequeue() (reflect.Value, bool) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if len(sub.queue) == 0 {
+		return reflect.Value{}, false
+	}
+	value := sub.queue[0]
+	sub.queue[0] = reflect.Value{}
+	sub.queue = sub.queue[1:]
+
+	select {
+	case sub.space <- struct{}{}:
+	default:
+	}
+	return value, true
+}
+
+// loop delivers queued values to the subscriber channel until the
+// subscription ends.
+func (sub *AsyncSubscription) loop() {
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(sub.quit)},
+		{Dir: reflect.SelectSend, Chan: sub.channel},
+	}
+	for {
+		select {
+		case <-sub.wakeup:
+		case <-sub.quit:
+			return
+		}
+		for {
+			value, ok := sub.dequeue()
+			if !ok {
+				break
+			}
+			cases[1].Send = value
+			if chosen, _, _ := reflect.Select(cases); chosen == 0 {
+				return
+			}
+		}
+	}
+}
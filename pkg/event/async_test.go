@@ -0,0 +1,217 @@
+// Copyright 2016 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package event
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// queued returns the number of values waiting in the queue.
+func (sub *AsyncSubscription) queued() int {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return len(sub.queue)
+}
+
+// subscribeInFlight subscribes an unbuffered channel that isn't read and sends
+// a first value, which the delivery loop then holds in flight.
+func subscribeInFlight(t *testing.T, feed *AsyncFeed) (chan int, *AsyncSubscription) {
+	ch := make(chan int)
+	sub := feed.Subscribe(ch)
+	if nsent := feed.Send(-1); nsent != 1 {
+		t.Fatalf("first send queued %d times, want 1", nsent)
+	}
+	deadline := time.Now().Add(time.Second)
+	for sub.queued() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("value not picked up by delivery loop")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return ch, sub
+}
+
+func expectValues(t *testing.T, ch chan int, values ...int) {
+	for _, want := range values {
+		select {
+		case v := <-ch:
+			if v != want {
+				t.Fatalf("received %d, want %d", v, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %d", want)
+		}
+	}
+}
+
+func TestAsyncFeedPanics(t *testing.T) {
+	var f AsyncFeed
+	f.Send(int(2))
+	want := feedTypeError{op: "Send", got: reflect.TypeOf(uint64(0)), want: reflect.TypeOf(int(0))}
+	if err := checkPanic(want, func() { f.Send(uint64(2)) }); err != nil {
+		t.Error(err)
+	}
+	want = feedTypeError{op: "Subscribe", got: reflect.TypeOf(make(chan uint64)), want: reflect.TypeOf(make(chan<- int))}
+	if err := checkPanic(want, func() { f.Subscribe(make(chan uint64)) }); err != nil {
+		t.Error(err)
+	}
+	if err := checkPanic(errBadChannel, func() { f.Subscribe(make(<-chan int)) }); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAsyncFeedDropOldest(t *testing.T) {
+	feed := NewAsyncFeed(AsyncFeedConfig{QueueSize: 2, Overflow: DropOldest})
+	ch, sub := subscribeInFlight(t, feed)
+	defer sub.Unsubscribe()
+
+	for i := 0; i < 5; i++ {
+		if nsent := feed.Send(i); nsent != 1 {
+			t.Fatalf("send queued %d times, want 1", nsent)
+		}
+	}
+	if dropped := sub.Dropped(); dropped != 3 {
+		t.Fatalf("dropped %d values, want 3", dropped)
+	}
+	expectValues(t, ch, -1, 3, 4)
+}
+
+func TestAsyncFeedDropNewest(t *testing.T) {
+	feed := NewAsyncFeed(AsyncFeedConfig{QueueSize: 2, Overflow: DropNewest})
+	ch, sub := subscribeInFlight(t, feed)
+	defer sub.Unsubscribe()
+
+	nsent := 0
+	for i := 0; i < 5; i++ {
+		nsent += feed.Send(i)
+	}
+	if nsent != 2 {
+		t.Fatalf("values queued %d times, want 2", nsent)
+	}
+	if dropped := sub.Dropped(); dropped != 3 {
+		t.Fatalf("dropped %d values, want 3", dropped)
+	}
+	expectValues(t, ch, -1, 0, 1)
+}
+
+func TestAsyncFeedSlowSubscriberDoesNotBlock(t *testing.T) {
+	feed := NewAsyncFeed(AsyncFeedConfig{QueueSize: 1, Overflow: Block, SendTimeout: 50 * time.Millisecond})
+	_, slow := subscribeInFlight(t, feed)
+	defer slow.Unsubscribe()
+
+	fast := make(chan int, 10)
+	fastSub := feed.Subscribe(fast)
+	defer fastSub.Unsubscribe()
+
+	feed.Send(1) // fills the queue of the slow subscriber
+	start := time.Now()
+	if nsent := feed.Send(2); nsent != 1 {
+		t.Fatalf("send queued %d times, want 1", nsent)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("send blocked for %v", elapsed)
+	}
+	if dropped := slow.Dropped(); dropped != 1 {
+		t.Fatalf("slow subscriber dropped %d values, want 1", dropped)
+	}
+	expectValues(t, fast, 1, 2)
+
+	// Skipped subscribers stay subscribed.
+	select {
+	case err := <-slow.Err():
+		t.Fatalf("slow subscriber ended: %v", err)
+	default:
+	}
+}
+
+func TestAsyncFeedSlowSubscribersShareTimeout(t *testing.T) {
+	feed := NewAsyncFeed(AsyncFeedConfig{QueueSize: 1, Overflow: Block, SendTimeout: 50 * time.Millisecond})
+	var subs []*AsyncSubscription
+	for i := 0; i < 3; i++ {
+		sub := feed.Subscribe(make(chan int))
+		defer sub.Unsubscribe()
+		subs = append(subs, sub)
+	}
+	feed.Send(-1)
+	deadline := time.Now().Add(time.Second)
+	for _, sub := range subs {
+		for sub.queued() != 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("value not picked up by delivery loop")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	feed.Send(1) // fills the queues of all subscribers
+	done := make(chan int)
+	go func() { done <- feed.Send(2) }()
+	select {
+	case nsent := <-done:
+		if nsent != 0 {
+			t.Fatalf("send queued %d times, want 0", nsent)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("send blocked on slow subscribers after the timeout")
+	}
+	for i, sub := range subs {
+		if dropped := sub.Dropped(); dropped != 1 {
+			t.Fatalf("subscriber %d dropped %d values, want 1", i, dropped)
+		}
+	}
+}
+
+func TestAsyncFeedUnsubscribeSlow(t *testing.T) {
+	feed := NewAsyncFeed(AsyncFeedConfig{QueueSize: 1, Overflow: Block, SendTimeout: 50 * time.Millisecond, UnsubscribeSlow: true})
+	_, sub := subscribeInFlight(t, feed)
+
+	feed.Send(1)
+	if nsent := feed.Send(2); nsent != 0 {
+		t.Fatalf("send queued %d times, want 0", nsent)
+	}
+	select {
+	case err := <-sub.Err():
+		if err != ErrSlowSubscriber {
+			t.Fatalf("expected %v, got %v", ErrSlowSubscriber, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("slow subscriber not unsubscribed")
+	}
+	if nsent := feed.Send(3); nsent != 0 {
+		t.Fatalf("send after unsubscribe queued %d times, want 0", nsent)
+	}
+}
+
+func TestAsyncFeedUnsubscribe(t *testing.T) {
+	var feed AsyncFeed
+	ch := make(chan int, 1)
+	sub := feed.Subscribe(ch)
+
+	feed.Send(1)
+	expectValues(t, ch, 1)
+
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	if _, ok := <-sub.Err(); ok {
+		t.Fatal("error channel not closed after unsubscribe")
+	}
+	if nsent := feed.Send(2); nsent != 0 {
+		t.Fatalf("send after unsubscribe queued %d times, want 0", nsent)
+	}
+}
@@ -37,12 +37,15 @@ type Feed struct {
 	sendLock  chan struct{}    // sendLock has a one-element buffer and is empty when held.It protects sendCases.
 	removeSub chan interface{} // interrupts Send
 	sendCases caseList         // the active set of select cases used by Send
+	sendSubs  subList          // subscriptions of sendCases, at the same index
+	filtered  int              // number of filtered subscriptions in sendSubs, protected by sendLock
 
 	// The inbox holds newly subscribed channels until they are added to sendCases.
-	mu     sync.Mutex
-	inbox  caseList
-	etype  reflect.Type
-	closed bool
+	mu        sync.Mutex
+	inbox     caseList
+	inboxSubs subList
+	etype     reflect.Type
+	closed    bool
 }
 
 // This is the index of the first actual subscription channel in sendCases.
@@ -63,6 +66,7 @@ func (f *Feed) init() {
 	f.sendLock = make(chan struct{}, 1)
 	f.sendLock <- struct{}{}
 	f.sendCases = caseList{{Chan: reflect.ValueOf(f.removeSub), Dir: reflect.SelectRecv}}
+	f.sendSubs = subList{nil}
 }
 
 // Subscribe adds a channel to the feed. Future sends will be delivered on the channel
@@ -71,6 +75,18 @@ func (f *Feed) init() {
 // The channel should have ample buffer space to avoid blocking other subscribers.
 // Slow subscribers are not dropped.
 func (f *Feed) Subscribe(channel interface{}) Subscription {
+	return f.subscribe(channel, nil)
+}
+
+// SubscribeFiltered is like Subscribe, but only values for which predicate
+// returns true are delivered on the channel. The predicate runs in Send before
+// delivery is attempted, so filtered values don't take up channel capacity.
+// It must not block or call methods of the feed.
+func (f *Feed) SubscribeFiltered(channel interface{}, predicate func(value interface{}) bool) Subscription {
+	return f.subscribe(channel, predicate)
+}
+
+func (f *Feed) subscribe(channel interface{}, predicate func(value interface{}) bool) Subscription {
 	f.once.Do(f.init)
 
 	chanval := reflect.ValueOf(channel)
@@ -78,7 +94,7 @@ func (f *Feed) Subscribe(channel interface{}) Subscription {
 	if chantyp.Kind() != reflect.Chan || chantyp.ChanDir()&reflect.SendDir == 0 {
 		panic(errBadChannel)
 	}
-	sub := &feedSub{feed: f, channel: chanval, err: make(chan error, 1)}
+	sub := &feedSub{feed: f, channel: chanval, filter: predicate, err: make(chan error, 1)}
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -89,6 +105,7 @@ func (f *Feed) Subscribe(channel interface{}) Subscription {
 	// The next Send will add it to f.sendCases.
 	cas := reflect.SelectCase{Dir: reflect.SelectSend, Chan: chanval}
 	f.inbox = append(f.inbox, cas)
+	f.inboxSubs = append(f.inboxSubs, sub)
 	return sub
 }
 
@@ -104,26 +121,36 @@ func (f *Feed) typecheck(typ reflect.Type) bool {
 func (f *Feed) remove(sub *feedSub) {
 	// Delete from inbox first, which covers channels
 	// that have not been added to f.sendCases yet.
-	ch := sub.channel.Interface()
 	f.mu.Lock()
-	index := f.inbox.find(ch)
+	index := f.inboxSubs.find(sub)
 	if index != -1 {
 		f.inbox = f.inbox.delete(index)
+		f.inboxSubs = f.inboxSubs.delete(index)
 		f.mu.Unlock()
 		return
 	}
 	f.mu.Unlock()
 
 	select {
-	case f.removeSub <- ch:
+	case f.removeSub <- sub:
 		// Send will remove the channel from f.sendCases.
 	case <-f.sendLock:
 		// No Send is in progress, delete the channel now that we have the send lock.
-		f.sendCases = f.sendCases.delete(f.sendCases.find(ch))
+		f.deleteSub(f.sendSubs.find(sub))
 		f.sendLock <- struct{}{}
 	}
 }
 
+// deleteSub removes the case at index from sendCases and sendSubs.
+// note: callers must hold f.sendLock
+func (f *Feed) deleteSub(index int) {
+	if f.sendSubs[index].filter != nil {
+		f.filtered--
+	}
+	f.sendCases = f.sendCases.delete(index)
+	f.sendSubs = f.sendSubs.delete(index)
+}
+
 // Send delivers to all subscribed channels simultaneously.
 // It returns the number of subscribers that the value was sent to.
 func (f *Feed) Send(value interface{}) (nsent int) {
@@ -135,7 +162,14 @@ func (f *Feed) Send(value interface{}) (nsent int) {
 	// Add new cases from the inbox after taking the send lock.
 	f.mu.Lock()
 	f.sendCases = append(f.sendCases, f.inbox...)
+	f.sendSubs = append(f.sendSubs, f.inboxSubs...)
+	for _, sub := range f.inboxSubs {
+		if sub.filter != nil {
+			f.filtered++
+		}
+	}
 	f.inbox = nil
+	f.inboxSubs = nil
 
 	if !f.typecheck(rvalue.Type()) {
 		f.sendLock <- struct{}{}
@@ -151,7 +185,17 @@ func (f *Feed) Send(value interface{}) (nsent int) {
 	// Send until all channels except removeSub have been chosen. 'cases' tracks a prefix
 	// of sendCases. When a send succeeds, the corresponding case moves to the end of
 	// 'cases' and it shrinks by one element.
-	cases := f.sendCases
+	cases, subs := f.sendCases, f.sendSubs
+
+	// Deactivate the filtered subscriptions that don't want the value.
+	if f.filtered > 0 {
+		for i := firstSubSendCase; i < len(cases); i++ {
+			if filter := subs[i].filter; filter != nil && !filter(value) {
+				cases, subs = cases.deactivate(i), subs.deactivate(i)
+				i--
+			}
+		}
+	}
 	for {
 		// Fast path: try sending without blocking before adding to the select set.
 		// This should usually succeed if subscribers are fast enough and have free
@@ -159,7 +203,7 @@ func (f *Feed) Send(value interface{}) (nsent int) {
 		for i := firstSubSendCase; i < len(cases); i++ {
 			if cases[i].Chan.TrySend(rvalue) {
 				nsent++
-				cases = cases.deactivate(i)
+				cases, subs = cases.deactivate(i), subs.deactivate(i)
 				i--
 			}
 		}
@@ -169,14 +213,14 @@ func (f *Feed) Send(value interface{}) (nsent int) {
 		// Select on all the receivers, waiting for them to unblock.
 		chosen, recv, _ := reflect.Select(cases)
 		if chosen == 0 /* <-f.removeSub */ {
-			index := f.sendCases.find(recv.Interface())
-			f.sendCases = f.sendCases.delete(index)
+			index := f.sendSubs.find(recv.Interface().(*feedSub))
+			f.deleteSub(index)
 			if index >= 0 && index < len(cases) {
 				// Shrink 'cases' too because the removed case was still active.
-				cases = f.sendCases[:len(cases)-1]
+				cases, subs = f.sendCases[:len(cases)-1], f.sendSubs[:len(subs)-1]
 			}
 		} else {
-			cases = cases.deactivate(chosen)
+			cases, subs = cases.deactivate(chosen), subs.deactivate(chosen)
 			nsent++
 		}
 	}
@@ -192,6 +236,7 @@ func (f *Feed) Send(value interface{}) (nsent int) {
 type feedSub struct {
 	feed    *Feed
 	channel reflect.Value
+	filter  func(value interface{}) bool // nil for unfiltered subscriptions
 	errOnce sync.Once
 	err     chan error
 }
@@ -207,18 +252,33 @@ func (sub *feedSub) Err() <-chan error {
 	return sub.err
 }
 
-type caseList []reflect.SelectCase
+// subList holds the subscriptions of a caseList at the same indices.
+type subList []*feedSub
 
-// find returns the index of a case containing the given channel.
-func (cs caseList) find(channel interface{}) int {
-	for i, cas := range cs {
-		if cas.Chan.Interface() == channel {
+// find returns the index of the given subscription.
+func (ss subList) find(sub *feedSub) int {
+	for i, s := range ss {
+		if s == sub {
 			return i
 		}
 	}
 	return -1
 }
 
+// delete removes the given subscription from ss.
+func (ss subList) delete(index int) subList {
+	return append(ss[:index], ss[index+1:]...)
+}
+
+// deactivate moves the subscription at index into the non-accessible portion of the ss slice.
+func (ss subList) deactivate(index int) subList {
+	last := len(ss) - 1
+	ss[index], ss[last] = ss[last], ss[index]
+	return ss[:last]
+}
+
+type caseList []reflect.SelectCase
+
 // delete removes the given case from cs.
 func (cs caseList) delete(index int) caseList {
 	return append(cs[:index], cs[index+1:]...)
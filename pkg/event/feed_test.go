@@ -301,6 +301,86 @@ func TestFeedUnsubscribeFromInbox(t *testing.T) {
 	}
 }
 
+func TestFeedSubscribeFiltered(t *testing.T) {
+	var (
+		feed  Feed
+		evens = make(chan int, 10)
+		all   = make(chan int, 10)
+	)
+	sub1 := feed.SubscribeFiltered(evens, func(v interface{}) bool { return v.(int)%2 == 0 })
+	sub2 := feed.Subscribe(all)
+	defer sub2.Unsubscribe()
+
+	for i := 0; i < 6; i++ {
+		want := 1
+		if i%2 == 0 {
+			want = 2
+		}
+		if n := feed.Send(i); n != want {
+			t.Fatalf("send %d delivered to %d subscribers, want %d", i, n, want)
+		}
+	}
+	if len(evens) != 3 || len(all) != 6 {
+		t.Fatalf("wrong delivery count: evens %d, all %d", len(evens), len(all))
+	}
+	for _, want := range []int{0, 2, 4} {
+		if v := <-evens; v != want {
+			t.Errorf("filtered subscriber got %d, want %d", v, want)
+		}
+	}
+
+	sub1.Unsubscribe()
+	if _, ok := <-sub1.Err(); ok {
+		t.Errorf("error channel not closed after unsubscribe")
+	}
+	if n := feed.Send(8); n != 1 {
+		t.Errorf("send after unsubscribe delivered to %d subscribers, want 1", n)
+	}
+	if feed.filtered != 0 {
+		t.Errorf("filtered count is %d after unsubscribe", feed.filtered)
+	}
+}
+
+func TestFeedSubscribeFilteredSameChannel(t *testing.T) {
+	var (
+		feed Feed
+		ch   = make(chan int, 10)
+		sub1 = feed.SubscribeFiltered(ch, func(v interface{}) bool { return false })
+		sub2 = feed.Subscribe(ch)
+	)
+	defer sub2.Unsubscribe()
+
+	if n := feed.Send(1); n != 1 {
+		t.Fatalf("send delivered to %d subscribers, want 1", n)
+	}
+	// Removing the filtered subscription must not remove the unfiltered one
+	// sharing its channel.
+	sub1.Unsubscribe()
+	if n := feed.Send(2); n != 1 {
+		t.Fatalf("send after unsubscribe delivered to %d subscribers, want 1", n)
+	}
+}
+
+func TestFeedUnsubscribeFilteredBlockedPost(t *testing.T) {
+	var (
+		feed Feed
+		ch   = make(chan int)
+		sub  = feed.SubscribeFiltered(ch, func(v interface{}) bool { return true })
+		done = make(chan int)
+	)
+	go func() { done <- feed.Send(1) }()
+	time.Sleep(50 * time.Millisecond)
+	sub.Unsubscribe()
+	select {
+	case n := <-done:
+		if n != 0 {
+			t.Errorf("blocked send delivered to %d subscribers, want 0", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("send not unblocked by unsubscribe")
+	}
+}
+
 func BenchmarkFeedSend1000(b *testing.B) {
 	var (
 		done  sync.WaitGroup
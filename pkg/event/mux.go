@@ -0,0 +1,245 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+package event
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var errBadPattern = errors.New("event: invalid topic pattern")
+
+const (
+	topicSeparator = "."
+	topicAnyOne    = "*" // matches exactly one topic segment
+	topicAnyRest   = ">" // matches one or more trailing topic segments
+)
+
+// TopicEvent is delivered to Mux subscribers whose channel element type is
+// TopicEvent, it carries the topic a value was posted to.
+type TopicEvent struct {
+	Topic string
+	Data  interface{}
+}
+
+var topicEventType = reflect.TypeOf(TopicEvent{})
+
+// Mux dispatches values posted to string topics to all subscribers with a
+// matching pattern. Topics are made of segments separated by dots, e.g.
+// "task.result.ok". In patterns "*" matches exactly one segment and a final
+// ">" matches all remaining segments, so "task.*.ok" and "task.>" both match
+// the topic above.
+//
+// Unlike Feed, a Mux carries values of any type. A subscriber receives the
+// values that are assignable to the element type of its channel; channels of
+// TopicEvent receive every matching value along with its topic. Like Feed,
+// Post blocks until every matching subscriber accepted the value.
+//
+// The zero value is ready to use.
+type Mux struct {
+	mu     sync.RWMutex
+	subs   map[*muxSub]struct{}
+	closed bool
+}
+
+// Subscribe adds a channel receiving the values posted to topics matching
+// pattern. It panics if pattern is malformed or channel isn't a channel that
+// can be sent to.
+func (m *Mux) Subscribe(pattern string, channel interface{}) Subscription {
+	chanval := reflect.ValueOf(channel)
+	chantyp := chanval.Type()
+	if chantyp.Kind() != reflect.Chan || chantyp.ChanDir()&reflect.SendDir == 0 {
+		panic(errBadChannel)
+	}
+	segments, ok := parsePattern(pattern)
+	if !ok {
+		panic(errBadPattern)
+	}
+	sub := &muxSub{
+		mux:      m,
+		pattern:  segments,
+		channel:  chanval,
+		envelope: chantyp.Elem() == topicEventType,
+		quit:     make(chan struct{}),
+		err:      make(chan error, 1),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		sub.errOnce.Do(func() {
+			close(sub.quit)
+			close(sub.err)
+		})
+		return sub
+	}
+	if m.subs == nil {
+		m.subs = make(map[*muxSub]struct{})
+	}
+	m.subs[sub] = struct{}{}
+	return sub
+}
+
+// Post delivers value to all subscribers of a pattern matching topic and
+// returns the number of subscribers it was delivered to.
+func (m *Mux) Post(topic string, value interface{}) (nsent int) {
+	segments := strings.Split(topic, topicSeparator)
+	event := TopicEvent{Topic: topic, Data: value}
+
+	m.mu.RLock()
+	var (
+		subs   []*muxSub
+		values []reflect.Value
+	)
+	for sub := range m.subs {
+		if !matchTopic(sub.pattern, segments) {
+			continue
+		}
+		if rv, ok := sub.value(event); ok {
+			subs = append(subs, sub)
+			values = append(values, rv)
+		}
+	}
+	m.mu.RUnlock()
+
+	// Fast path: try sending without blocking.
+	for i := 0; i < len(subs); i++ {
+		if subs[i].channel.TrySend(values[i]) {
+			nsent++
+			subs, values = removeMuxCase(subs, values, i)
+			i--
+		}
+	}
+	// Wait for the remaining subscribers to accept the value or unsubscribe.
+	for len(subs) > 0 {
+		cases := make([]reflect.SelectCase, 0, 2*len(subs))
+		for i, sub := range subs {
+			cases = append(cases,
+				reflect.SelectCase{Dir: reflect.SelectSend, Chan: sub.channel, Send: values[i]},
+				reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(sub.quit)})
+		}
+		chosen, _, _ := reflect.Select(cases)
+		if chosen%2 == 0 {
+			nsent++
+		}
+		subs, values = removeMuxCase(subs, values, chosen/2)
+	}
+	return nsent
+}
+
+// Close unsubscribes all subscribers. Subscriptions created after Close are
+// ended immediately.
+func (m *Mux) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	subs := m.subs
+	m.subs = nil
+	m.mu.Unlock()
+
+	for sub := range subs {
+		sub.Unsubscribe()
+	}
+}
+
+// Count returns the number of subscribers.
+func (m *Mux) Count() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.subs)
+}
+
+func (m *Mux) remove(sub *muxSub) {
+	m.mu.Lock()
+	delete(m.subs, sub)
+	m.mu.Unlock()
+}
+
+type muxSub struct {
+	mux      *Mux
+	pattern  []string
+	channel  reflect.Value
+	envelope bool // channel receives TopicEvent values
+	quit     chan struct{}
+	errOnce  sync.Once
+	err      chan error
+}
+
+func (sub *muxSub) Unsubscribe() {
+	sub.errOnce.Do(func() {
+		sub.mux.remove(sub)
+		close(sub.quit)
+		close(sub.err)
+	})
+}
+
+func (sub *muxSub) Err() <-chan error {
+	return sub.err
+}
+
+// value returns what is sent to the subscriber for event, if anything.
+func (sub *muxSub) value(event TopicEvent) (reflect.Value, bool) {
+	if sub.envelope {
+		return reflect.ValueOf(event), true
+	}
+	if event.Data == nil {
+		return reflect.Value{}, false
+	}
+	rv := reflect.ValueOf(event.Data)
+	if !rv.Type().AssignableTo(sub.channel.Type().Elem()) {
+		return reflect.Value{}, false
+	}
+	return rv, true
+}
+
+func removeMuxCase(subs []*muxSub, values []reflect.Value, i int) ([]*muxSub, []reflect.Value) {
+	last := len(subs) - 1
+	subs[i], values[i] = subs[last], values[last]
+	return subs[:last], values[:last]
+}
+
+// parsePattern splits a subscription pattern into segments and validates it.
+func parsePattern(pattern string) ([]string, bool) {
+	if pattern == "" {
+		return nil, false
+	}
+	segments := strings.Split(pattern, topicSeparator)
+	for i, s := range segments {
+		if s == "" || (s == topicAnyRest && i != len(segments)-1) {
+			return nil, false
+		}
+	}
+	return segments, true
+}
+
+// matchTopic reports whether the topic segments match the pattern segments.
+func matchTopic(pattern, topic []string) bool {
+	for i, p := range pattern {
+		if p == topicAnyRest {
+			return len(topic) > i
+		}
+		if i >= len(topic) || (p != topicAnyOne && p != topic[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(topic)
+}
@@ -0,0 +1,176 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+package event
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMuxMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		match          bool
+	}{
+		{"task.result", "task.result", true},
+		{"task.result", "task.results", false},
+		{"task.result", "task.result.ok", false},
+		{"task.*", "task.result", true},
+		{"task.*", "task.result.ok", false},
+		{"task.*.ok", "task.result.ok", true},
+		{"task.*.ok", "task.result.failed", false},
+		{"task.>", "task.result", true},
+		{"task.>", "task.result.ok", true},
+		{"task.>", "task", false},
+		{">", "task", true},
+		{"*", "task.result", false},
+	}
+	for _, test := range tests {
+		pattern, ok := parsePattern(test.pattern)
+		if !ok {
+			t.Fatalf("pattern %q rejected", test.pattern)
+		}
+		topic, _ := parsePattern(test.topic)
+		if got := matchTopic(pattern, topic); got != test.match {
+			t.Errorf("pattern %q, topic %q: match = %v, want %v", test.pattern, test.topic, got, test.match)
+		}
+	}
+	for _, bad := range []string{"", "task..result", "task.>.result", "."} {
+		if _, ok := parsePattern(bad); ok {
+			t.Errorf("pattern %q accepted", bad)
+		}
+	}
+}
+
+func TestMuxPanics(t *testing.T) {
+	var mux Mux
+	if err := checkPanic(errBadChannel, func() { mux.Subscribe("task", make(<-chan int)) }); err != nil {
+		t.Error(err)
+	}
+	if err := checkPanic(errBadPattern, func() { mux.Subscribe("task..x", make(chan int)) }); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMuxTypedDelivery(t *testing.T) {
+	var (
+		mux     Mux
+		ints    = make(chan int, 10)
+		strs    = make(chan string, 10)
+		any     = make(chan interface{}, 10)
+		events  = make(chan TopicEvent, 10)
+		intSub  = mux.Subscribe("task.>", ints)
+		strSub  = mux.Subscribe("task.>", strs)
+		anySub  = mux.Subscribe("task.*", any)
+		evSub   = mux.Subscribe("task.result.*", events)
+		allSubs = []Subscription{intSub, strSub, anySub, evSub}
+	)
+	defer func() {
+		for _, sub := range allSubs {
+			sub.Unsubscribe()
+		}
+	}()
+
+	if n := mux.Post("task.count", 1); n != 2 {
+		t.Errorf("int post delivered %d times, want 2", n)
+	}
+	if n := mux.Post("task.result.ok", "done"); n != 2 {
+		t.Errorf("string post delivered %d times, want 2", n)
+	}
+	if n := mux.Post("other", 2); n != 0 {
+		t.Errorf("post to other topic delivered %d times, want 0", n)
+	}
+
+	if v := <-ints; v != 1 {
+		t.Errorf("int subscriber received %d", v)
+	}
+	if v := <-strs; v != "done" {
+		t.Errorf("string subscriber received %q", v)
+	}
+	if v := <-any; v != 1 {
+		t.Errorf("interface subscriber received %v", v)
+	}
+	if ev := <-events; ev.Topic != "task.result.ok" || ev.Data != "done" {
+		t.Errorf("envelope subscriber received %+v", ev)
+	}
+	if len(ints)+len(strs)+len(any)+len(events) != 0 {
+		t.Error("unexpected extra values delivered")
+	}
+}
+
+func TestMuxScopeAcrossTopics(t *testing.T) {
+	var (
+		mux   Mux
+		scope SubscriptionScope
+	)
+	for i := 0; i < 3; i++ {
+		scope.Track(mux.Subscribe(fmt.Sprintf("topic%d", i), make(chan int)))
+	}
+	if n := mux.Count(); n != 3 {
+		t.Fatalf("mux has %d subscribers, want 3", n)
+	}
+	scope.Close()
+	if n := mux.Count(); n != 0 {
+		t.Fatalf("mux has %d subscribers after scope close, want 0", n)
+	}
+}
+
+func TestMuxUnsubscribeBlockedPost(t *testing.T) {
+	var (
+		mux  Mux
+		fast = make(chan int, 1)
+		slow = make(chan int)
+		_    = mux.Subscribe("a", fast)
+		sub  = mux.Subscribe("a", slow)
+		done = make(chan int)
+	)
+	go func() { done <- mux.Post("a", 1) }()
+
+	<-fast
+	select {
+	case <-done:
+		t.Fatal("post returned before slow subscriber received")
+	case <-time.After(50 * time.Millisecond):
+	}
+	sub.Unsubscribe()
+	select {
+	case n := <-done:
+		if n != 1 {
+			t.Fatalf("post delivered %d times, want 1", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("post still blocked after unsubscribe")
+	}
+}
+
+func TestMuxClose(t *testing.T) {
+	var mux Mux
+	sub := mux.Subscribe("a", make(chan int))
+	mux.Close()
+	if _, ok := <-sub.Err(); ok {
+		t.Fatal("error channel not closed after mux close")
+	}
+	late := mux.Subscribe("a", make(chan int))
+	if _, ok := <-late.Err(); ok {
+		t.Fatal("subscription on closed mux not ended")
+	}
+	late.Unsubscribe()
+	if n := mux.Post("a", 1); n != 0 {
+		t.Fatalf("post on closed mux delivered %d times", n)
+	}
+}
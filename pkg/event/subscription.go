@@ -17,7 +17,10 @@
 package event
 
 import (
+	"context"
+	"math/rand"
 	"sync"
+	"time"
 )
 
 // SubscriptionScope provides a facility to unsubscribe multiple subscriptions at once.
@@ -88,3 +91,190 @@ func (s *scopeSub) Unsubscribe() {
 func (s *scopeSub) Err() <-chan error {
 	return s.s.Err()
 }
+
+// ResubscribeFunc attempts to establish a subscription. The context is
+// canceled when the resubscription is unsubscribed. Returning a nil
+// subscription without an error counts as a failed attempt.
+type ResubscribeFunc func(ctx context.Context) (Subscription, error)
+
+// BackoffConfig controls the delays between resubscription attempts.
+type BackoffConfig struct {
+	Min    time.Duration // delay before the first retry
+	Max    time.Duration // upper bound of the delay
+	Jitter float64       // fraction of each delay that is randomized, in [0, 1]
+}
+
+// DefaultBackoffConfig is used by Resubscribe.
+var DefaultBackoffConfig = BackoffConfig{
+	Min:    100 * time.Millisecond,
+	Max:    30 * time.Second,
+	Jitter: 0.2,
+}
+
+// Resubscribe calls fn repeatedly to keep a subscription established. When the
+// subscription fails with an error, fn is called again after an exponentially
+// growing delay. Failed attempts are retried the same way. The backoff is reset
+// once a subscription has lived longer than the maximum delay.
+//
+// The returned subscription ends when it is unsubscribed or when the wrapped
+// subscription ends without an error.
+func Resubscribe(fn ResubscribeFunc) *ResubscribeSubscription {
+	return ResubscribeWithConfig(DefaultBackoffConfig, fn)
+}
+
+// ResubscribeWithConfig is like Resubscribe, but uses the given backoff settings.
+func ResubscribeWithConfig(config BackoffConfig, fn ResubscribeFunc) *ResubscribeSubscription {
+	if config.Min <= 0 {
+		config.Min = DefaultBackoffConfig.Min
+	}
+	if config.Max < config.Min {
+		config.Max = config.Min
+	}
+	if config.Jitter < 0 {
+		config.Jitter = 0
+	} else if config.Jitter > 1 {
+		config.Jitter = 1
+	}
+	s := &ResubscribeSubscription{
+		fn:     fn,
+		config: config,
+		err:    make(chan error),
+		unsub:  make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go s.loop()
+	return s
+}
+
+// ResubscribeSubscription is the subscription returned by Resubscribe.
+type ResubscribeSubscription struct {
+	fn      ResubscribeFunc
+	config  BackoffConfig
+	backoff time.Duration
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	err       chan error
+	unsubOnce sync.Once
+	unsub     chan struct{}
+
+	mu       sync.Mutex
+	current  Subscription
+	attempts int
+}
+
+// Unsubscribe stops resubscribing and unsubscribes the live subscription.
+// It returns after the error channel has been closed.
+func (s *ResubscribeSubscription) Unsubscribe() {
+	s.unsubOnce.Do(func() {
+		close(s.unsub)
+		s.cancel()
+	})
+	<-s.err
+}
+
+// Err returns a channel that is closed when the subscription ends.
+func (s *ResubscribeSubscription) Err() <-chan error {
+	return s.err
+}
+
+// Current returns the live wrapped subscription, or nil while resubscribing.
+func (s *ResubscribeSubscription) Current() Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current
+}
+
+// Attempts returns the number of times fn has been called.
+func (s *ResubscribeSubscription) Attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts
+}
+
+func (s *ResubscribeSubscription) setCurrent(sub Subscription) {
+	s.mu.Lock()
+	s.current = sub
+	s.mu.Unlock()
+}
+
+func (s *ResubscribeSubscription) loop() {
+	defer close(s.err)
+	defer s.cancel()
+
+	for {
+		sub := s.subscribe()
+		if sub == nil {
+			return
+		}
+		done := s.waitForError(sub)
+		sub.Unsubscribe()
+		s.setCurrent(nil)
+		if done || !s.wait() {
+			return
+		}
+	}
+}
+
+// subscribe calls fn until it succeeds. It returns nil if the
+// resubscription was unsubscribed in the meantime.
+func (s *ResubscribeSubscription) subscribe() Subscription {
+	for {
+		s.mu.Lock()
+		s.attempts++
+		s.mu.Unlock()
+
+		sub, err := s.fn(s.ctx)
+		if err == nil && sub != nil {
+			select {
+			case <-s.unsub:
+				sub.Unsubscribe()
+				return nil
+			default:
+			}
+			s.setCurrent(sub)
+			return sub
+		}
+		if !s.wait() {
+			return nil
+		}
+	}
+}
+
+// waitForError blocks until sub fails or the resubscription is unsubscribed.
+// It returns true if no further attempt should be made.
+func (s *ResubscribeSubscription) waitForError(sub Subscription) bool {
+	start := time.Now()
+	select {
+	case err := <-sub.Err():
+		if time.Since(start) >= s.config.Max {
+			s.backoff = 0
+		}
+		return err == nil
+	case <-s.unsub:
+		return true
+	}
+}
+
+// wait sleeps for the next backoff delay. It returns false
+// if the resubscription was unsubscribed while waiting.
+func (s *ResubscribeSubscription) wait() bool {
+	if s.backoff == 0 {
+		s.backoff = s.config.Min
+	} else if s.backoff *= 2; s.backoff > s.config.Max {
+		s.backoff = s.config.Max
+	}
+	delay := s.backoff
+	if jitter := int64(float64(delay) * s.config.Jitter); jitter > 0 {
+		delay -= time.Duration(rand.Int63n(jitter + 1))
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.unsub:
+		return false
+	}
+}
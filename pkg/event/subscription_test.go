@@ -0,0 +1,181 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+package event
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errUpstream = errors.New("upstream failed")
+
+type testSub struct {
+	err   chan error
+	unsub chan struct{}
+}
+
+func newTestSub() *testSub {
+	return &testSub{err: make(chan error, 1), unsub: make(chan struct{})}
+}
+
+func (s *testSub) Err() <-chan error { return s.err }
+
+func (s *testSub) Unsubscribe() {
+	select {
+	case <-s.unsub:
+	default:
+		close(s.unsub)
+	}
+}
+
+var testBackoff = BackoffConfig{Min: time.Millisecond, Max: 10 * time.Millisecond, Jitter: 0.5}
+
+func TestResubscribe(t *testing.T) {
+	subs := make(chan *testSub, 10)
+	calls := 0
+	sub := ResubscribeWithConfig(testBackoff, func(ctx context.Context) (Subscription, error) {
+		calls++
+		if calls <= 2 {
+			return nil, errUpstream
+		}
+		s := newTestSub()
+		subs <- s
+		return s, nil
+	})
+	defer sub.Unsubscribe()
+
+	first := <-subs
+	if sub.Attempts() != 3 {
+		t.Fatalf("got %d attempts, want 3", sub.Attempts())
+	}
+	if sub.Current() != first {
+		t.Fatalf("Current doesn't return the live subscription")
+	}
+
+	// Fail the live subscription, it should be replaced.
+	first.err <- errUpstream
+	var second *testSub
+	select {
+	case second = <-subs:
+	case <-time.After(time.Second):
+		t.Fatal("not resubscribed after failure")
+	}
+	select {
+	case <-first.unsub:
+	default:
+		t.Error("failed subscription was not unsubscribed")
+	}
+	if second == first {
+		t.Fatal("got the same subscription twice")
+	}
+
+	sub.Unsubscribe()
+	if _, ok := <-sub.Err(); ok {
+		t.Error("error channel not closed after unsubscribe")
+	}
+	select {
+	case <-second.unsub:
+	default:
+		t.Error("live subscription was not unsubscribed")
+	}
+	if sub.Current() != nil {
+		t.Error("Current is not nil after unsubscribe")
+	}
+}
+
+func TestResubscribeNilSubscription(t *testing.T) {
+	subs := make(chan *testSub, 1)
+	calls := 0
+	sub := ResubscribeWithConfig(testBackoff, func(ctx context.Context) (Subscription, error) {
+		calls++
+		if calls == 1 {
+			return nil, nil
+		}
+		s := newTestSub()
+		subs <- s
+		return s, nil
+	})
+	defer sub.Unsubscribe()
+
+	select {
+	case <-subs:
+	case <-sub.Err():
+		t.Fatal("resubscription ended after a nil subscription")
+	case <-time.After(time.Second):
+		t.Fatal("not resubscribed after a nil subscription")
+	}
+	if sub.Attempts() != 2 {
+		t.Fatalf("got %d attempts, want 2", sub.Attempts())
+	}
+}
+
+func TestResubscribeUnsubscribeDuringBackoff(t *testing.T) {
+	config := BackoffConfig{Min: time.Hour, Max: time.Hour}
+	called := make(chan struct{}, 1)
+	sub := ResubscribeWithConfig(config, func(ctx context.Context) (Subscription, error) {
+		called <- struct{}{}
+		return nil, errUpstream
+	})
+	<-called
+
+	done := make(chan struct{})
+	go func() {
+		sub.Unsubscribe()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Unsubscribe blocked during backoff")
+	}
+}
+
+func TestResubscribeCancelsPendingAttempt(t *testing.T) {
+	started := make(chan struct{})
+	sub := ResubscribeWithConfig(testBackoff, func(ctx context.Context) (Subscription, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	<-started
+	sub.Unsubscribe()
+	if sub.Attempts() != 1 {
+		t.Errorf("got %d attempts, want 1", sub.Attempts())
+	}
+}
+
+func TestResubscribeCleanEnd(t *testing.T) {
+	inner := newTestSub()
+	sub := ResubscribeWithConfig(testBackoff, func(ctx context.Context) (Subscription, error) {
+		return inner, nil
+	})
+	close(inner.err)
+
+	select {
+	case _, ok := <-sub.Err():
+		if ok {
+			t.Error("unexpected error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscription didn't end after clean close of the wrapped subscription")
+	}
+	if sub.Attempts() != 1 {
+		t.Errorf("got %d attempts, want 1", sub.Attempts())
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package health runs the health checks of a process and serves their
+// results over HTTP.
+//
+// Liveness checks tell whether the process works at all and should be
+// restarted otherwise. Readiness checks tell whether it can serve requests
+// right now, e.g. whether its database is reachable. A process is ready if all
+// liveness and readiness checks pass.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LivePath  = "/health/live"
+	ReadyPath = "/health/ready"
+
+	DefaultTimeout = 5 * time.Second
+)
+
+// Status of a check or report.
+const (
+	StatusPass = "pass"
+	StatusFail = "fail"
+)
+
+// Checker checks a part of the process, a nil error means healthy.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc is an adapter to use ordinary functions as checkers.
+type CheckerFunc func(ctx context.Context) error
+
+func (f CheckerFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Result is the outcome of a single check.
+type Result struct {
+	Status   string        `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Report is the outcome of a set of checks.
+type Report struct {
+	Status string             `json:"status"`
+	Checks map[string]*Result `json:"checks"`
+}
+
+// Err returns an error naming the failed checks, or nil if all passed.
+func (r *Report) Err() error {
+	if r.Status == StatusPass {
+		return nil
+	}
+	var failed []string
+	for name, res := range r.Checks {
+		if res.Status != StatusPass {
+			failed = append(failed, fmt.Sprintf("%s: %s", name, res.Error))
+		}
+	}
+	sort.Strings(failed)
+	return errors.New(strings.Join(failed, "; "))
+}
+
+type check struct {
+	checker Checker
+	ready   bool // readiness check, liveness otherwise
+}
+
+// Health is a set of named checks. It is an http.Handler serving the liveness
+// report at LivePath and the readiness report at ReadyPath.
+type Health struct {
+	timeout time.Duration
+
+	mu     sync.RWMutex
+	checks map[string]*check
+}
+
+// New creates an empty set of checks. Checks taking longer than timeout fail,
+// the timeout defaults to DefaultTimeout.
+func New(timeout time.Duration) *Health {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Health{timeout: timeout, checks: make(map[string]*check)}
+}
+
+// AddLivenessCheck adds a liveness check, replacing the check of the same name.
+func (h *Health) AddLivenessCheck(name string, c Checker) {
+	h.add(name, c, false)
+}
+
+// AddReadinessCheck adds a readiness check, replacing the check of the same name.
+func (h *Health) AddReadinessCheck(name string, c Checker) {
+	h.add(name, c, true)
+}
+
+func (h *Health) add(name string, c Checker, ready bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = &check{checker: c, ready: ready}
+}
+
+// RemoveCheck removes the check with the given name.
+func (h *Health) RemoveCheck(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.checks, name)
+}
+
+// Live runs the liveness checks.
+func (h *Health) Live(ctx context.Context) *Report {
+	return h.run(ctx, false)
+}
+
+// Ready runs the liveness and the readiness checks.
+func (h *Health) Ready(ctx context.Context) *Report {
+	return h.run(ctx, true)
+}
+
+// run runs the selected checks concurrently.
+func (h *Health) run(ctx context.Context, ready bool) *Report {
+	h.mu.RLock()
+	selected := make(map[string]Checker)
+	for name, c := range h.checks {
+		if ready || !c.ready {
+			selected[name] = c.checker
+		}
+	}
+	h.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		report = &Report{Status: StatusPass, Checks: make(map[string]*Result, len(selected))}
+	)
+	for name, c := range selected {
+		wg.Add(1)
+		go func(name string, c Checker) {
+			defer wg.Done()
+			res := runCheck(ctx, c)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = res
+			if res.Status != StatusPass {
+				report.Status = StatusFail
+			}
+		}(name, c)
+	}
+	wg.Wait()
+	return report
+}
+
+// runCheck runs c, giving up when ctx is done.
+func runCheck(ctx context.Context, c Checker) *Result {
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() { errc <- c.Check(ctx) }()
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	res := &Result{Status: StatusPass, Duration: time.Since(start)}
+	if err != nil {
+		res.Status, res.Error = StatusFail, err.Error()
+	}
+	return res
+}
+
+// ServeHTTP serves the reports as JSON, failing reports with status 503.
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var report *Report
+	switch r.URL.Path {
+	case LivePath:
+		report = h.Live(r.Context())
+	case ReadyPath:
+		report = h.Ready(r.Context())
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	if report.Status != StatusPass {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// IsHealthPath reports whether path is served by Health.
+func IsHealthPath(path string) bool {
+	return path == LivePath || path == ReadyPath
+}
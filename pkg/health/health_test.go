@@ -0,0 +1,101 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	h := New(50 * time.Millisecond)
+	h.AddLivenessCheck("loop", CheckerFunc(func(ctx context.Context) error { return nil }))
+	h.AddReadinessCheck("db", CheckerFunc(func(ctx context.Context) error { return errors.New("connection refused") }))
+	h.AddReadinessCheck("slow", CheckerFunc(func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}))
+
+	live := h.Live(context.Background())
+	if live.Status != StatusPass || len(live.Checks) != 1 || live.Err() != nil {
+		t.Fatalf("unexpected liveness report %+v", live)
+	}
+
+	start := time.Now()
+	ready := h.Ready(context.Background())
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("slow check not timed out")
+	}
+	if ready.Status != StatusFail || len(ready.Checks) != 3 {
+		t.Fatalf("unexpected readiness report %+v", ready)
+	}
+	if res := ready.Checks["slow"]; res.Status != StatusFail || res.Error != context.DeadlineExceeded.Error() {
+		t.Fatalf("slow check result %+v", res)
+	}
+	if err := ready.Err(); err == nil || err.Error() != "db: connection refused; slow: context deadline exceeded" {
+		t.Fatalf("got error %v", err)
+	}
+
+	h.RemoveCheck("db")
+	h.RemoveCheck("slow")
+	if ready := h.Ready(context.Background()); ready.Status != StatusPass {
+		t.Fatalf("checks not removed: %+v", ready)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	h := New(0)
+	var failing error
+	h.AddReadinessCheck("db", CheckerFunc(func(ctx context.Context) error { return failing }))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	get := func(path string) (int, *Report) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var report Report
+		if strings.HasPrefix(resp.Header.Get("content-type"), "application/json") {
+			if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, &report
+	}
+
+	if code, report := get(ReadyPath); code != http.StatusOK || report.Checks["db"].Status != StatusPass {
+		t.Fatalf("ready: %d %+v", code, report)
+	}
+	failing = errors.New("down")
+	if code, report := get(ReadyPath); code != http.StatusServiceUnavailable || report.Checks["db"].Error != "down" {
+		t.Fatalf("ready while failing: %d %+v", code, report)
+	}
+	if code, report := get(LivePath); code != http.StatusOK || report.Status != StatusPass {
+		t.Fatalf("live while not ready: %d %+v", code, report)
+	}
+	if code, _ := get("/health/other"); code != http.StatusNotFound {
+		t.Fatalf("unknown path: %d", code)
+	}
+}
@@ -0,0 +1,465 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+package leveldb
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"airman.com/airfk/pkg/event"
+)
+
+// OffsetLatest subscribes to events appended after the subscription is made.
+const OffsetLatest = ^uint64(0)
+
+const (
+	eventLogReadBatch      = 128
+	DefaultCompactInterval = time.Minute
+)
+
+var (
+	ErrEventLogClosed = errors.New("event log closed")
+	errBadEntry       = errors.New("malformed event log entry")
+)
+
+// Event is an entry of an EventLog. Offsets start at 1 and increase by one
+// for every appended event.
+type Event struct {
+	Offset uint64
+	Time   time.Time
+	Data   []byte
+}
+
+// EventLogConfig controls the retention of an EventLog. Zero values disable the
+// respective limit.
+type EventLogConfig struct {
+	RetentionSize   int           // maximum number of retained events
+	RetentionAge    time.Duration // maximum age of retained events
+	CompactInterval time.Duration // interval of background compaction
+}
+
+// EventLog is a persistent, append-only event stream stored in a LevelDB
+// database. Entries are stored under sequence-numbered keys, so consumers can
+// replay the stream from any retained offset. Consumers can record checkpoints
+// to resume after a restart.
+//
+// Multiple logs with different names can share the same database.
+type EventLog struct {
+	db     *LevelDB
+	name   string
+	config EventLogConfig
+
+	entryPrefix []byte
+	checkPrefix []byte
+
+	compactLock sync.Mutex // serializes compactions
+
+	mu     sync.Mutex
+	first  uint64 // offset of the oldest retained event, 0 if empty
+	next   uint64 // offset of the next appended event
+	subs   map[*logSub]struct{}
+	closed bool
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewEventLog opens the event log with the given name in db. Events appended in a
+// previous run are retained. Closing the log does not close the database.
+func NewEventLog(db *LevelDB, name string, config EventLogConfig) (*EventLog, error) {
+	l := &EventLog{
+		db:          db,
+		name:        name,
+		config:      config,
+		entryPrefix: []byte("evlog-e-" + name + "\x00"),
+		checkPrefix: []byte("evlog-c-" + name + "\x00"),
+		next:        1,
+		subs:        make(map[*logSub]struct{}),
+		quit:        make(chan struct{}),
+	}
+	it := db.NewIteratorWithPrefix(l.entryPrefix)
+	if it.First() {
+		l.first = l.offsetOf(it.Key())
+	}
+	if it.Last() {
+		l.next = l.offsetOf(it.Key()) + 1
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+
+	if config.RetentionSize > 0 || config.RetentionAge > 0 {
+		if l.config.CompactInterval <= 0 {
+			l.config.CompactInterval = DefaultCompactInterval
+		}
+		l.wg.Add(1)
+		go l.compactLoop()
+	}
+	return l, nil
+}
+
+// Name returns the name of the log.
+func (l *EventLog) Name() string {
+	return l.name
+}
+
+// First returns the offset of the oldest retained event, or 0 if the log is empty.
+func (l *EventLog) First() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.first
+}
+
+// Last returns the offset of the latest event, or 0 if no event has been appended.
+func (l *EventLog) Last() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.next - 1
+}
+
+// Append stores data as the next event and wakes up subscribers.
+// It returns the offset of the event.
+func (l *EventLog) Append(data []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, ErrEventLogClosed
+	}
+	offset := l.next
+	if err := l.db.Put(l.entryKey(offset), encodeEntry(time.Now(), data)); err != nil {
+		return 0, err
+	}
+	l.next++
+	if l.first == 0 {
+		l.first = offset
+	}
+	for sub := range l.subs {
+		sub.wake()
+	}
+	return offset, nil
+}
+
+// Read returns up to max events starting at offset from. If from has been
+// compacted, reading starts at the oldest retained event.
+func (l *EventLog) Read(from uint64, max int) ([]Event, error) {
+	l.mu.Lock()
+	first, next := l.first, l.next
+	l.mu.Unlock()
+
+	if from < first {
+		from = first
+	}
+	if from >= next || max <= 0 {
+		return nil, nil
+	}
+	it := l.db.NewIteratorWithPrefix(l.entryPrefix)
+	defer it.Release()
+
+	var events []Event
+	for ok := it.Seek(l.entryKey(from)); ok && len(events) < max; ok = it.Next() {
+		ev, err := l.decodeEvent(it.Key(), it.Value())
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, it.Error()
+}
+
+// Subscribe delivers events starting at offset from on ch: retained events are
+// replayed first, followed by newly appended ones. Use OffsetLatest to receive
+// only new events. Events that are compacted before the subscriber reads them
+// are skipped.
+//
+// Slow subscribers don't block Append, they read from the database at their own
+// pace.
+func (l *EventLog) Subscribe(from uint64, ch chan<- Event) event.Subscription {
+	sub := &logSub{
+		log:    l,
+		ch:     ch,
+		wakeup: make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		err:    make(chan error, 1),
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		sub.err <- ErrEventLogClosed
+		close(sub.err)
+		return sub
+	}
+	if from == OffsetLatest {
+		from = l.next
+	}
+	sub.next = from
+	l.subs[sub] = struct{}{}
+	l.wg.Add(1)
+	go sub.loop()
+	return sub
+}
+
+// SubscribeConsumer subscribes on behalf of a named consumer. Delivery starts
+// after the consumer's checkpoint, or at the oldest retained event if the
+// consumer has no checkpoint.
+func (l *EventLog) SubscribeConsumer(consumer string, ch chan<- Event) (event.Subscription, error) {
+	offset, ok, err := l.Checkpoint(consumer)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return l.Subscribe(offset+1, ch), nil
+	}
+	return l.Subscribe(0, ch), nil
+}
+
+// Commit records offset as the latest event processed by consumer.
+func (l *EventLog) Commit(consumer string, offset uint64) error {
+	return l.db.Put(l.checkpointKey(consumer), encodeOffset(offset))
+}
+
+// Checkpoint returns the offset last committed by consumer.
+func (l *EventLog) Checkpoint(consumer string) (uint64, bool, error) {
+	enc, err := l.db.Get(l.checkpointKey(consumer))
+	if err == leveldb.ErrNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if len(enc) != 8 {
+		return 0, false, errBadEntry
+	}
+	return binary.BigEndian.Uint64(enc), true, nil
+}
+
+// Compact deletes the events exceeding the retention size or age and returns
+// the number of deleted events.
+func (l *EventLog) Compact() (int, error) {
+	l.compactLock.Lock()
+	defer l.compactLock.Unlock()
+
+	l.mu.Lock()
+	first, next := l.first, l.next
+	l.mu.Unlock()
+
+	if first == 0 {
+		return 0, nil
+	}
+	// All events below limit are deleted because of their count.
+	limit := first
+	if size := l.config.RetentionSize; size > 0 && next-first > uint64(size) {
+		limit = next - uint64(size)
+	}
+	var cutoff time.Time
+	if l.config.RetentionAge > 0 {
+		cutoff = time.Now().Add(-l.config.RetentionAge)
+	}
+
+	it := l.db.NewIteratorWithPrefix(l.entryPrefix)
+	defer it.Release()
+
+	batch := l.db.NewBatch()
+	deleted, newFirst := 0, uint64(0)
+	for ok := it.First(); ok; ok = it.Next() {
+		ev, err := l.decodeEvent(it.Key(), it.Value())
+		if err != nil {
+			return 0, err
+		}
+		if ev.Offset >= limit && (cutoff.IsZero() || !ev.Time.Before(cutoff)) {
+			newFirst = ev.Offset
+			break
+		}
+		batch.Delete(l.entryKey(ev.Offset))
+		deleted++
+	}
+	if err := it.Error(); err != nil {
+		return 0, err
+	}
+	if deleted == 0 {
+		return 0, nil
+	}
+	if err := batch.Write(); err != nil {
+		return 0, err
+	}
+
+	l.mu.Lock()
+	if newFirst == 0 && l.next > next {
+		// Events were appended while compacting everything we had seen.
+		newFirst = next
+	}
+	l.first = newFirst
+	l.mu.Unlock()
+
+	log.Debugf("event log %s compacted %d events", l.name, deleted)
+	return deleted, nil
+}
+
+// Close ends all subscriptions and stops background compaction.
+// The database is left open.
+func (l *EventLog) Close() {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.closed = true
+	close(l.quit)
+	l.mu.Unlock()
+
+	l.wg.Wait()
+}
+
+func (l *EventLog) compactLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.config.CompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := l.Compact(); err != nil {
+				log.Errorf("event log %s compaction failed: %v", l.name, err)
+			}
+		case <-l.quit:
+			return
+		}
+	}
+}
+
+func (l *EventLog) entryKey(offset uint64) []byte {
+	key := make([]byte, len(l.entryPrefix)+8)
+	copy(key, l.entryPrefix)
+	binary.BigEndian.PutUint64(key[len(l.entryPrefix):], offset)
+	return key
+}
+
+func (l *EventLog) checkpointKey(consumer string) []byte {
+	return append(append([]byte{}, l.checkPrefix...), consumer...)
+}
+
+func (l *EventLog) offsetOf(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key[len(l.entryPrefix):])
+}
+
+func (l *EventLog) decodeEvent(key, value []byte) (Event, error) {
+	if len(key) != len(l.entryPrefix)+8 || len(value) < 8 {
+		return Event{}, errBadEntry
+	}
+	data := make([]byte, len(value)-8)
+	copy(data, value[8:])
+	return Event{
+		Offset: l.offsetOf(key),
+		Time:   time.Unix(0, int64(binary.BigEndian.Uint64(value))),
+		Data:   data,
+	}, nil
+}
+
+func encodeEntry(t time.Time, data []byte) []byte {
+	enc := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint64(enc, uint64(t.UnixNano()))
+	copy(enc[8:], data)
+	return enc
+}
+
+func encodeOffset(offset uint64) []byte {
+	enc := make([]byte, 8)
+	binary.BigEndian.PutUint64(enc, offset)
+	return enc
+}
+
+// logSub is a subscription to an EventLog.
+type logSub struct {
+	log    *EventLog
+	ch     chan<- Event
+	next   uint64
+	wakeup chan struct{}
+
+	quitOnce sync.Once
+	quit     chan struct{}
+	err      chan error
+}
+
+func (sub *logSub) Unsubscribe() {
+	sub.quitOnce.Do(func() { close(sub.quit) })
+	<-sub.err
+}
+
+func (sub *logSub) Err() <-chan error {
+	return sub.err
+}
+
+func (sub *logSub) wake() {
+	select {
+	case sub.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (sub *logSub) loop() {
+	l := sub.log
+	var err error
+	defer func() {
+		l.mu.Lock()
+		delete(l.subs, sub)
+		l.mu.Unlock()
+
+		if err != nil {
+			sub.err <- err
+		}
+		close(sub.err)
+		l.wg.Done()
+	}()
+
+	for {
+		var events []Event
+		events, err = l.Read(sub.next, eventLogReadBatch)
+		if err != nil {
+			return
+		}
+		for _, ev := range events {
+			select {
+			case sub.ch <- ev:
+				sub.next = ev.Offset + 1
+			case <-sub.quit:
+				return
+			case <-l.quit:
+				err = ErrEventLogClosed
+				return
+			}
+		}
+		if len(events) == eventLogReadBatch {
+			continue
+		}
+		select {
+		case <-sub.wakeup:
+		case <-sub.quit:
+			return
+		case <-l.quit:
+			err = ErrEventLogClosed
+			return
+		}
+	}
+}
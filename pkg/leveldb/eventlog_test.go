@@ -0,0 +1,191 @@
+package leveldb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func appendEvents(t *testing.T, l *EventLog, from, to int) {
+	for i := from; i < to; i++ {
+		if _, err := l.Append([]byte(fmt.Sprintf("event-%d", i))); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+}
+
+func expectEvents(t *testing.T, ch <-chan Event, from, to uint64) {
+	for want := from; want < to; want++ {
+		select {
+		case ev := <-ch:
+			if ev.Offset != want {
+				t.Fatalf("got offset %d, want %d", ev.Offset, want)
+			}
+			if string(ev.Data) != fmt.Sprintf("event-%d", want-1) {
+				t.Fatalf("offset %d has data %q", ev.Offset, ev.Data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for offset %d", want)
+		}
+	}
+}
+
+func TestEventLogReopen(t *testing.T) {
+	db, remove := newTestLDB()
+	defer remove()
+
+	l, err := NewEventLog(db, "test", EventLogConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEvents(t, l, 0, 5)
+	l.Close()
+	if _, err := l.Append(nil); err != ErrEventLogClosed {
+		t.Fatalf("append after close returned %v", err)
+	}
+
+	// Another log sharing the database must not see the events.
+	other, err := NewEventLog(db, "tes", EventLogConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.First() != 0 || other.Last() != 0 {
+		t.Fatalf("unrelated log has events %d-%d", other.First(), other.Last())
+	}
+	other.Close()
+
+	l, err = NewEventLog(db, "test", EventLogConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.First() != 1 || l.Last() != 5 {
+		t.Fatalf("reopened log has events %d-%d, want 1-5", l.First(), l.Last())
+	}
+	if offset, _ := l.Append([]byte("event-5")); offset != 6 {
+		t.Fatalf("append after reopen returned offset %d, want 6", offset)
+	}
+	events, err := l.Read(2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[0].Offset != 2 || events[2].Offset != 4 {
+		t.Fatalf("wrong events read: %v", events)
+	}
+}
+
+func TestEventLogSubscribe(t *testing.T) {
+	db, remove := newTestLDB()
+	defer remove()
+
+	l, err := NewEventLog(db, "test", EventLogConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	appendEvents(t, l, 0, 3)
+
+	replay := make(chan Event)
+	sub1 := l.Subscribe(2, replay)
+	defer sub1.Unsubscribe()
+	latest := make(chan Event, 10)
+	sub2 := l.Subscribe(OffsetLatest, latest)
+	defer sub2.Unsubscribe()
+
+	expectEvents(t, replay, 2, 4)
+	appendEvents(t, l, 3, 5)
+	expectEvents(t, replay, 4, 6)
+	expectEvents(t, latest, 4, 6)
+
+	sub1.Unsubscribe()
+	if _, ok := <-sub1.Err(); ok {
+		t.Error("error channel not closed after unsubscribe")
+	}
+
+	l.Close()
+	if err := <-sub2.Err(); err != ErrEventLogClosed {
+		t.Errorf("got error %v after close, want %v", err, ErrEventLogClosed)
+	}
+}
+
+func TestEventLogCheckpoint(t *testing.T) {
+	db, remove := newTestLDB()
+	defer remove()
+
+	l, err := NewEventLog(db, "test", EventLogConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	appendEvents(t, l, 0, 5)
+
+	if _, ok, _ := l.Checkpoint("consumer"); ok {
+		t.Fatal("unknown consumer has a checkpoint")
+	}
+	ch := make(chan Event, 10)
+	sub, err := l.SubscribeConsumer("consumer", ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, ch, 1, 6)
+	sub.Unsubscribe()
+
+	if err := l.Commit("consumer", 3); err != nil {
+		t.Fatal(err)
+	}
+	if offset, ok, err := l.Checkpoint("consumer"); err != nil || !ok || offset != 3 {
+		t.Fatalf("checkpoint is %d %v %v, want 3", offset, ok, err)
+	}
+	ch = make(chan Event, 10)
+	sub, err = l.SubscribeConsumer("consumer", ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	expectEvents(t, ch, 4, 6)
+}
+
+func TestEventLogCompactSize(t *testing.T) {
+	db, remove := newTestLDB()
+	defer remove()
+
+	l, err := NewEventLog(db, "test", EventLogConfig{RetentionSize: 3, CompactInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	appendEvents(t, l, 0, 10)
+
+	n, err := l.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 7 || l.First() != 8 || l.Last() != 10 {
+		t.Fatalf("compacted %d events, log has %d-%d", n, l.First(), l.Last())
+	}
+	// Subscribing from a compacted offset starts at the oldest retained event.
+	ch := make(chan Event, 10)
+	sub := l.Subscribe(1, ch)
+	defer sub.Unsubscribe()
+	expectEvents(t, ch, 8, 11)
+}
+
+func TestEventLogCompactAge(t *testing.T) {
+	db, remove := newTestLDB()
+	defer remove()
+
+	l, err := NewEventLog(db, "test", EventLogConfig{RetentionAge: 50 * time.Millisecond, CompactInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	appendEvents(t, l, 0, 5)
+	time.Sleep(100 * time.Millisecond)
+
+	if l.First() != 0 {
+		t.Fatalf("expired events not compacted, first offset is %d", l.First())
+	}
+	if offset, _ := l.Append([]byte("event-5")); offset != 6 || l.First() != 6 {
+		t.Fatalf("append after compaction returned offset %d, first is %d", offset, l.First())
+	}
+}
@@ -0,0 +1,370 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"airman.com/airfk/pkg/common"
+	"airman.com/airfk/pkg/event"
+)
+
+const DefaultCacheRefreshInterval = 30 * time.Second
+
+// CacheConfig contains the settings of a CacheRegistry.
+type CacheConfig struct {
+	RefreshInterval time.Duration // interval of the background refresh
+	SnapshotPath    string        // file the cache is persisted to, empty disables persistence
+}
+
+type cacheKey struct {
+	name, tag string
+}
+
+type cacheEntry struct {
+	Name     string     `json:"name"`
+	Tag      string     `json:"tag"`
+	Services []*Service `json:"services"`
+	Updated  time.Time  `json:"updated"`
+	stale    bool
+}
+
+// cacheSnapshot is the persisted form of the cache.
+type cacheSnapshot struct {
+	Entries []*cacheEntry `json:"entries"`
+	List    []*Service    `json:"list,omitempty"`
+}
+
+// CacheRegistry serves lookups of a backend registry from memory. Looked up
+// services are refreshed in the background, immediately on changes if the
+// backend is a Watcher. While the backend is unreachable the last known nodes
+// are served and flagged stale, see Lookup. With a snapshot file the cache
+// survives restarts, so lookups work on a cold start during an outage.
+type CacheRegistry struct {
+	backend Registry
+	config  CacheConfig
+
+	mu      sync.RWMutex
+	entries map[cacheKey]*cacheEntry
+	list    []*Service
+	watches map[string]event.Subscription
+	pending map[string]bool // names to refresh after watch events
+	closed  bool
+
+	saveMu sync.Mutex
+	wakeup chan struct{}
+	quit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewCacheRegistry wraps backend with a cache. The cache is loaded from the
+// snapshot file if it exists. Closing the cache closes the backend.
+func NewCacheRegistry(backend Registry, config CacheConfig) *CacheRegistry {
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = DefaultCacheRefreshInterval
+	}
+	c := &CacheRegistry{
+		backend: backend,
+		config:  config,
+		entries: make(map[cacheKey]*cacheEntry),
+		watches: make(map[string]event.Subscription),
+		pending: make(map[string]bool),
+		wakeup:  make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+	if config.SnapshotPath != "" && common.FileExist(config.SnapshotPath) {
+		if err := c.load(); err != nil {
+			log.Warnf("registry cache snapshot %s not loaded: %v", config.SnapshotPath, err)
+		}
+	}
+
+	c.wg.Add(1)
+	go c.loop()
+	c.mu.RLock()
+	var names []string
+	for key := range c.entries {
+		names = append(names, key.name)
+	}
+	c.mu.RUnlock()
+	for _, name := range names {
+		c.watch(name)
+		c.schedule(name)
+	}
+	return c
+}
+
+func (c *CacheRegistry) Register(s *Service) error {
+	if err := c.backend.Register(s); err != nil {
+		return err
+	}
+	c.schedule(s.Name)
+	return nil
+}
+
+func (c *CacheRegistry) RegisterWithTTL(s *Service, ttl time.Duration) error {
+	if err := c.backend.RegisterWithTTL(s, ttl); err != nil {
+		return err
+	}
+	c.schedule(s.Name)
+	return nil
+}
+
+func (c *CacheRegistry) Deregister(s *Service) error {
+	if err := c.backend.Deregister(s); err != nil {
+		return err
+	}
+	c.schedule(s.Name)
+	return nil
+}
+
+// GetService returns the cached nodes of name, see Lookup.
+func (c *CacheRegistry) GetService(name, tag string) ([]*Service, error) {
+	services, _, err := c.Lookup(name, tag)
+	return services, err
+}
+
+// Lookup returns the cached nodes registered under name and whether they are
+// stale because the backend couldn't be reached since the last lookup. A
+// service is looked up in the backend the first time only, it is kept up to
+// date afterwards. The returned services are shared and must not be modified.
+func (c *CacheRegistry) Lookup(name, tag string) ([]*Service, bool, error) {
+	if name == "" {
+		return nil, false, ErrNilKey
+	}
+	key := cacheKey{name, tag}
+	c.mu.RLock()
+	entry, ok := c.entries[key]
+	if ok {
+		services, stale := entry.Services, entry.stale
+		c.mu.RUnlock()
+		return services, stale, nil
+	}
+	c.mu.RUnlock()
+
+	services, err := c.backend.GetService(name, tag)
+	if err != nil {
+		return nil, false, err
+	}
+	c.mu.Lock()
+	c.entries[key] = &cacheEntry{Name: name, Tag: tag, Services: services, Updated: time.Now()}
+	c.mu.Unlock()
+	c.watch(name)
+	c.save()
+	return services, false, nil
+}
+
+// ListServices returns the services of the backend, or the last known ones
+// if the backend can't be reached.
+func (c *CacheRegistry) ListServices() ([]*Service, error) {
+	list, err := c.backend.ListServices()
+	c.mu.Lock()
+	if err != nil {
+		list = c.list
+	} else {
+		c.list = list
+	}
+	c.mu.Unlock()
+	if err != nil && list == nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Options returns the options of the backend.
+func (c *CacheRegistry) Options() Options {
+	if o, ok := c.backend.(interface{ Options() Options }); ok {
+		return o.Options()
+	}
+	return Options{}
+}
+
+// Close stops refreshing and closes the backend.
+func (c *CacheRegistry) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.quit)
+	watches := c.watches
+	c.watches = nil
+	c.mu.Unlock()
+
+	for _, sub := range watches {
+		sub.Unsubscribe()
+	}
+	c.wg.Wait()
+	return c.backend.Close()
+}
+
+// schedule requests a refresh of the cached lookups of name.
+func (c *CacheRegistry) schedule(name string) {
+	c.mu.Lock()
+	c.pending[name] = true
+	c.mu.Unlock()
+	select {
+	case c.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// watch refreshes the lookups of name whenever the backend reports a change.
+func (c *CacheRegistry) watch(name string) {
+	w, ok := c.backend.(Watcher)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	if _, ok := c.watches[name]; ok || c.closed {
+		c.mu.Unlock()
+		return
+	}
+	ch := make(chan *Event, 16)
+	sub, err := w.Watch(name, ch)
+	if err != nil {
+		c.mu.Unlock()
+		log.Warnf("registry cache can't watch %s: %v", name, err)
+		return
+	}
+	c.watches[name] = sub
+	c.mu.Unlock()
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for {
+			select {
+			case <-ch:
+				c.schedule(name)
+			case <-sub.Err():
+				return
+			case <-c.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (c *CacheRegistry) loop() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.config.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.refresh(nil)
+		case <-c.wakeup:
+			c.mu.Lock()
+			names := c.pending
+			c.pending = make(map[string]bool)
+			c.mu.Unlock()
+			c.refresh(names)
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// refresh looks up the cached entries of names again, of all names if nil.
+func (c *CacheRegistry) refresh(names map[string]bool) {
+	c.mu.RLock()
+	var keys []cacheKey
+	for key := range c.entries {
+		if names == nil || names[key.name] {
+			keys = append(keys, key)
+		}
+	}
+	c.mu.RUnlock()
+
+	changed := false
+	for _, key := range keys {
+		services, err := c.backend.GetService(key.name, key.tag)
+
+		c.mu.Lock()
+		entry := c.entries[key]
+		if err != nil {
+			if !entry.stale {
+				log.Warnf("registry cache serving stale %s: %v", key.name, err)
+			}
+			entry.stale = true
+		} else {
+			if !reflect.DeepEqual(entry.Services, services) {
+				changed = true
+			}
+			// entries are replaced, lookups may still use the old ones
+			c.entries[key] = &cacheEntry{Name: key.name, Tag: key.tag, Services: services, Updated: time.Now()}
+		}
+		c.mu.Unlock()
+	}
+	if changed {
+		c.save()
+	}
+}
+
+// save writes the snapshot file.
+func (c *CacheRegistry) save() {
+	if c.config.SnapshotPath == "" {
+		return
+	}
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+
+	c.mu.RLock()
+	snapshot := cacheSnapshot{List: c.list}
+	for _, entry := range c.entries {
+		snapshot.Entries = append(snapshot.Entries, entry)
+	}
+	sort.Slice(snapshot.Entries, func(i, j int) bool {
+		a, b := snapshot.Entries[i], snapshot.Entries[j]
+		return a.Name < b.Name || (a.Name == b.Name && a.Tag < b.Tag)
+	})
+	enc, err := json.MarshalIndent(snapshot, "", "  ")
+	c.mu.RUnlock()
+	if err != nil {
+		log.Errorf("registry cache snapshot encoding failed: %v", err)
+		return
+	}
+	if err := common.WriteFile(c.config.SnapshotPath, enc); err != nil {
+		log.Errorf("registry cache snapshot %s not written: %v", c.config.SnapshotPath, err)
+	}
+}
+
+// load fills the cache from the snapshot file. The loaded entries are stale
+// until they are refreshed.
+func (c *CacheRegistry) load() error {
+	enc, err := common.ReadFile(c.config.SnapshotPath)
+	if err != nil {
+		return err
+	}
+	var snapshot cacheSnapshot
+	if err := json.Unmarshal(enc, &snapshot); err != nil {
+		return err
+	}
+	for _, entry := range snapshot.Entries {
+		entry.stale = true
+		c.entries[cacheKey{entry.Name, entry.Tag}] = entry
+	}
+	c.list = snapshot.List
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyRegistry is a registry backend without watch support that can be
+// taken down.
+type flakyRegistry struct {
+	Registry
+
+	mu      sync.Mutex
+	down    bool
+	lookups int
+}
+
+var errBackendDown = errors.New("backend down")
+
+func (f *flakyRegistry) setDown(down bool) {
+	f.mu.Lock()
+	f.down = down
+	f.mu.Unlock()
+}
+
+func (f *flakyRegistry) GetService(name, tag string) ([]*Service, error) {
+	f.mu.Lock()
+	down := f.down
+	f.lookups++
+	f.mu.Unlock()
+	if down {
+		return nil, errBackendDown
+	}
+	return f.Registry.GetService(name, tag)
+}
+
+func (f *flakyRegistry) ListServices() ([]*Service, error) {
+	f.mu.Lock()
+	down := f.down
+	f.mu.Unlock()
+	if down {
+		return nil, errBackendDown
+	}
+	return f.Registry.ListServices()
+}
+
+func TestCacheStale(t *testing.T) {
+	mem := NewMemoryRegistry()
+	backend := &flakyRegistry{Registry: mem}
+	c := NewCacheRegistry(backend, CacheConfig{RefreshInterval: time.Hour})
+	defer c.Close()
+
+	mem.Register(NewService("task", "1.0.0", "10.0.0.1", 8080))
+	for i := 0; i < 3; i++ {
+		ss, stale, err := c.Lookup("task", "")
+		if err != nil || stale || len(ss) != 1 {
+			t.Fatalf("lookup %d: %v %v %v", i, ss, stale, err)
+		}
+	}
+	if backend.lookups != 1 {
+		t.Fatalf("backend looked up %d times, want 1", backend.lookups)
+	}
+	if list, err := c.ListServices(); err != nil || len(list) != 1 {
+		t.Fatalf("list: %v %v", list, err)
+	}
+
+	backend.setDown(true)
+	mem.Register(NewService("task", "2.0.0", "10.0.0.2", 8080))
+	c.refresh(nil)
+	ss, stale, err := c.Lookup("task", "")
+	if err != nil || !stale || len(ss) != 1 {
+		t.Fatalf("lookup during outage: %v %v %v", ss, stale, err)
+	}
+	if list, err := c.ListServices(); err != nil || len(list) != 1 {
+		t.Fatalf("list during outage: %v %v", list, err)
+	}
+	if _, err := c.GetService("unknown", ""); err != errBackendDown {
+		t.Fatalf("got %v for uncached service, want errBackendDown", err)
+	}
+
+	backend.setDown(false)
+	c.refresh(nil)
+	if ss, stale, err := c.Lookup("task", ""); err != nil || stale || len(ss) != 2 {
+		t.Fatalf("lookup after outage: %v %v %v", ss, stale, err)
+	}
+}
+
+func TestCacheWatch(t *testing.T) {
+	mem := NewMemoryRegistry()
+	c := NewCacheRegistry(mem, CacheConfig{RefreshInterval: time.Hour})
+	defer c.Close()
+
+	mem.Register(NewService("task", "1.0.0", "10.0.0.1", 8080))
+	if ss, _ := c.GetService("task", ""); len(ss) != 1 {
+		t.Fatalf("unexpected services %v", ss)
+	}
+	mem.Register(NewService("task", "2.0.0", "10.0.0.2", 8080))
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if ss, _ := c.GetService("task", ""); len(ss) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cache not refreshed after registry change")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.json")
+
+	mem := NewMemoryRegistry()
+	s := newMetaService()
+	mem.Register(s)
+	c := NewCacheRegistry(mem, CacheConfig{SnapshotPath: path})
+	want, err := c.GetService("task", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// cold start while the backend is down
+	backend := &flakyRegistry{Registry: NewMemoryRegistry(), down: true}
+	c = NewCacheRegistry(backend, CacheConfig{SnapshotPath: path})
+	defer c.Close()
+	ss, stale, err := c.Lookup("task", "")
+	if err != nil || !stale || len(ss) != 1 {
+		t.Fatalf("lookup from snapshot: %v %v %v", ss, stale, err)
+	}
+	got, exp := ss[0].Nodes[0], want[0].Nodes[0]
+	if got.Id != exp.Id || got.Weight != exp.Weight || got.Metadata["region"] != "east" {
+		t.Fatalf("snapshot node %#v, want %#v", got, exp)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+
+	"airman.com/airfk/pkg/event"
+)
+
+var ErrInvalidConfigKey = errors.New("invalid config key")
+
+// ConfigSource is implemented by registries storing the configuration of
+// services. The values of a service are kept below
+// /<prefix>/_config/<service>/<key>, keys don't contain slashes.
+type ConfigSource interface {
+	// GetConfig returns the configuration values of service by key.
+	GetConfig(service string) (map[string][]byte, error)
+	// PutConfig stores a configuration value of service.
+	PutConfig(service, key string, value []byte) error
+	// DeleteConfig removes a configuration value of service.
+	DeleteConfig(service, key string) error
+	// WatchConfig delivers the configuration values of service on ch, first
+	// the current ones and then the complete values after every change.
+	WatchConfig(service string, ch chan<- map[string][]byte) (event.Subscription, error)
+}
+
+var (
+	_ ConfigSource = (*ConsulRegistry)(nil)
+	_ ConfigSource = (*EtcdRegistry)(nil)
+	_ ConfigSource = (*MemoryRegistry)(nil)
+)
+
+// configPrefix keeps the configuration apart from the registered nodes.
+const configPrefix = "_config"
+
+func configKey(root, service string) string {
+	return root + "/" + configPrefix + "/" + service
+}
+
+func checkConfigKey(service, key string) error {
+	if service == "" {
+		return ErrNilKey
+	}
+	if key == "" || strings.Contains(key, "/") {
+		return ErrInvalidConfigKey
+	}
+	return nil
+}
+
+// configWatch is the subscription returned by WatchConfig.
+type configWatch struct {
+	subLoop
+	service string
+	ch      chan<- map[string][]byte
+	last    map[string][]byte // nil until the first delivery
+}
+
+func newConfigWatch(service string, ch chan<- map[string][]byte) *configWatch {
+	return &configWatch{subLoop: newSubLoop(), service: service, ch: ch}
+}
+
+// send delivers values unless they equal the last delivery. It returns false
+// if the watch was unsubscribed.
+func (w *configWatch) send(values map[string][]byte) bool {
+	if w.last != nil && reflect.DeepEqual(w.last, values) {
+		return true
+	}
+	w.last = values
+	select {
+	case w.ch <- values:
+		return true
+	case <-w.ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+
+	"airman.com/airfk/pkg/event"
+)
+
+// configPath returns the consul KV prefix of the values of service.
+func (c *ConsulRegistry) configPath(service string) string {
+	return strings.TrimPrefix(configKey(c.opts.root(), service), "/") + "/"
+}
+
+func configValues(prefix string, pairs consul.KVPairs) map[string][]byte {
+	values := make(map[string][]byte, len(pairs))
+	for _, pair := range pairs {
+		key := strings.TrimPrefix(pair.Key, prefix)
+		if key != "" && !strings.Contains(key, "/") {
+			values[key] = pair.Value
+		}
+	}
+	return values
+}
+
+func (c *ConsulRegistry) GetConfig(service string) (map[string][]byte, error) {
+	if service == "" {
+		return nil, ErrNilKey
+	}
+	prefix := c.configPath(service)
+	pairs, _, err := c.client.KV().List(prefix, &consul.QueryOptions{Datacenter: c.opts.Datacenter})
+	if err != nil {
+		return nil, err
+	}
+	return configValues(prefix, pairs), nil
+}
+
+func (c *ConsulRegistry) PutConfig(service, key string, value []byte) error {
+	if err := checkConfigKey(service, key); err != nil {
+		return err
+	}
+	pair := &consul.KVPair{Key: c.configPath(service) + key, Value: value}
+	_, err := c.client.KV().Put(pair, &consul.WriteOptions{Datacenter: c.opts.Datacenter})
+	return err
+}
+
+func (c *ConsulRegistry) DeleteConfig(service, key string) error {
+	if err := checkConfigKey(service, key); err != nil {
+		return err
+	}
+	_, err := c.client.KV().Delete(c.configPath(service)+key, &consul.WriteOptions{Datacenter: c.opts.Datacenter})
+	return err
+}
+
+// WatchConfig implements ConfigSource with blocking queries on the KV prefix
+// of the service.
+func (c *ConsulRegistry) WatchConfig(service string, ch chan<- map[string][]byte) (event.Subscription, error) {
+	if service == "" {
+		return nil, ErrNilKey
+	}
+	w := newConfigWatch(service, ch)
+	go func() {
+		defer w.exit()
+
+		prefix := c.configPath(service)
+		var index uint64
+		for {
+			opts := &consul.QueryOptions{
+				Datacenter: c.opts.Datacenter,
+				WaitIndex:  index,
+				WaitTime:   DefaultWatchWaitTime,
+			}
+			pairs, meta, err := c.client.KV().List(prefix, opts.WithContext(w.ctx))
+			if err != nil {
+				if w.ctx.Err() != nil {
+					return
+				}
+				log.Warnf("consul config watch %s failed: %v", service, err)
+				if !w.wait() {
+					return
+				}
+				continue
+			}
+			if meta.LastIndex < index {
+				index = 0
+			} else {
+				index = meta.LastIndex
+			}
+			if !w.send(configValues(prefix, pairs)) {
+				return
+			}
+		}
+	}()
+	return w, nil
+}
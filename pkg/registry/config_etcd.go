@@ -0,0 +1,108 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"context"
+	"strings"
+
+	"github.com/coreos/etcd/clientv3"
+	log "github.com/sirupsen/logrus"
+
+	"airman.com/airfk/pkg/event"
+)
+
+func (c *EtcdRegistry) GetConfig(service string) (map[string][]byte, error) {
+	if service == "" {
+		return nil, ErrNilKey
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.reqTimeout)
+	defer cancel()
+	values, _, err := c.getConfig(ctx, service)
+	return values, err
+}
+
+// getConfig reads the values of service and the revision they were read at.
+func (c *EtcdRegistry) getConfig(ctx context.Context, service string) (map[string][]byte, int64, error) {
+	prefix := configKey(c.root, service) + "/"
+	resp, err := c.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+	values := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		key := strings.TrimPrefix(string(kv.Key), prefix)
+		if key != "" && !strings.Contains(key, "/") {
+			values[key] = kv.Value
+		}
+	}
+	return values, resp.Header.Revision, nil
+}
+
+func (c *EtcdRegistry) PutConfig(service, key string, value []byte) error {
+	if err := checkConfigKey(service, key); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.reqTimeout)
+	defer cancel()
+	_, err := c.client.Put(ctx, configKey(c.root, service)+"/"+key, string(value))
+	return err
+}
+
+func (c *EtcdRegistry) DeleteConfig(service, key string) error {
+	if err := checkConfigKey(service, key); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.reqTimeout)
+	defer cancel()
+	_, err := c.client.Delete(ctx, configKey(c.root, service)+"/"+key)
+	return err
+}
+
+// WatchConfig implements ConfigSource. The values are read again after every
+// change below the prefix of the service.
+func (c *EtcdRegistry) WatchConfig(service string, ch chan<- map[string][]byte) (event.Subscription, error) {
+	if service == "" {
+		return nil, ErrNilKey
+	}
+	w := newConfigWatch(service, ch)
+	go func() {
+		defer w.exit()
+
+		prefix := configKey(c.root, service) + "/"
+		for {
+			ctx, cancel := context.WithTimeout(w.ctx, c.reqTimeout)
+			values, rev, err := c.getConfig(ctx, service)
+			cancel()
+			if err == nil {
+				if !w.send(values) {
+					return
+				}
+				err = c.waitChange(w.ctx, prefix, rev)
+			}
+			if w.ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Warnf("etcd config watch %s failed: %v", service, err)
+				if !w.wait() {
+					return
+				}
+			}
+		}
+	}()
+	return w, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"airman.com/airfk/pkg/event"
+)
+
+func (m *MemoryRegistry) GetConfig(service string) (map[string][]byte, error) {
+	if service == "" {
+		return nil, ErrNilKey
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	values := make(map[string][]byte, len(m.configs[service]))
+	for key, value := range m.configs[service] {
+		values[key] = append([]byte(nil), value...)
+	}
+	return values, nil
+}
+
+func (m *MemoryRegistry) PutConfig(service, key string, value []byte) error {
+	if err := checkConfigKey(service, key); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values, ok := m.configs[service]
+	if !ok {
+		values = make(map[string][]byte)
+		m.configs[service] = values
+	}
+	values[key] = append([]byte(nil), value...)
+	m.notify()
+	return nil
+}
+
+func (m *MemoryRegistry) DeleteConfig(service, key string) error {
+	if err := checkConfigKey(service, key); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if values, ok := m.configs[service]; ok {
+		delete(values, key)
+		if len(values) == 0 {
+			delete(m.configs, service)
+		}
+		m.notify()
+	}
+	return nil
+}
+
+// WatchConfig implements ConfigSource. Watchers compare the values after
+// every change of the registry.
+func (m *MemoryRegistry) WatchConfig(service string, ch chan<- map[string][]byte) (event.Subscription, error) {
+	if service == "" {
+		return nil, ErrNilKey
+	}
+	w := newConfigWatch(service, ch)
+	wake := make(chan struct{}, 1)
+	m.mu.Lock()
+	m.wakeups[wake] = struct{}{}
+	m.mu.Unlock()
+
+	go func() {
+		defer w.exit()
+		defer func() {
+			m.mu.Lock()
+			delete(m.wakeups, wake)
+			m.mu.Unlock()
+		}()
+
+		for {
+			values, _ := m.GetConfig(service)
+			if !w.send(values) {
+				return
+			}
+			select {
+			case <-wake:
+			case <-w.ctx.Done():
+				return
+			}
+		}
+	}()
+	return w, nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func waitConfig(t *testing.T, ch <-chan map[string][]byte, want map[string]string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case values := <-ch:
+			got := make(map[string]string, len(values))
+			for key, value := range values {
+				got[key] = string(value)
+			}
+			if reflect.DeepEqual(got, want) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for config %v", want)
+		}
+	}
+}
+
+// testConfigSource stores and watches the configuration of a service on src.
+func testConfigSource(t *testing.T, src ConfigSource) {
+	if err := src.PutConfig("task", "a/b", nil); err != ErrInvalidConfigKey {
+		t.Fatalf("put with slash: %v", err)
+	}
+	if err := src.PutConfig("task", "http_modules", []byte(`["admin"]`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.PutConfig("other", "http_modules", []byte(`["other"]`)); err != nil {
+		t.Fatal(err)
+	}
+	values, err := src.GetConfig("task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || string(values["http_modules"]) != `["admin"]` {
+		t.Fatalf("unexpected values %q", values)
+	}
+
+	ch := make(chan map[string][]byte, 8)
+	sub, err := src.WatchConfig("task", ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	waitConfig(t, ch, map[string]string{"http_modules": `["admin"]`})
+
+	if err := src.PutConfig("task", "http_origins", []byte(`["http://a.com"]`)); err != nil {
+		t.Fatal(err)
+	}
+	waitConfig(t, ch, map[string]string{"http_modules": `["admin"]`, "http_origins": `["http://a.com"]`})
+	if err := src.DeleteConfig("task", "http_modules"); err != nil {
+		t.Fatal(err)
+	}
+	waitConfig(t, ch, map[string]string{"http_origins": `["http://a.com"]`})
+
+	// Configuration values are not mistaken for services.
+	if r, ok := src.(Registry); ok {
+		if list, err := r.ListServices(); err != nil || len(list) != 0 {
+			t.Fatalf("unexpected services %v %v", list, err)
+		}
+	}
+}
+
+func TestMemoryConfig(t *testing.T) {
+	testConfigSource(t, NewMemoryRegistry())
+}
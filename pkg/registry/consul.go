@@ -19,14 +19,20 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	consul "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+
+	"airman.com/airfk/pkg/event"
+	"airman.com/airfk/pkg/health"
 )
 
 const (
-	DefaultInterval   = 10 * time.Second
-	DefaultTagService = "service"
+	DefaultInterval      = 10 * time.Second
+	DefaultTagService    = "service"
+	DefaultWatchWaitTime = 5 * time.Minute
 )
 
 type ConsulRegistry struct {
@@ -34,6 +40,8 @@ type ConsulRegistry struct {
 	client       *consul.Client
 	timeout      time.Duration
 	queryOptions *consul.QueryOptions
+	opts         Options
+	dc           *consul.Client // client of opts.Datacenter, nil for that of the agent
 }
 
 func NewConsulRegistry(address string, timeout time.Duration) (*ConsulRegistry, error) {
@@ -48,6 +56,43 @@ func NewConsulRegistry(address string, timeout time.Duration) (*ConsulRegistry,
 	return r, nil
 }
 
+// NewConsulRegistryWithOptions creates a consul registry tagging its nodes
+// with the namespace of opts and querying the datacenter of opts.
+func NewConsulRegistryWithOptions(address string, timeout time.Duration, opts Options) (*ConsulRegistry, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	r, err := NewConsulRegistry(address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	r.opts = opts
+	r.queryOptions.Datacenter = opts.Datacenter
+	if opts.Datacenter != "" {
+		config := consul.DefaultConfig()
+		config.Address = r.addr
+		config.Datacenter = opts.Datacenter
+		if r.dc, err = consul.NewClient(config); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// dcClient returns a client sending all its requests to the datacenter of the
+// options, for APIs without per-request options like the lock recipe.
+func (c *ConsulRegistry) dcClient() *consul.Client {
+	if c.dc != nil {
+		return c.dc
+	}
+	return c.client
+}
+
+// Options returns the options the registry was created with.
+func (c *ConsulRegistry) Options() Options {
+	return c.opts
+}
+
 func configure(c *ConsulRegistry, address string, timeout time.Duration) error {
 	// use default config
 	config := consul.DefaultConfig()
@@ -93,6 +138,13 @@ func getDeregisterTTL(t time.Duration) time.Duration {
 }
 
 func (c *ConsulRegistry) RegisterWithTTL(s *Service, timeTTL time.Duration) error {
+	return c.RegisterWithHealth(s, timeTTL, nil)
+}
+
+// RegisterWithHealth registers the first node of s with a TTL check whose
+// status is set by err, like ReportHealth. A registered node only gets its
+// status updated.
+func (c *ConsulRegistry) RegisterWithHealth(s *Service, timeTTL time.Duration, failure error) error {
 	if len(s.Nodes) == 0 {
 		return errors.New("require at least one node")
 	}
@@ -101,10 +153,15 @@ func (c *ConsulRegistry) RegisterWithTTL(s *Service, timeTTL time.Duration) erro
 	node := s.Nodes[0]
 
 	// full re-register
-	if err := c.client.Agent().PassTTL("service:"+node.Id, ""); err == nil {
+	if err := c.ReportHealth(s, failure); err == nil {
 		return nil
 	}
 
+	meta, err := serviceMeta(s)
+	if err != nil {
+		return err
+	}
+
 	deregTTL := getDeregisterTTL(timeTTL)
 	check := &consul.AgentServiceCheck{
 		Name:                           s.Name,
@@ -117,7 +174,8 @@ func (c *ConsulRegistry) RegisterWithTTL(s *Service, timeTTL time.Duration) erro
 	asr := &consul.AgentServiceRegistration{
 		ID:      node.Id,
 		Name:    s.Name,
-		Tags:    s.GetTags(),
+		Tags:    c.tags(s),
+		Meta:    meta,
 		Port:    node.Port,
 		Address: node.Host,
 		Check:   check,
@@ -138,10 +196,12 @@ func (c *ConsulRegistry) RegisterWithTTL(s *Service, timeTTL time.Duration) erro
 	if timeTTL == time.Duration(0) {
 		return nil
 	}
-	return c.client.Agent().PassTTL("service:"+node.Id, "")
+	return c.ReportHealth(s, failure)
 }
 
-// default is 30s.
+// Register registers the first node of s with an HTTP check consul runs every
+// 10s against the Check path of the node, the readiness path of package health
+// by default.
 func (c *ConsulRegistry) Register(s *Service) error {
 	if len(s.Nodes) == 0 {
 		return errors.New("require at least one node")
@@ -155,10 +215,15 @@ func (c *ConsulRegistry) Register(s *Service) error {
 		return nil
 	}
 
+	meta, err := serviceMeta(s)
+	if err != nil {
+		return err
+	}
+
 	unregTTL := getDeregisterTTL(0)
-	healthCheck := fmt.Sprintf("http://%v:%v/%v", node.Host, node.Port, s.Check)
+	healthCheck := fmt.Sprintf("http://%v:%v/%v", node.Host, node.Port, strings.TrimPrefix(s.Check, "/"))
 	if s.Check == "" {
-		healthCheck = fmt.Sprintf("http://%v:%v", node.Host, node.Port)
+		healthCheck = fmt.Sprintf("http://%v:%v%v", node.Host, node.Port, health.ReadyPath)
 	}
 	check := &consul.AgentServiceCheck{
 		Name:                           s.Name,
@@ -173,7 +238,8 @@ func (c *ConsulRegistry) Register(s *Service) error {
 	asr := &consul.AgentServiceRegistration{
 		ID:      node.Id,
 		Name:    s.Name,
-		Tags:    s.GetTags(),
+		Tags:    c.tags(s),
+		Meta:    meta,
 		Port:    node.Port,
 		Address: node.Host,
 		Check:   check,
@@ -185,6 +251,19 @@ func (c *ConsulRegistry) Register(s *Service) error {
 	return nil
 }
 
+// ReportHealth sets the status of the TTL check of the first node of s. The
+// check fails with the error as output if err is not nil.
+func (c *ConsulRegistry) ReportHealth(s *Service, err error) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
+	}
+	status, output := consul.HealthPassing, ""
+	if err != nil {
+		status, output = consul.HealthCritical, err.Error()
+	}
+	return c.client.Agent().UpdateTTL("service:"+s.Nodes[0].Id, output, status)
+}
+
 func (c *ConsulRegistry) Deregister(s *Service) error {
 	if len(s.Nodes) == 0 {
 		return errors.New("require at least one node")
@@ -193,15 +272,39 @@ func (c *ConsulRegistry) Deregister(s *Service) error {
 	return c.client.Agent().ServiceDeregister(node.Id)
 }
 
+// tags returns the consul tags of s, including the namespace tag.
+func (c *ConsulRegistry) tags(s *Service) []string {
+	tags := s.GetTags()
+	if tag := c.opts.namespaceTag(); tag != "" {
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
 func (c *ConsulRegistry) GetService(name, tag string) ([]*Service, error) {
 	rsp, _, err := c.client.Health().Service(name, tag, false, c.queryOptions)
 	if err != nil {
 		return nil, err
 	}
+	return servicesFromEntries(name, tag, c.opts.Namespace, rsp), nil
+}
 
+// entryNamespace returns the namespace a consul service is tagged with.
+func entryNamespace(tags []string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, namespaceTagPrefix) {
+			return strings.TrimPrefix(tag, namespaceTagPrefix)
+		}
+	}
+	return ""
+}
+
+// servicesFromEntries groups the healthy entries of a health query in the
+// given namespace by version.
+func servicesFromEntries(name, tag, namespace string, rsp []*consul.ServiceEntry) []*Service {
 	serviceMap := map[string]*Service{}
 	for _, s := range rsp {
-		if s.Service.Service != name {
+		if s.Service.Service != name || entryNamespace(s.Service.Tags) != namespace {
 			continue
 		}
 
@@ -219,12 +322,18 @@ func (c *ConsulRegistry) GetService(name, tag string) ([]*Service, error) {
 			continue
 		}
 
-		version := tagsVersion(s.Service.Tags)
 		address := s.Service.Address
 		// use node address
 		if len(address) == 0 {
 			address = s.Node.Address
 		}
+		node := &Node{
+			Id:   s.Service.ID,
+			Host: address,
+			Port: s.Service.Port,
+			Tags: s.Service.Tags,
+		}
+		version := applyServiceMeta(node, s.Service.Meta, s.Service.Tags)
 
 		key := tagsCheck(s.Service.Tags, tag)
 		if tag == "" {
@@ -240,18 +349,59 @@ func (c *ConsulRegistry) GetService(name, tag string) ([]*Service, error) {
 			serviceMap[key] = svc
 		}
 
-		svc.Nodes = append(svc.Nodes, &Node{
-			Id:   s.Service.ID,
-			Host: address,
-			Port: s.Service.Port,
-		})
+		svc.Nodes = append(svc.Nodes, node)
 	}
 
 	var services []*Service
 	for _, service := range serviceMap {
 		services = append(services, service)
 	}
-	return services, nil
+	return services
+}
+
+// Watch implements Watcher with blocking queries on the health endpoint of
+// the service.
+func (c *ConsulRegistry) Watch(name string, ch chan<- *Event) (event.Subscription, error) {
+	if name == "" {
+		return nil, ErrNilKey
+	}
+	w := newWatch(name, ch)
+	go c.watchLoop(w)
+	return w, nil
+}
+
+func (c *ConsulRegistry) watchLoop(w *watch) {
+	defer w.exit()
+
+	var index uint64
+	for {
+		opts := &consul.QueryOptions{
+			Datacenter: c.opts.Datacenter,
+			AllowStale: true,
+			WaitIndex:  index,
+			WaitTime:   DefaultWatchWaitTime,
+		}
+		rsp, meta, err := c.client.Health().Service(w.name, "", false, opts.WithContext(w.ctx))
+		if err != nil {
+			if w.ctx.Err() != nil {
+				return
+			}
+			log.Warnf("consul watch %s failed: %v", w.name, err)
+			if !w.wait() {
+				return
+			}
+			continue
+		}
+		// The index can go backwards, e.g. after a consul restart.
+		if meta.LastIndex < index {
+			index = 0
+		} else {
+			index = meta.LastIndex
+		}
+		if !w.sync(servicesFromEntries(w.name, "", c.opts.Namespace, rsp)) {
+			return
+		}
+	}
 }
 
 func (c *ConsulRegistry) ListServices() ([]*Service, error) {
@@ -261,9 +411,13 @@ func (c *ConsulRegistry) ListServices() ([]*Service, error) {
 	}
 
 	var services []*Service
-
-	for service := range rsp {
-		services = append(services, &Service{Name: service})
+	// the catalog lists the tags of all nodes of a service, so services are
+	// only filtered in namespaces
+	nsTag := c.opts.namespaceTag()
+	for service, tags := range rsp {
+		if nsTag == "" || hasTag(tags, nsTag) {
+			services = append(services, &Service{Name: service})
+		}
 	}
 	return services, nil
 }
@@ -0,0 +1,342 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"airman.com/airfk/pkg/event"
+)
+
+const DefaultDNSRefreshInterval = 30 * time.Second
+
+var (
+	ErrReadOnly       = errors.New("registry is read-only")
+	ErrRegistryClosed = errors.New("registry closed")
+)
+
+// DNSConfig contains the settings of a DNSRegistry.
+type DNSConfig struct {
+	Domain          string        // domain of the SRV records, e.g. "service.example.com"
+	Server          string        // host:port of the DNS server, empty uses the system resolver
+	Timeout         time.Duration // timeout of a lookup
+	RefreshInterval time.Duration // interval of the background refresh
+}
+
+type dnsEntry struct {
+	services []*Service
+	resolved bool // false until the first successful lookup
+	watchers int  // number of watches of the name
+	used     bool // looked up since the previous refresh
+}
+
+// DNSRegistry is a read-only registry resolving the SRV records
+// _<name>._tcp.<domain> of services. A service has a single version "" and
+// one node per SRV target, with the target host name as Host.
+//
+// Node.Weight is the SRV weight plus one and the SRV priority is kept in the
+// node metadata MetaPriority, see Node.Priority. The balancer only sends calls
+// to the backup targets while all preferred targets are ejected.
+//
+// Services that are watched or were looked up since the previous refresh are
+// resolved again every RefreshInterval, the others are forgotten. Watchers are
+// told the changes of a refresh, failed lookups keep the last known nodes.
+type DNSRegistry struct {
+	config   DNSConfig
+	resolver *net.Resolver
+
+	mu       sync.RWMutex
+	services map[string]*dnsEntry     // name -> last lookup
+	watches  map[*watch]chan struct{} // watch -> wakeup channel notified after refreshes
+	closed   bool
+
+	closeOnce sync.Once
+	quit      chan struct{}
+	done      chan struct{}
+	wg        sync.WaitGroup // watch goroutines
+}
+
+func NewDNSRegistry(config DNSConfig) (*DNSRegistry, error) {
+	if config.Domain == "" {
+		return nil, errors.New("dns registry requires a domain")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultRequestTimeout
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = DefaultDNSRefreshInterval
+	}
+	r := &DNSRegistry{
+		config:   config,
+		resolver: net.DefaultResolver,
+		services: make(map[string]*dnsEntry),
+		watches:  make(map[*watch]chan struct{}),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if config.Server != "" {
+		var dialer net.Dialer
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, config.Server)
+			},
+		}
+	}
+	go r.loop()
+	return r, nil
+}
+
+func (r *DNSRegistry) Register(s *Service) error {
+	return ErrReadOnly
+}
+
+func (r *DNSRegistry) RegisterWithTTL(s *Service, timeTTL time.Duration) error {
+	return ErrReadOnly
+}
+
+func (r *DNSRegistry) Deregister(s *Service) error {
+	return ErrReadOnly
+}
+
+func (r *DNSRegistry) GetService(name, tag string) ([]*Service, error) {
+	if name == "" {
+		return nil, ErrNilKey
+	}
+	r.mu.Lock()
+	entry, ok := r.services[name]
+	if ok {
+		entry.used = true
+	}
+	resolved := ok && entry.resolved
+	r.mu.Unlock()
+	if !resolved {
+		if err := r.refresh(name); err != nil {
+			return nil, err
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var services []*Service
+	for _, svc := range r.services[name].lookup() {
+		if tag == "" || hasTag(svc.Tags, tag) {
+			services = append(services, svc)
+		}
+	}
+	return services, nil
+}
+
+// ListServices returns the services looked up so far that have nodes, DNS
+// can't enumerate the SRV records of a domain.
+func (r *DNSRegistry) ListServices() ([]*Service, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	services := make([]*Service, 0, len(r.services))
+	for name, entry := range r.services {
+		if len(entry.services) > 0 {
+			services = append(services, &Service{Name: name})
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services, nil
+}
+
+// Close stops refreshing and ends all watches.
+func (r *DNSRegistry) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.quit)
+		<-r.done
+
+		r.mu.Lock()
+		r.closed = true
+		for w := range r.watches {
+			w.cancel()
+		}
+		r.mu.Unlock()
+		r.wg.Wait()
+	})
+	return nil
+}
+
+// Watch implements Watcher. The service is compared after every refresh.
+func (r *DNSRegistry) Watch(name string, ch chan<- *Event) (event.Subscription, error) {
+	if name == "" {
+		return nil, ErrNilKey
+	}
+	w := newWatch(name, ch)
+	wake := make(chan struct{}, 1)
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, ErrRegistryClosed
+	}
+	r.watches[w] = wake
+	// Track the service so the refresh resolves it.
+	entry, ok := r.services[name]
+	if !ok {
+		entry = &dnsEntry{}
+		r.services[name] = entry
+	}
+	entry.watchers++
+	resolved := entry.resolved
+	r.wg.Add(1)
+	r.mu.Unlock()
+
+	go func() {
+		defer r.wg.Done()
+		defer w.exit()
+		defer func() {
+			r.mu.Lock()
+			delete(r.watches, w)
+			entry.watchers--
+			r.mu.Unlock()
+		}()
+
+		for {
+			r.mu.RLock()
+			services := entry.services
+			r.mu.RUnlock()
+			if !w.sync(services) {
+				return
+			}
+			select {
+			case <-wake:
+			case <-w.ctx.Done():
+				return
+			}
+		}
+	}()
+	if !resolved {
+		go func() {
+			if err := r.refresh(name); err != nil {
+				log.Warnf("dns registry: lookup of %s failed: %v", name, err)
+			}
+		}()
+	}
+	return w, nil
+}
+
+// lookup returns the services of the last lookup, e may be nil.
+func (e *dnsEntry) lookup() []*Service {
+	if e == nil {
+		return nil
+	}
+	return e.services
+}
+
+func (r *DNSRegistry) loop() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.config.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.mu.Lock()
+			names := make([]string, 0, len(r.services))
+			for name, entry := range r.services {
+				if entry.watchers == 0 && !entry.used {
+					delete(r.services, name)
+					continue
+				}
+				entry.used = false
+				names = append(names, name)
+			}
+			r.mu.Unlock()
+			for _, name := range names {
+				if err := r.refresh(name); err != nil {
+					log.Warnf("dns registry: refresh of %s failed: %v", name, err)
+				}
+			}
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// refresh resolves name and notifies the watchers if the nodes changed.
+func (r *DNSRegistry) refresh(name string) error {
+	services, err := r.lookup(name)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.services[name]
+	if !ok {
+		entry = &dnsEntry{used: true}
+		r.services[name] = entry
+	}
+	if entry.resolved && reflect.DeepEqual(entry.services, services) {
+		return nil
+	}
+	entry.services, entry.resolved = services, true
+	for _, wake := range r.watches {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// lookup resolves the SRV records of name. A name without records has no
+// services.
+func (r *DNSRegistry) lookup(name string) ([]*Service, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.Timeout)
+	defer cancel()
+	_, addrs, err := r.resolver.LookupSRV(ctx, name, "tcp", r.config.Domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+	return []*Service{{Name: name, Nodes: srvNodes(addrs)}}, nil
+}
+
+// srvNodes converts SRV records into nodes sorted by id.
+func srvNodes(addrs []*net.SRV) []*Node {
+	nodes := make([]*Node, 0, len(addrs))
+	for _, addr := range addrs {
+		host := strings.TrimSuffix(addr.Target, ".")
+		nodes = append(nodes, &Node{
+			Id:       fmt.Sprintf("%s:%d", host, addr.Port),
+			Host:     host,
+			Port:     int(addr.Port),
+			Weight:   int(addr.Weight) + 1,
+			Metadata: map[string]string{MetaPriority: strconv.Itoa(int(addr.Priority))},
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Id < nodes[j].Id })
+	return nodes
+}
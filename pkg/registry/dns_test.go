@@ -0,0 +1,297 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS answers SRV queries over UDP from a table of records.
+type fakeDNS struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	records map[string][]*net.SRV // fully qualified name -> records
+	fail    bool                  // answer with a server failure
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeDNS{conn: conn, records: make(map[string][]*net.SRV)}
+	go f.serve()
+	return f
+}
+
+func (f *fakeDNS) addr() string {
+	return f.conn.LocalAddr().String()
+}
+
+func (f *fakeDNS) close() {
+	f.conn.Close()
+}
+
+func (f *fakeDNS) set(name string, records ...*net.SRV) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(records) == 0 {
+		delete(f.records, name)
+	} else {
+		f.records[name] = records
+	}
+}
+
+func (f *fakeDNS) setFail(fail bool) {
+	f.mu.Lock()
+	f.fail = fail
+	f.mu.Unlock()
+}
+
+func (f *fakeDNS) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if msg, err := f.answer(buf[:n]); err == nil {
+			f.conn.WriteTo(msg, addr)
+		}
+	}
+}
+
+func (f *fakeDNS) answer(req []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(req)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	records, found := f.records[q.Name.String()]
+	fail := f.fail
+	f.mu.Unlock()
+
+	header := dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+	}
+	switch {
+	case fail:
+		header.RCode = dnsmessage.RCodeServerFailure
+	case !found:
+		header.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, header)
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	if !fail && q.Type == dnsmessage.TypeSRV {
+		for _, rec := range records {
+			target, err := dnsmessage.NewName(rec.Target)
+			if err != nil {
+				return nil, err
+			}
+			rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+			srv := dnsmessage.SRVResource{Priority: rec.Priority, Weight: rec.Weight, Port: rec.Port, Target: target}
+			if err := b.SRVResource(rh, srv); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b.Finish()
+}
+
+func TestSrvNodes(t *testing.T) {
+	nodes := srvNodes([]*net.SRV{
+		{Target: "b.example.com.", Port: 8080, Priority: 10, Weight: 0},
+		{Target: "a.example.com.", Port: 8080, Priority: 10, Weight: 5},
+		{Target: "backup.example.com.", Port: 9090, Priority: 20, Weight: 3},
+	})
+	want := []*Node{
+		{Id: "a.example.com:8080", Host: "a.example.com", Port: 8080, Weight: 6, Metadata: map[string]string{"priority": "10"}},
+		{Id: "b.example.com:8080", Host: "b.example.com", Port: 8080, Weight: 1, Metadata: map[string]string{"priority": "10"}},
+		{Id: "backup.example.com:9090", Host: "backup.example.com", Port: 9090, Weight: 4, Metadata: map[string]string{"priority": "20"}},
+	}
+	if !reflect.DeepEqual(nodes, want) {
+		for _, node := range nodes {
+			t.Logf("%+v", node)
+		}
+		t.Fatal("unexpected nodes")
+	}
+	if p := nodes[2].Priority(); p != 20 {
+		t.Fatalf("backup priority %d, want 20", p)
+	}
+}
+
+func TestDNSRegistry(t *testing.T) {
+	dns := newFakeDNS(t)
+	defer dns.close()
+	dns.set("_task._tcp.example.com.",
+		&net.SRV{Target: "a.example.com.", Port: 8080, Priority: 10, Weight: 1},
+		&net.SRV{Target: "b.example.com.", Port: 8080, Priority: 10, Weight: 1},
+	)
+
+	r, err := New("dns://example.com?server=" + dns.addr() + "&timeout=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	ss, err := r.GetService("task", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 1 || len(ss[0].Nodes) != 2 || ss[0].Nodes[0].Host != "a.example.com" || ss[0].Nodes[1].Weight != 2 {
+		t.Fatalf("unexpected services %v", ss)
+	}
+	if ss, err := r.GetService("missing", ""); err != nil || len(ss) != 0 {
+		t.Fatalf("missing service: %v %v", ss, err)
+	}
+	if list, err := r.ListServices(); err != nil || len(list) != 1 || list[0].Name != "task" {
+		t.Fatalf("unexpected list %v %v", list, err)
+	}
+	if err := r.Register(NewService("task", "1.0.0", "10.0.0.1", 8080)); err != ErrReadOnly {
+		t.Fatalf("register: %v", err)
+	}
+}
+
+func TestDNSRegistryWatch(t *testing.T) {
+	dns := newFakeDNS(t)
+	defer dns.close()
+	dns.set("_task._tcp.example.com.",
+		&net.SRV{Target: "a.example.com.", Port: 8080, Priority: 10},
+		&net.SRV{Target: "b.example.com.", Port: 8080, Priority: 10},
+	)
+
+	r, err := NewDNSRegistry(DNSConfig{
+		Domain:          "example.com",
+		Server:          dns.addr(),
+		Timeout:         time.Second,
+		RefreshInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	ch := make(chan *Event, 8)
+	sub, err := r.Watch("task", ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	expectEvent(t, ch, EventAdd, "a.example.com")
+	expectEvent(t, ch, EventAdd, "b.example.com")
+
+	dns.set("_task._tcp.example.com.", &net.SRV{Target: "a.example.com.", Port: 8080, Priority: 10})
+	expectEvent(t, ch, EventRemove, "b.example.com")
+
+	// Failed refreshes keep the last known nodes.
+	dns.setFail(true)
+	expectNoEvent(t, ch)
+	ss, err := r.GetService("task", "")
+	if err != nil || len(ss) != 1 || len(ss[0].Nodes) != 1 {
+		t.Fatalf("services during failure %v %v", ss, err)
+	}
+	dns.setFail(false)
+	dns.set("_task._tcp.example.com.")
+	expectEvent(t, ch, EventRemove, "a.example.com")
+}
+
+func TestDNSRegistryForget(t *testing.T) {
+	dns := newFakeDNS(t)
+	defer dns.close()
+	dns.set("_task._tcp.example.com.", &net.SRV{Target: "a.example.com.", Port: 8080})
+	dns.set("_api._tcp.example.com.", &net.SRV{Target: "b.example.com.", Port: 8080})
+
+	r, err := NewDNSRegistry(DNSConfig{
+		Domain:          "example.com",
+		Server:          dns.addr(),
+		Timeout:         time.Second,
+		RefreshInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	ch := make(chan *Event, 8)
+	if _, err := r.Watch("api", ch); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, ch, EventAdd, "b.example.com")
+	if _, err := r.GetService("task", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The name nothing looks up anymore is forgotten, the watched one stays.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		list, _ := r.ListServices()
+		if len(list) == 1 && list[0].Name == "api" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("services %v, want [api]", list)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDNSRegistryCloseEndsWatch(t *testing.T) {
+	dns := newFakeDNS(t)
+	defer dns.close()
+
+	r, err := NewDNSRegistry(DNSConfig{Domain: "example.com", Server: dns.addr(), Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := r.Watch("task", make(chan *Event))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	select {
+	case <-sub.Err():
+	case <-time.After(time.Second):
+		t.Fatal("watch not ended by Close")
+	}
+	if _, err := r.Watch("task", make(chan *Event)); err != ErrRegistryClosed {
+		t.Fatalf("watch after close: %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"airman.com/airfk/pkg/event"
+)
+
+// SessionTTL is the lifetime of the sessions backing elections and mutexes.
+// A candidate or lock holder that stops refreshing its session loses the
+// leadership or the lock after at most SessionTTL.
+var SessionTTL = 15 * time.Second
+
+var (
+	ErrNoLeader       = errors.New("election has no leader")
+	ErrElectionClosed = errors.New("election closed")
+	ErrMutexNotLocked = errors.New("mutex not locked")
+)
+
+// coordinationPrefix keeps the keys of elections and mutexes apart from the
+// registered nodes.
+const coordinationPrefix = "_coordination"
+
+func coordinationKey(root, kind, name string) string {
+	return root + "/" + coordinationPrefix + "/" + kind + "/" + name
+}
+
+// LeaderEvent is a change of the leadership of an election.
+type LeaderEvent struct {
+	Election string // election name
+	Leader   string // value proclaimed by the leader, empty if there is none
+	IsLeader bool   // whether the local candidate is the leader
+}
+
+// Election elects a single leader among the candidates sharing a name, e.g.
+// the instances of a scheduler.
+type Election interface {
+	// Campaign blocks until the candidate is elected with value or ctx is
+	// done.
+	Campaign(ctx context.Context, value string) error
+	// Resign gives up the leadership so another candidate can be elected.
+	Resign(ctx context.Context) error
+	// Leader returns the value of the current leader or ErrNoLeader.
+	Leader(ctx context.Context) (string, error)
+	// IsLeader reports whether the local candidate is the leader.
+	IsLeader() bool
+	// SubscribeLeader delivers every leadership change on ch, including the
+	// loss of the leadership when the session of the candidate expires.
+	// The channel should be buffered, a blocked receiver stalls the election.
+	SubscribeLeader(ch chan<- LeaderEvent) event.Subscription
+	// Close resigns and stops observing the election.
+	Close() error
+}
+
+// Mutex is a lock shared by all processes using the same name.
+type Mutex interface {
+	// Lock blocks until the lock is acquired or ctx is done.
+	Lock(ctx context.Context) error
+	// Unlock releases the lock.
+	Unlock(ctx context.Context) error
+}
+
+// Coordinator is implemented by registries that can coordinate the instances
+// of a service.
+type Coordinator interface {
+	NewElection(name string) (Election, error)
+	NewMutex(name string) (Mutex, error)
+}
+
+var (
+	_ Coordinator = (*ConsulRegistry)(nil)
+	_ Coordinator = (*EtcdRegistry)(nil)
+	_ Coordinator = (*MemoryRegistry)(nil)
+)
+
+// leaderState is the leadership of an election as observed from the backend.
+// It is only updated by the observing goroutine of the election, so the
+// events are delivered in order.
+type leaderState struct {
+	name string
+	feed event.Feed
+	quit chan struct{} // closed when the election is closed
+
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	leader   string
+	isLeader bool
+	changed  chan struct{} // closed and replaced on every update
+}
+
+func newLeaderState(name string) *leaderState {
+	return &leaderState{
+		name:    name,
+		quit:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+}
+
+func (s *leaderState) IsLeader() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isLeader
+}
+
+func (s *leaderState) SubscribeLeader(ch chan<- LeaderEvent) event.Subscription {
+	return s.feed.Subscribe(ch)
+}
+
+// update records the observed leadership and announces it if it changed.
+func (s *leaderState) update(leader string, isLeader bool) {
+	s.mu.Lock()
+	if leader == s.leader && isLeader == s.isLeader {
+		s.mu.Unlock()
+		return
+	}
+	s.leader, s.isLeader = leader, isLeader
+	close(s.changed)
+	s.changed = make(chan struct{})
+	s.mu.Unlock()
+
+	s.feed.Send(LeaderEvent{Election: s.name, Leader: leader, IsLeader: isLeader})
+}
+
+// wait blocks until the observed leadership of the local candidate is
+// isLeader. Campaign and Resign use it so IsLeader and the events agree with
+// their outcome.
+func (s *leaderState) wait(ctx context.Context, isLeader bool) error {
+	for {
+		s.mu.Lock()
+		if s.isLeader == isLeader {
+			s.mu.Unlock()
+			return nil
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.quit:
+			return ErrElectionClosed
+		}
+	}
+}
+
+// close marks the election closed. It returns false if it already was.
+func (s *leaderState) close() bool {
+	first := false
+	s.closeOnce.Do(func() {
+		close(s.quit)
+		first = true
+	})
+	return first
+}
+
+// closing reports whether the election was closed.
+func (s *leaderState) closing() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// campaignContext returns a context that is also canceled when the election
+// is closed.
+func (s *leaderState) campaignContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-s.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// campaignErr reports a campaign interrupted by Close as ErrElectionClosed.
+func (s *leaderState) campaignErr(err error) error {
+	if err != nil && s.closing() {
+		return ErrElectionClosed
+	}
+	return err
+}
+
+// localLock serializes the callers of a Mutex within the process, so a
+// second Lock waits for Unlock like the lock of another process does.
+type localLock chan struct{}
+
+func newLocalLock() localLock {
+	return make(localLock, 1)
+}
+
+// lock blocks until the lock is free or ctx is done.
+func (l localLock) lock(ctx context.Context) error {
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l localLock) unlock() {
+	<-l
+}
+
+// stopChan returns a channel closed when ctx is done, for APIs taking a stop
+// channel. The returned func releases it.
+func stopChan(ctx context.Context) (<-chan struct{}, func()) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(stop)
+		case <-done:
+		}
+	}()
+	return stop, func() { close(done) }
+}
@@ -0,0 +1,271 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	consul "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// kvKey returns the consul KV key of an election or a mutex.
+func (c *ConsulRegistry) kvKey(kind, name string) string {
+	return strings.TrimPrefix(coordinationKey(c.opts.root(), kind, name), "/")
+}
+
+// NewElection implements Coordinator with the leader election guide of
+// consul. The leader holds the key <prefix>/_coordination/election/<name>
+// with the session of its candidate.
+func (c *ConsulRegistry) NewElection(name string) (Election, error) {
+	if name == "" {
+		return nil, ErrNilKey
+	}
+	e := &consulElection{
+		leaderState: newLeaderState(name),
+		c:           c,
+		key:         c.kvKey("election", name),
+		done:        make(chan struct{}),
+	}
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	go e.observe()
+	return e, nil
+}
+
+type consulElection struct {
+	*leaderState
+	c   *ConsulRegistry
+	key string
+
+	ctx    context.Context // canceled by Close
+	cancel context.CancelFunc
+	done   chan struct{} // closed when observe returns
+
+	mu      sync.Mutex
+	session string        // empty if the candidate has no session
+	renew   chan struct{} // closing it stops renewing the session
+	lock    *consul.Lock
+}
+
+func (e *consulElection) sessionID() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.session
+}
+
+// currentSession returns the session of the candidate, it is created on the
+// first campaign and again after it expired.
+func (e *consulElection) currentSession() (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.session != "" {
+		return e.session, nil
+	}
+	entry := &consul.SessionEntry{
+		Name:     "election " + e.name,
+		TTL:      SessionTTL.String(),
+		Behavior: consul.SessionBehaviorRelease,
+	}
+	opts := &consul.WriteOptions{Datacenter: e.c.opts.Datacenter}
+	id, _, err := e.c.client.Session().Create(entry, opts.WithContext(e.ctx))
+	if err != nil {
+		return "", err
+	}
+	renew := make(chan struct{})
+	e.session, e.renew = id, renew
+	go func() {
+		err := e.c.client.Session().RenewPeriodic(entry.TTL, id, &consul.WriteOptions{Datacenter: e.c.opts.Datacenter}, renew)
+		if err != nil {
+			log.Warnf("consul election %s lost its session: %v", e.name, err)
+		}
+		e.mu.Lock()
+		if e.session == id {
+			e.session, e.renew = "", nil
+		}
+		e.mu.Unlock()
+	}()
+	return id, nil
+}
+
+func (e *consulElection) Campaign(ctx context.Context, value string) error {
+	ctx, cancel := e.campaignContext(ctx)
+	defer cancel()
+	session, err := e.currentSession()
+	if err != nil {
+		return err
+	}
+	lock, err := e.c.dcClient().LockOpts(&consul.LockOptions{
+		Key:     e.key,
+		Value:   []byte(value),
+		Session: session,
+	})
+	if err != nil {
+		return err
+	}
+	stop, release := stopChan(ctx)
+	lost, err := lock.Lock(stop)
+	release()
+	if err != nil {
+		return err
+	}
+	if lost == nil {
+		return e.campaignErr(ctx.Err())
+	}
+	e.mu.Lock()
+	e.lock = lock
+	e.mu.Unlock()
+	return e.campaignErr(e.wait(ctx, true))
+}
+
+func (e *consulElection) Resign(ctx context.Context) error {
+	e.mu.Lock()
+	lock := e.lock
+	e.lock = nil
+	e.mu.Unlock()
+	if lock == nil {
+		return nil
+	}
+	if err := lock.Unlock(); err != nil && err != consul.ErrLockNotHeld {
+		return err
+	}
+	return e.wait(ctx, false)
+}
+
+func (e *consulElection) Leader(ctx context.Context) (string, error) {
+	opts := &consul.QueryOptions{Datacenter: e.c.opts.Datacenter}
+	pair, _, err := e.c.client.KV().Get(e.key, opts.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	if pair == nil || pair.Session == "" {
+		return "", ErrNoLeader
+	}
+	return string(pair.Value), nil
+}
+
+func (e *consulElection) Close() error {
+	if !e.close() {
+		return nil
+	}
+	e.cancel()
+	<-e.done
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.session == "" {
+		return nil
+	}
+	// Destroying the session releases the key if the candidate holds it.
+	close(e.renew)
+	_, err := e.c.client.Session().Destroy(e.session, &consul.WriteOptions{Datacenter: e.c.opts.Datacenter})
+	e.session, e.renew, e.lock = "", nil, nil
+	return err
+}
+
+// observe follows the election key with blocking queries.
+func (e *consulElection) observe() {
+	defer close(e.done)
+
+	var index uint64
+	for {
+		opts := &consul.QueryOptions{
+			Datacenter: e.c.opts.Datacenter,
+			WaitIndex:  index,
+			WaitTime:   DefaultWatchWaitTime,
+		}
+		pair, meta, err := e.c.client.KV().Get(e.key, opts.WithContext(e.ctx))
+		if err != nil {
+			if e.ctx.Err() != nil {
+				return
+			}
+			log.Warnf("consul election %s: %v", e.name, err)
+			if !retryWait(e.ctx) {
+				return
+			}
+			continue
+		}
+		if meta.LastIndex < index {
+			index = 0
+		} else {
+			index = meta.LastIndex
+		}
+		if pair == nil || pair.Session == "" {
+			e.update("", false)
+		} else {
+			e.update(string(pair.Value), pair.Session == e.sessionID())
+		}
+	}
+}
+
+// NewMutex implements Coordinator with a consul lock on the key
+// <prefix>/_coordination/mutex/<name>.
+func (c *ConsulRegistry) NewMutex(name string) (Mutex, error) {
+	if name == "" {
+		return nil, ErrNilKey
+	}
+	return &consulMutex{c: c, key: c.kvKey("mutex", name), local: newLocalLock()}, nil
+}
+
+type consulMutex struct {
+	c     *ConsulRegistry
+	key   string
+	local localLock // held from Lock to Unlock
+
+	mu   sync.Mutex // guards lock, not held while locking
+	lock *consul.Lock
+}
+
+func (l *consulMutex) Lock(ctx context.Context) error {
+	if err := l.local.lock(ctx); err != nil {
+		return err
+	}
+	lock, err := l.c.dcClient().LockOpts(&consul.LockOptions{
+		Key:        l.key,
+		SessionTTL: SessionTTL.String(),
+	})
+	if err == nil {
+		stop, release := stopChan(ctx)
+		var lost <-chan struct{}
+		lost, err = lock.Lock(stop)
+		release()
+		if err == nil && lost == nil {
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		l.local.unlock()
+		return err
+	}
+	l.mu.Lock()
+	l.lock = lock
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *consulMutex) Unlock(ctx context.Context) error {
+	l.mu.Lock()
+	lock := l.lock
+	l.lock = nil
+	l.mu.Unlock()
+	if lock == nil {
+		return ErrMutexNotLocked
+	}
+	err := lock.Unlock()
+	l.local.unlock()
+	return err
+}
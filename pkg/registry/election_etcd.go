@@ -0,0 +1,247 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	log "github.com/sirupsen/logrus"
+)
+
+// newSession creates a session whose lease is kept alive until it is closed.
+func (c *EtcdRegistry) newSession() (*concurrency.Session, error) {
+	return concurrency.NewSession(c.client, concurrency.WithTTL(int(leaseTTL(SessionTTL))))
+}
+
+// NewElection implements Coordinator with the election recipe of etcd. The
+// candidates are keys below /<prefix>/_coordination/election/<name> attached
+// to the lease of their session, the oldest key is the leader.
+func (c *EtcdRegistry) NewElection(name string) (Election, error) {
+	if name == "" {
+		return nil, ErrNilKey
+	}
+	e := &etcdElection{
+		leaderState: newLeaderState(name),
+		c:           c,
+		prefix:      coordinationKey(c.root, "election", name),
+		done:        make(chan struct{}),
+	}
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	go e.observe()
+	return e, nil
+}
+
+type etcdElection struct {
+	*leaderState
+	c      *EtcdRegistry
+	prefix string
+
+	ctx    context.Context // canceled by Close
+	cancel context.CancelFunc
+	done   chan struct{} // closed when observe returns
+
+	mu       sync.Mutex
+	session  *concurrency.Session
+	election *concurrency.Election
+}
+
+// candidateKey returns the key of the local candidate, it is empty if the
+// candidate has no session.
+func (e *etcdElection) candidateKey() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.session == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/%x", e.prefix, e.session.Lease())
+}
+
+// current returns the election of the live session, a new session is created
+// after the previous one expired.
+func (e *etcdElection) current() (*concurrency.Election, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.session != nil {
+		select {
+		case <-e.session.Done():
+			e.session.Close()
+			e.session, e.election = nil, nil
+		default:
+			return e.election, nil
+		}
+	}
+	session, err := e.c.newSession()
+	if err != nil {
+		return nil, err
+	}
+	e.session = session
+	e.election = concurrency.NewElection(session, e.prefix)
+	return e.election, nil
+}
+
+func (e *etcdElection) Campaign(ctx context.Context, value string) error {
+	ctx, cancel := e.campaignContext(ctx)
+	defer cancel()
+	election, err := e.current()
+	if err != nil {
+		return err
+	}
+	if err := election.Campaign(ctx, value); err != nil {
+		return e.campaignErr(err)
+	}
+	return e.campaignErr(e.wait(ctx, true))
+}
+
+func (e *etcdElection) Resign(ctx context.Context) error {
+	e.mu.Lock()
+	election := e.election
+	e.mu.Unlock()
+	if election == nil {
+		return nil
+	}
+	if err := election.Resign(ctx); err != nil {
+		return err
+	}
+	return e.wait(ctx, false)
+}
+
+func (e *etcdElection) Leader(ctx context.Context) (string, error) {
+	resp, err := e.c.client.Get(ctx, e.prefix+"/", clientv3.WithFirstCreate()...)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", ErrNoLeader
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+func (e *etcdElection) Close() error {
+	if !e.close() {
+		return nil
+	}
+	e.cancel()
+	<-e.done
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.session == nil {
+		return nil
+	}
+	// Closing the session revokes its lease and the candidate key with it.
+	err := e.session.Close()
+	e.session, e.election = nil, nil
+	return err
+}
+
+// observe follows the oldest candidate key. It reads the leader and waits for
+// the next change below the prefix.
+func (e *etcdElection) observe() {
+	defer close(e.done)
+	for {
+		rev, err := e.observeLeader()
+		if err == nil {
+			err = e.c.waitChange(e.ctx, e.prefix+"/", rev)
+		}
+		if e.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Warnf("etcd election %s: %v", e.name, err)
+			if !retryWait(e.ctx) {
+				return
+			}
+		}
+	}
+}
+
+func (e *etcdElection) observeLeader() (int64, error) {
+	ctx, cancel := context.WithTimeout(e.ctx, e.c.reqTimeout)
+	defer cancel()
+	resp, err := e.c.client.Get(ctx, e.prefix+"/", clientv3.WithFirstCreate()...)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		e.update("", false)
+	} else {
+		kv := resp.Kvs[0]
+		e.update(string(kv.Value), string(kv.Key) == e.candidateKey())
+	}
+	return resp.Header.Revision, nil
+}
+
+// NewMutex implements Coordinator with the lock recipe of etcd below
+// /<prefix>/_coordination/mutex/<name>. Every Lock runs in its own session.
+func (c *EtcdRegistry) NewMutex(name string) (Mutex, error) {
+	if name == "" {
+		return nil, ErrNilKey
+	}
+	return &etcdMutex{
+		c:      c,
+		prefix: coordinationKey(c.root, "mutex", name),
+		local:  newLocalLock(),
+	}, nil
+}
+
+type etcdMutex struct {
+	c      *EtcdRegistry
+	prefix string
+	local  localLock // held from Lock to Unlock
+
+	mu      sync.Mutex // guards session and mutex, not held while locking
+	session *concurrency.Session
+	mutex   *concurrency.Mutex
+}
+
+func (l *etcdMutex) Lock(ctx context.Context) error {
+	if err := l.local.lock(ctx); err != nil {
+		return err
+	}
+	session, err := l.c.newSession()
+	if err != nil {
+		l.local.unlock()
+		return err
+	}
+	mutex := concurrency.NewMutex(session, l.prefix)
+	if err := mutex.Lock(ctx); err != nil {
+		session.Close()
+		l.local.unlock()
+		return err
+	}
+	l.mu.Lock()
+	l.session, l.mutex = session, mutex
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *etcdMutex) Unlock(ctx context.Context) error {
+	l.mu.Lock()
+	session, mutex := l.session, l.mutex
+	l.session, l.mutex = nil, nil
+	l.mu.Unlock()
+	if session == nil {
+		return ErrMutexNotLocked
+	}
+	err := mutex.Unlock(ctx)
+	session.Close()
+	l.local.unlock()
+	return err
+}
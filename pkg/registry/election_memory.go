@@ -0,0 +1,198 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"context"
+	"sync"
+)
+
+// memoryLock is an election or a mutex of a MemoryRegistry.
+type memoryLock struct {
+	owner   interface{} // holder, nil if free
+	value   string
+	changed chan struct{} // closed when the holder or its value changes
+}
+
+// lockState returns the holder of the lock under key and a channel closed on
+// the next change.
+func (m *MemoryRegistry) lockState(key string) (interface{}, string, <-chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.memoryLock(key)
+	return l.owner, l.value, l.changed
+}
+
+// memoryLock returns the lock under key, m.mu must be held.
+func (m *MemoryRegistry) memoryLock(key string) *memoryLock {
+	l, ok := m.locks[key]
+	if !ok {
+		l = &memoryLock{changed: make(chan struct{})}
+		m.locks[key] = l
+	}
+	return l
+}
+
+// acquire blocks until owner holds the lock under key or ctx is done. An
+// owner acquiring the lock again replaces its value.
+func (m *MemoryRegistry) acquire(ctx context.Context, key string, owner interface{}, value string) error {
+	for {
+		m.mu.Lock()
+		l := m.memoryLock(key)
+		if l.owner == nil || l.owner == owner {
+			l.owner, l.value = owner, value
+			close(l.changed)
+			l.changed = make(chan struct{})
+			m.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		m.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release frees the lock under key if owner holds it.
+func (m *MemoryRegistry) release(key string, owner interface{}) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.locks[key]
+	if !ok || l.owner != owner {
+		return false
+	}
+	delete(m.locks, key)
+	close(l.changed)
+	return true
+}
+
+// NewElection implements Coordinator.
+func (m *MemoryRegistry) NewElection(name string) (Election, error) {
+	if name == "" {
+		return nil, ErrNilKey
+	}
+	e := &memoryElection{
+		leaderState: newLeaderState(name),
+		m:           m,
+		key:         "election/" + name,
+		done:        make(chan struct{}),
+	}
+	go e.observe()
+	return e, nil
+}
+
+type memoryElection struct {
+	*leaderState
+	m    *MemoryRegistry
+	key  string
+	done chan struct{} // closed when observe returns
+}
+
+func (e *memoryElection) observe() {
+	defer close(e.done)
+	for {
+		owner, value, changed := e.m.lockState(e.key)
+		e.update(value, owner == e)
+		select {
+		case <-changed:
+		case <-e.quit:
+			return
+		}
+	}
+}
+
+func (e *memoryElection) Campaign(ctx context.Context, value string) error {
+	ctx, cancel := e.campaignContext(ctx)
+	defer cancel()
+	if err := e.m.acquire(ctx, e.key, e, value); err != nil {
+		return e.campaignErr(err)
+	}
+	if e.closing() {
+		e.m.release(e.key, e)
+		return ErrElectionClosed
+	}
+	return e.campaignErr(e.wait(ctx, true))
+}
+
+func (e *memoryElection) Resign(ctx context.Context) error {
+	e.m.release(e.key, e)
+	return e.wait(ctx, false)
+}
+
+func (e *memoryElection) Leader(ctx context.Context) (string, error) {
+	owner, value, _ := e.m.lockState(e.key)
+	if owner == nil {
+		return "", ErrNoLeader
+	}
+	return value, nil
+}
+
+func (e *memoryElection) Close() error {
+	if !e.close() {
+		return nil
+	}
+	e.m.release(e.key, e)
+	<-e.done
+	return nil
+}
+
+// NewMutex implements Coordinator.
+func (m *MemoryRegistry) NewMutex(name string) (Mutex, error) {
+	if name == "" {
+		return nil, ErrNilKey
+	}
+	return &memoryMutex{m: m, key: "mutex/" + name, local: newLocalLock()}, nil
+}
+
+type memoryMutex struct {
+	m     *MemoryRegistry
+	key   string
+	local localLock // held from Lock to Unlock
+
+	mu     sync.Mutex // guards locked, not held while locking
+	locked bool
+}
+
+func (l *memoryMutex) Lock(ctx context.Context) error {
+	if err := l.local.lock(ctx); err != nil {
+		return err
+	}
+	if err := l.m.acquire(ctx, l.key, l, ""); err != nil {
+		l.local.unlock()
+		return err
+	}
+	l.mu.Lock()
+	l.locked = true
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *memoryMutex) Unlock(ctx context.Context) error {
+	l.mu.Lock()
+	locked := l.locked
+	l.locked = false
+	l.mu.Unlock()
+	if !locked {
+		return ErrMutexNotLocked
+	}
+	l.m.release(l.key, l)
+	l.local.unlock()
+	return nil
+}
@@ -0,0 +1,260 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitLeaderEvent skips events until want arrives.
+func waitLeaderEvent(t *testing.T, events <-chan LeaderEvent, want LeaderEvent) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for %+v", want)
+		}
+	}
+}
+
+// testElection runs two candidates of the same election on c.
+func testElection(t *testing.T, c Coordinator) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a, err := c.NewElection("scheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := c.NewElection("scheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	events := make(chan LeaderEvent, 16)
+	sub := a.SubscribeLeader(events)
+	defer sub.Unsubscribe()
+
+	if _, err := a.Leader(ctx); err != ErrNoLeader {
+		t.Fatalf("leader before the campaign: %v", err)
+	}
+	if err := a.Campaign(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatalf("a leader %v, b leader %v", a.IsLeader(), b.IsLeader())
+	}
+	waitLeaderEvent(t, events, LeaderEvent{Election: "scheduler", Leader: "a", IsLeader: true})
+	if leader, err := b.Leader(ctx); err != nil || leader != "a" {
+		t.Fatalf("leader %q %v", leader, err)
+	}
+
+	elected := make(chan error, 1)
+	go func() { elected <- b.Campaign(ctx, "b") }()
+	select {
+	case err := <-elected:
+		t.Fatalf("b elected while a leads: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := a.Resign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if a.IsLeader() {
+		t.Fatal("a still leader after resigning")
+	}
+	if err := <-elected; err != nil {
+		t.Fatal(err)
+	}
+	if !b.IsLeader() {
+		t.Fatal("b not leader")
+	}
+	waitLeaderEvent(t, events, LeaderEvent{Election: "scheduler", Leader: "b", IsLeader: false})
+
+	// Closing the leader ends its leadership.
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitLeaderEvent(t, events, LeaderEvent{Election: "scheduler"})
+	if _, err := a.Leader(ctx); err != ErrNoLeader {
+		t.Fatalf("leader after close: %v", err)
+	}
+	if err := b.Campaign(ctx, "b"); err != ErrElectionClosed {
+		t.Fatalf("campaign after close: %v", err)
+	}
+}
+
+// testMutex locks the same mutex from two holders on c.
+func testMutex(t *testing.T, c Coordinator) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a, err := c.NewMutex("migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.NewMutex("migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Local and remote callers wait for the holder until their ctx is done.
+	for _, m := range []Mutex{a, b} {
+		short, cancelShort := context.WithTimeout(ctx, 100*time.Millisecond)
+		err = m.Lock(short)
+		cancelShort()
+		if err == nil {
+			t.Fatal("locked a held mutex")
+		}
+	}
+	relocked := make(chan error, 1)
+	go func() { relocked <- a.Lock(ctx) }()
+	select {
+	case err := <-relocked:
+		t.Fatalf("a locked its held mutex again: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := a.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-relocked; err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan error, 1)
+	go func() { locked <- b.Lock(ctx) }()
+	select {
+	case err := <-locked:
+		t.Fatalf("b locked a held mutex: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := a.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Unlock(ctx); err != ErrMutexNotLocked {
+		t.Fatalf("second unlock: %v", err)
+	}
+}
+
+func TestMemoryElection(t *testing.T) {
+	testElection(t, NewMemoryRegistry())
+}
+
+func TestMemoryMutex(t *testing.T) {
+	testMutex(t, NewMemoryRegistry())
+}
+
+func TestElectionCloseStopsCampaign(t *testing.T) {
+	r := NewMemoryRegistry()
+	a, _ := r.NewElection("scheduler")
+	defer a.Close()
+	b, _ := r.NewElection("scheduler")
+
+	if err := a.Campaign(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	elected := make(chan error, 1)
+	go func() { elected <- b.Campaign(context.Background(), "b") }()
+	time.Sleep(50 * time.Millisecond)
+	b.Close()
+	select {
+	case err := <-elected:
+		if err != ErrElectionClosed {
+			t.Fatalf("campaign returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("campaign not stopped by close")
+	}
+	if leader, err := a.Leader(context.Background()); err != nil || leader != "a" {
+		t.Fatalf("leader %q %v", leader, err)
+	}
+}
+
+func TestConsulDatacenter(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		dcs = make(map[string][]string) // path -> datacenters
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		dcs[r.URL.Path] = append(dcs[r.URL.Path], r.URL.Query().Get("dc"))
+		mu.Unlock()
+		if r.URL.Path == "/v1/session/create" {
+			fmt.Fprint(w, `{"ID":"session"}`)
+			return
+		}
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	r, err := NewConsulRegistryWithOptions(srv.Listener.Addr().String(), 0, Options{Datacenter: "eu-west"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := r.NewMutex("migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := r.NewElection("leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// A failed lock attempt doesn't keep local callers waiting.
+	for i := 0; i < 2; i++ {
+		if err := m.Lock(ctx); err == nil {
+			t.Fatal("locked without consul")
+		}
+	}
+	if err := e.Campaign(ctx, "a"); err == nil {
+		t.Fatal("elected without consul")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, path := range []string{"/v1/session/create", "/v1/kv/" + r.kvKey("election", "leader"), "/v1/kv/" + r.kvKey("mutex", "migration")} {
+		if len(dcs[path]) == 0 {
+			t.Fatalf("no requests to %s: %v", path, dcs)
+		}
+	}
+	for path, list := range dcs {
+		for _, dc := range list {
+			if dc != "eu-west" {
+				t.Fatalf("request to %s went to datacenter %q", path, dc)
+			}
+		}
+	}
+}
@@ -16,7 +16,10 @@
 package registry
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -35,13 +38,114 @@ type Service struct {
 }
 
 type Node struct {
-	Id   string   `json:"id"`
-	Host string   `json:"host"`
-	Port int      `json:"port"`
-	Tags []string `json:"tags"`
+	Id        string            `json:"id"`
+	Host      string            `json:"host"`
+	Port      int               `json:"port"`
+	Tags      []string          `json:"tags"`
+	Weight    int               `json:"weight,omitempty"`
+	Zone      string            `json:"zone,omitempty"`
+	Endpoints []Endpoint        `json:"endpoints,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
 }
 
+// Protocols of node endpoints.
+const (
+	ProtocolHTTP = "http"
+	ProtocolWS   = "ws"
+	ProtocolIPC  = "ipc"
+)
+
+// Endpoint is an address a node serves a protocol on, e.g. a websocket url or
+// an ipc path.
+type Endpoint struct {
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+}
+
+// MetaPriority is the node metadata holding the priority of a node. Calls go
+// to the nodes with the lowest priority, the others are backups.
+const MetaPriority = "priority"
+
+// Priority returns the priority of the node, 0 if it has none.
+func (n *Node) Priority() int {
+	p, _ := strconv.Atoi(n.Metadata[MetaPriority])
+	return p
+}
+
+// Endpoint returns the address of the first endpoint with the given protocol.
+func (n *Node) Endpoint(protocol string) (string, bool) {
+	for _, ep := range n.Endpoints {
+		if ep.Protocol == protocol {
+			return ep.Address, true
+		}
+	}
+	return "", false
+}
+
+// nodeRecord is the stored form of a registered node, it is kept as JSON in
+// etcd and zookeeper.
+type nodeRecord struct {
+	Id        string            `json:"id"`
+	Host      string            `json:"host"`
+	Port      int               `json:"port"`
+	Version   string            `json:"version"`
+	Tags      []string          `json:"tags"`
+	Weight    int               `json:"weight,omitempty"`
+	Zone      string            `json:"zone,omitempty"`
+	Endpoints []Endpoint        `json:"endpoints,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// newNodeRecord returns the record of the first node of s.
+func newNodeRecord(s *Service) *nodeRecord {
+	node := s.Nodes[0]
+	return &nodeRecord{
+		Id:        node.Id,
+		Host:      node.Host,
+		Port:      node.Port,
+		Version:   s.Version,
+		Tags:      s.GetTags(),
+		Weight:    node.Weight,
+		Zone:      node.Zone,
+		Endpoints: node.Endpoints,
+		Metadata:  node.Metadata,
+	}
+}
+
+func (r *nodeRecord) node() *Node {
+	return &Node{
+		Id:        r.Id,
+		Host:      r.Host,
+		Port:      r.Port,
+		Tags:      r.Tags,
+		Weight:    r.Weight,
+		Zone:      r.Zone,
+		Endpoints: r.Endpoints,
+		Metadata:  r.Metadata,
+	}
+}
+
+// NewService creates a service with a single node at address and port, which
+// default to 127.0.0.1 and 8500. The node id is a path below
+// DefaultPrefixService.
 func NewService(name, version, address string, port int) *Service {
+	return NewServiceWithOptions(name, version, address, port, Options{})
+}
+
+// NewServiceFor is like NewService, but the node id is a path below the
+// prefix and namespace r was created with, so the nodes of registries sharing
+// a backend don't collide.
+func NewServiceFor(r Registry, name, version, address string, port int) *Service {
+	var opts Options
+	if o, ok := r.(interface{ Options() Options }); ok {
+		opts = o.Options()
+	}
+	return NewServiceWithOptions(name, version, address, port, opts)
+}
+
+// NewServiceWithOptions is like NewService, but the node id is a path below
+// the prefix and namespace of opts.
+func NewServiceWithOptions(name, version, address string, port int, opts Options) *Service {
 	hostIP := address
 	if address == "" {
 		hostIP = "127.0.0.1"
@@ -51,7 +155,7 @@ func NewService(name, version, address string, port int) *Service {
 		hostPort = 8500
 	}
 	node := &Node{
-		Id:   fmt.Sprintf("/%s/%s%s/%s/%d", DefaultPrefixService, name, version, hostIP, hostPort),
+		Id:   fmt.Sprintf("%s/%s%s/%s/%d", opts.root(), name, version, hostIP, hostPort),
 		Host: hostIP,
 		Port: hostPort,
 	}
@@ -63,6 +167,9 @@ func NewService(name, version, address string, port int) *Service {
 	return s
 }
 
+// GetTags returns the tags a node of s is registered with: the generated
+// service, version and host tags followed by the tags of s and of its first
+// node, without duplicates.
 func (s *Service) GetTags() []string {
 	if s == nil {
 		return nil
@@ -74,6 +181,20 @@ func (s *Service) GetTags() []string {
 	if s.Nodes != nil && s.Nodes[0].Host != "" {
 		tags = append(tags, "h-"+s.Nodes[0].Host)
 	}
+	tags = appendTags(tags, s.Tags)
+	if len(s.Nodes) > 0 {
+		tags = appendTags(tags, s.Nodes[0].Tags)
+	}
+	return tags
+}
+
+// appendTags appends the tags missing from tags.
+func appendTags(tags []string, more []string) []string {
+	for _, tag := range more {
+		if !hasTag(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
 	return tags
 }
 
@@ -110,3 +231,96 @@ func tagsCheck(tags []string, input string) string {
 	}
 	return ""
 }
+
+// Keys of the consul service meta. Node metadata is stored under its key
+// with the metaPrefix.
+const (
+	metaVersion   = "version"
+	metaWeight    = "weight"
+	metaZone      = "zone"
+	metaEndpoints = "endpoints"
+	metaPrefix    = "x-"
+)
+
+// Limits consul puts on service meta.
+const (
+	consulMaxMetaPairs    = 64
+	consulMaxMetaKeyLen   = 128
+	consulMaxMetaValueLen = 512
+	consulReservedMeta    = "consul-"
+)
+
+// ErrInvalidMeta is returned when the fields of a node don't fit in consul
+// service meta.
+var ErrInvalidMeta = errors.New("invalid service meta")
+
+// serviceMeta returns the consul service meta of the first node of s. It
+// fails if the meta exceeds the limits of consul.
+func serviceMeta(s *Service) (map[string]string, error) {
+	node := s.Nodes[0]
+	meta := map[string]string{metaVersion: s.Version}
+	if node.Weight != 0 {
+		meta[metaWeight] = strconv.Itoa(node.Weight)
+	}
+	if node.Zone != "" {
+		meta[metaZone] = node.Zone
+	}
+	if len(node.Endpoints) > 0 {
+		enc, _ := json.Marshal(node.Endpoints)
+		meta[metaEndpoints] = string(enc)
+	}
+	for k, v := range node.Metadata {
+		meta[metaPrefix+k] = v
+	}
+	if err := validateMeta(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// validateMeta checks meta against the limits of consul: at most 64 pairs,
+// keys of up to 128 letters, digits, '_' or '-' and values of up to 512
+// characters.
+func validateMeta(meta map[string]string) error {
+	if len(meta) > consulMaxMetaPairs {
+		return fmt.Errorf("%w: %d pairs, at most %d allowed", ErrInvalidMeta, len(meta), consulMaxMetaPairs)
+	}
+	for k, v := range meta {
+		if k == "" || len(k) > consulMaxMetaKeyLen || strings.HasPrefix(k, consulReservedMeta) {
+			return fmt.Errorf("%w: bad key %q", ErrInvalidMeta, k)
+		}
+		for _, c := range k {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+				return fmt.Errorf("%w: bad key %q", ErrInvalidMeta, k)
+			}
+		}
+		if len(v) > consulMaxMetaValueLen {
+			return fmt.Errorf("%w: value of %q longer than %d characters", ErrInvalidMeta, k, consulMaxMetaValueLen)
+		}
+	}
+	return nil
+}
+
+// applyServiceMeta sets the node fields stored in a consul service meta and
+// returns the version. Services registered without meta carry the version in
+// their tags.
+func applyServiceMeta(node *Node, meta map[string]string, tags []string) string {
+	version, ok := meta[metaVersion]
+	if !ok {
+		version = tagsVersion(tags)
+	}
+	node.Weight, _ = strconv.Atoi(meta[metaWeight])
+	node.Zone = meta[metaZone]
+	if enc, ok := meta[metaEndpoints]; ok {
+		json.Unmarshal([]byte(enc), &node.Endpoints)
+	}
+	for k, v := range meta {
+		if strings.HasPrefix(k, metaPrefix) {
+			if node.Metadata == nil {
+				node.Metadata = make(map[string]string)
+			}
+			node.Metadata[strings.TrimPrefix(k, metaPrefix)] = v
+		}
+	}
+	return version
+}
@@ -0,0 +1,144 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newMetaService() *Service {
+	s := NewService("task", "1.0.0", "10.0.0.1", 8080)
+	node := s.Nodes[0]
+	node.Weight = 10
+	node.Zone = "zone-a"
+	node.Endpoints = []Endpoint{
+		{Protocol: ProtocolHTTP, Address: "http://10.0.0.1:8080"},
+		{Protocol: ProtocolWS, Address: "ws://10.0.0.1:8081"},
+	}
+	node.Metadata = map[string]string{"region": "east", "build": "42"}
+	return s
+}
+
+func TestNodeEndpoint(t *testing.T) {
+	node := newMetaService().Nodes[0]
+	if addr, ok := node.Endpoint(ProtocolWS); !ok || addr != "ws://10.0.0.1:8081" {
+		t.Fatalf("ws endpoint: %q %v", addr, ok)
+	}
+	if _, ok := node.Endpoint(ProtocolIPC); ok {
+		t.Fatal("found missing ipc endpoint")
+	}
+}
+
+func TestServiceMeta(t *testing.T) {
+	s := newMetaService()
+	want := s.Nodes[0]
+
+	meta, err := serviceMeta(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &Node{Id: want.Id, Host: want.Host, Port: want.Port}
+	version := applyServiceMeta(node, meta, s.GetTags())
+	if version != "1.0.0" {
+		t.Fatalf("got version %q", version)
+	}
+	if !reflect.DeepEqual(node, want) {
+		t.Fatalf("meta round trip:\ngot  %#v\nwant %#v", node, want)
+	}
+
+	// services registered without meta carry the version in their tags
+	node = &Node{}
+	if version := applyServiceMeta(node, nil, []string{"a-service", "v-2.0.0"}); version != "2.0.0" {
+		t.Fatalf("got legacy version %q", version)
+	}
+	if node.Weight != 0 || node.Zone != "" || node.Endpoints != nil || node.Metadata != nil {
+		t.Fatalf("legacy node has metadata: %#v", node)
+	}
+}
+
+func TestServiceMetaLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+	}{
+		{"bad key", map[string]string{"a.b": "v"}},
+		{"long key", map[string]string{strings.Repeat("k", 127): "v"}},
+		{"long value", map[string]string{"k": strings.Repeat("v", 513)}},
+	}
+	many := make(map[string]string)
+	for i := 0; i < 64; i++ {
+		many[fmt.Sprint("k", i)] = "v"
+	}
+	tests = append(tests, struct {
+		name     string
+		metadata map[string]string
+	}{"too many pairs", many})
+
+	for _, tt := range tests {
+		s := newMetaService()
+		s.Nodes[0].Metadata = tt.metadata
+		if _, err := serviceMeta(s); !errors.Is(err, ErrInvalidMeta) {
+			t.Errorf("%s: expected %v, got %v", tt.name, ErrInvalidMeta, err)
+		}
+	}
+	s := newMetaService()
+	s.Nodes[0].Metadata = map[string]string{"build_id": strings.Repeat("v", 512)}
+	if _, err := serviceMeta(s); err != nil {
+		t.Fatalf("valid meta rejected: %v", err)
+	}
+}
+
+func TestServiceTags(t *testing.T) {
+	s := NewService("task", "1.0.0", "10.0.0.1", 8080)
+	s.Tags = []string{"blue", "canary"}
+	s.Nodes[0].Tags = []string{"canary", "ssd"}
+
+	want := []string{"a-" + DefaultTagService, "v-1.0.0", "h-10.0.0.1", "blue", "canary", "ssd"}
+	if tags := s.GetTags(); !reflect.DeepEqual(tags, want) {
+		t.Fatalf("got tags %v, want %v", tags, want)
+	}
+	if tags := newNodeRecord(s).node().Tags; !reflect.DeepEqual(tags, want) {
+		t.Fatalf("stored tags %v, want %v", tags, want)
+	}
+}
+
+func TestServiceIdPrefix(t *testing.T) {
+	if id := NewService("task", "1.0.0", "10.0.0.1", 8080).GetId(); id != "/airman/task1.0.0/10.0.0.1/8080" {
+		t.Fatalf("default id %s", id)
+	}
+	opts := Options{Prefix: "/svc/", Namespace: "dev"}
+	if id := NewServiceWithOptions("task", "1.0.0", "10.0.0.1", 8080, opts).GetId(); id != "/svc/dev/task1.0.0/10.0.0.1/8080" {
+		t.Fatalf("prefixed id %s", id)
+	}
+
+	r, err := New("consul://127.0.0.1:8501?prefix=svc&namespace=staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if id := NewServiceFor(r, "task", "1.0.0", "10.0.0.1", 8080).GetId(); id != "/svc/staging/task1.0.0/10.0.0.1/8080" {
+		t.Fatalf("registry id %s", id)
+	}
+	mem := NewMemoryRegistry()
+	defer mem.Close()
+	if id := NewServiceFor(mem, "task", "1.0.0", "10.0.0.1", 8080).GetId(); id != "/airman/task1.0.0/10.0.0.1/8080" {
+		t.Fatalf("memory registry id %s", id)
+	}
+}
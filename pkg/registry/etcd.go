@@ -17,15 +17,21 @@ package registry
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
 	log "github.com/sirupsen/logrus"
+
+	"airman.com/airfk/pkg/event"
 )
 
 var (
@@ -33,67 +39,106 @@ var (
 	ErrNilValue = errors.New("value is null")
 )
 
+// LeaseRetryInterval is the delay between attempts to register a node again
+// after its lease was lost.
+var LeaseRetryInterval = time.Second
+
 // etcd clientv3
 //
 type EtcdRegistry struct {
 	dailTimeOut time.Duration
 	reqTimeout  time.Duration
 	endPoints   []string
+	root        string // nodes are stored below root
+	opts        Options
 	client      *clientv3.Client
+
+	mu     sync.Mutex
+	leases map[string]*etcdLease // node key -> lease of RegisterWithTTL
 }
 
 func NewEtcdRegistry(tmDail, tmReq time.Duration, endPoints []string) *EtcdRegistry {
+	r, err := newEtcdRegistry(tmDail, tmReq, endPoints)
+	if err != nil {
+		log.Fatal(err)
+		return nil
+	}
+	return r
+}
+
+// NewEtcdRegistryWithOptions creates an etcd registry storing its nodes below
+// the prefix and namespace of opts.
+func NewEtcdRegistryWithOptions(tmDail, tmReq time.Duration, endPoints []string, opts Options) (*EtcdRegistry, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	c, err := newEtcdRegistry(tmDail, tmReq, endPoints)
+	if err != nil {
+		return nil, err
+	}
+	c.root = opts.root()
+	c.opts = opts
+	return c, nil
+}
+
+// Options returns the options the registry was created with.
+func (c *EtcdRegistry) Options() Options {
+	return c.opts
+}
+
+func newEtcdRegistry(tmDail, tmReq time.Duration, endPoints []string) (*EtcdRegistry, error) {
 	cli, err := clientv3.New(clientv3.Config{
 		Endpoints:   endPoints,
 		DialTimeout: tmDail,
 	})
-
 	if err != nil {
-		log.Fatal(err)
-		return nil
+		return nil, err
 	}
 
 	return &EtcdRegistry{
 		dailTimeOut: tmDail,
 		reqTimeout:  tmReq,
 		endPoints:   endPoints,
+		root:        Options{}.root(),
 		client:      cli,
-	}
+		leases:      make(map[string]*etcdLease),
+	}, nil
 }
 
+// RegisterWithTTL registers the first node of s under a lease with the given
+// TTL. The lease is kept alive in the background until the node is
+// deregistered or the registry is closed. If the lease is lost, e.g. because
+// etcd was unreachable for longer than the TTL, the node is registered again
+// under a new lease. Calling RegisterWithTTL again for a registered node
+// updates its value and keeps the lease, unless the TTL changed.
 func (c *EtcdRegistry) RegisterWithTTL(s *Service, timeTTL time.Duration) error {
 	if len(s.Nodes) == 0 {
 		return errors.New("require at least one node")
 	}
+	key := c.key(s)
+	ttl := leaseTTL(timeTTL)
 
-	// use first node
-	node := s.Nodes[0]
-	val := strings.Join(s.GetTags(), ",")
-	ctx, cancel := context.WithTimeout(context.Background(), c.reqTimeout)
-	defer cancel()
-
-	// ttl-second
-	resp, _ := c.client.Grant(ctx, timeTTL.Nanoseconds())
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	// get and put
-	_, err := c.client.Get(ctx, node.Id)
-	if err != nil {
-		if err == rpctypes.ErrKeyNotFound {
-			if _, err := c.client.Put(ctx, node.Id, val, clientv3.WithLease(resp.ID)); err != nil {
-				log.Errorf("set service %s etcd3 failed: %v", node.Id, err)
-				return err
-			}
-		} else {
-			log.Infof("get failed: Id:%s, error: %v", node.Id, err)
-			return err
-		}
-	} else {
-		// refresh
-		if _, err := c.client.Put(ctx, node.Id, val, clientv3.WithLease(resp.ID)); err != nil {
-			log.Errorf("refresh service %s failed: %v", node.Id, err)
-			return err
+	if l, ok := c.leases[key]; ok {
+		if l.ttl == ttl {
+			// refresh
+			l.mu.Lock()
+			l.service = s
+			l.mu.Unlock()
+			return c.putWithLease(s, l.leaseID())
 		}
+		c.stopLease(l)
+	}
+	l := &etcdLease{service: s, ttl: ttl, done: make(chan struct{})}
+	if err := c.grantAndPut(l); err != nil {
+		return err
 	}
+	var ctx context.Context
+	ctx, l.cancel = context.WithCancel(context.Background())
+	c.leases[key] = l
+	go c.keepAlive(ctx, l)
 	return nil
 }
 
@@ -102,13 +147,14 @@ func (c *EtcdRegistry) Register(s *Service) error {
 		return errors.New("require at least one node")
 	}
 
-	// use first node
-	node := s.Nodes[0]
-	val := strings.Join(s.GetTags(), ",")
+	val, err := etcdValue(s)
+	if err != nil {
+		return err
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), c.reqTimeout)
 	defer cancel()
 
-	if _, err := c.client.Put(ctx, node.Id, val); err != nil {
+	if _, err := c.client.Put(ctx, c.key(s), val); err != nil {
 		log.Errorf("etcd put error:%v", err)
 		return err
 	}
@@ -119,11 +165,19 @@ func (c *EtcdRegistry) Deregister(s *Service) error {
 	if len(s.Nodes) == 0 {
 		return errors.New("require at least one node")
 	}
-	node := s.Nodes[0]
+	key := c.key(s)
+
+	c.mu.Lock()
+	if l, ok := c.leases[key]; ok {
+		delete(c.leases, key)
+		c.stopLease(l)
+	}
+	c.mu.Unlock()
+
 	ctx, cancel := context.WithTimeout(context.Background(), c.reqTimeout)
 	defer cancel()
 
-	if _, err := c.client.Delete(ctx, node.Id); err != nil {
+	if _, err := c.client.Delete(ctx, key); err != nil {
 		log.Errorf("etcd Delete error:%v", err)
 		return err
 	}
@@ -138,35 +192,107 @@ func (c *EtcdRegistry) GetService(name, tag string) ([]*Service, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), c.reqTimeout)
 	defer cancel()
 
-	key := fmt.Sprintf("/%s/%s", DefaultPrefixService, name)
-	resp, err := c.client.Get(ctx, key, clientv3.WithPrefix())
+	resp, err := c.client.Get(ctx, c.prefix(name), clientv3.WithPrefix())
 	if err != nil || resp == nil {
 		log.Errorf("etcd GetWithPrefix error:%v", err)
 		return nil, err
 	}
 
-	serviceMap := map[string]*Service{}
-	//resList := make([]*Service, len(resp.Kvs))
-	for i, ev := range resp.Kvs {
-		log.Infof("ev %d: %#v \n", i, ev)
+	return servicesFromKvs(c.root, name, tag, resp.Kvs), nil
+}
 
-		tags := strings.Split(string(ev.Value), ",")
-		keys := strings.Split(string(ev.Key), "/")
+// key returns the key of the first node of s, <root>/<name>/<host>/<port>.
+// A node is keyed by its address, so registering another version of the
+// service at the same host and port replaces the node.
+func (c *EtcdRegistry) key(s *Service) string {
+	node := s.Nodes[0]
+	return fmt.Sprintf("%s/%s/%s/%d", c.root, s.Name, node.Host, node.Port)
+}
 
-		fmt.Println("keys :", keys)
-		fmt.Println("tags :", tags)
-		if len(keys) < 4 || keys[2] != name {
-			continue
-		}
+// prefix returns the prefix of the keys of the service name. It also covers
+// the keys <root>/<name><version>/<host>/<port> written by older versions.
+func (c *EtcdRegistry) prefix(name string) string {
+	return c.root + "/" + name
+}
+
+// etcdValue returns the value stored for the first node of s.
+func etcdValue(s *Service) (string, error) {
+	enc, err := json.Marshal(newNodeRecord(s))
+	if err != nil {
+		return "", err
+	}
+	return string(enc), nil
+}
 
-		version := tagsVersion(tags)
-		address := keys[3]
+// etcdKeyParts splits a node key below root into name, host and port. Keys
+// of other namespaces below root have more parts and are rejected.
+func etcdKeyParts(root string, key []byte) ([]string, bool) {
+	rest := strings.TrimPrefix(string(key), root+"/")
+	if len(rest) == len(key) {
+		return nil, false
+	}
+	parts := strings.Split(rest, "/")
+	// Names starting with an underscore hold coordination and configuration
+	// keys.
+	return parts, len(parts) == 3 && !strings.HasPrefix(parts[0], "_")
+}
+
+// etcdNode parses the node stored in kv, which is registered under the key
+// <root>/<name>/<host>/<port>, or <root>/<name><version>/<host>/<port> by
+// older versions. The value is a JSON node record, or the comma-joined tags
+// written by older versions. The node keeps the id it was registered with;
+// only nodes stored without an id are identified by their key.
+func etcdNode(root, name string, kv *mvccpb.KeyValue) (string, *Node, bool) {
+	keys, ok := etcdKeyParts(root, kv.Key)
+	if !ok || !strings.HasPrefix(keys[0], name) {
+		return "", nil, false
+	}
+	var (
+		version string
+		node    *Node
+	)
+	if len(kv.Value) > 0 && kv.Value[0] == '{' {
+		var record nodeRecord
+		if err := json.Unmarshal(kv.Value, &record); err == nil {
+			version, node = record.Version, record.node()
+		}
+	}
+	if node == nil {
+		tags := strings.Split(string(kv.Value), ",")
+		address := keys[1]
 		// use node address
 		if len(address) == 0 {
 			address = tagsHost(tags)
 		}
+		port, _ := strconv.Atoi(keys[2])
+		version, node = tagsVersion(tags), &Node{
+			Host: address,
+			Port: port,
+			Tags: tags,
+		}
+	}
+	if keys[0] != name && (version == "" || keys[0] != name+version) {
+		return "", nil, false
+	}
+	if node.Id == "" {
+		node.Id = string(kv.Key)
+	}
+	return version, node, true
+}
 
-		key := tagsCheck(tags, tag)
+// servicesFromKvs groups the nodes stored in kvs by version.
+func servicesFromKvs(root, name, tag string, kvs []*mvccpb.KeyValue) []*Service {
+	serviceMap := map[string]*Service{}
+	seen := make(map[string]bool)
+	for _, kv := range kvs {
+		version, node, ok := etcdNode(root, name, kv)
+		// A node may be stored under both layouts while it is upgraded.
+		if !ok || seen[node.Id] {
+			continue
+		}
+		seen[node.Id] = true
+
+		key := tagsCheck(node.Tags, tag)
 		if tag == "" {
 			key = version
 		}
@@ -175,24 +301,102 @@ func (c *EtcdRegistry) GetService(name, tag string) ([]*Service, error) {
 			svc = &Service{
 				Name:    name,
 				Version: version,
-				Tags:    tags,
+				Tags:    node.Tags,
 			}
 			serviceMap[key] = svc
 		}
-
-		port, _ := strconv.Atoi(keys[4])
-		svc.Nodes = append(svc.Nodes, &Node{
-			Id:   string(ev.Key),
-			Host: address,
-			Port: port,
-		})
+		svc.Nodes = append(svc.Nodes, node)
 	}
 
 	var services []*Service
 	for _, service := range serviceMap {
 		services = append(services, service)
 	}
-	return services, nil
+	return services
+}
+
+// Watch implements Watcher with an etcd watch on the key prefix of the
+// service. After a failure the prefix is read again to catch up on missed
+// changes before watching continues.
+func (c *EtcdRegistry) Watch(name string, ch chan<- *Event) (event.Subscription, error) {
+	if name == "" {
+		return nil, ErrNilKey
+	}
+	w := newWatch(name, ch)
+	go c.watchLoop(w)
+	return w, nil
+}
+
+func (c *EtcdRegistry) watchLoop(w *watch) {
+	defer w.exit()
+
+	prefix := c.prefix(w.name)
+	for {
+		ctx, cancel := context.WithTimeout(w.ctx, c.reqTimeout)
+		resp, err := c.client.Get(ctx, prefix, clientv3.WithPrefix())
+		cancel()
+		if err == nil {
+			if !w.sync(servicesFromKvs(c.root, w.name, "", resp.Kvs)) {
+				return
+			}
+			err = c.watchChanges(w, prefix, resp.Header.Revision+1)
+		}
+		if w.ctx.Err() != nil {
+			return
+		}
+		log.Warnf("etcd watch %s failed: %v", w.name, err)
+		if !w.wait() {
+			return
+		}
+	}
+}
+
+// watchChanges delivers the changes below prefix starting at revision rev
+// until the watch fails.
+func (c *EtcdRegistry) watchChanges(w *watch, prefix string, rev int64) error {
+	ctx := clientv3.WithRequireLeader(w.ctx)
+	opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithRev(rev), clientv3.WithPrevKV()}
+	for wresp := range c.client.Watch(ctx, prefix, opts...) {
+		if err := wresp.Err(); err != nil {
+			return err
+		}
+		for _, ev := range wresp.Events {
+			ok := true
+			switch ev.Type {
+			case mvccpb.PUT:
+				if version, node, valid := etcdNode(c.root, w.name, ev.Kv); valid {
+					ok = w.put(version, node)
+				}
+			case mvccpb.DELETE:
+				// The previous value holds the id of the removed node.
+				if ev.PrevKv == nil {
+					ok = w.remove(string(ev.Kv.Key))
+				} else if _, node, valid := etcdNode(c.root, w.name, ev.PrevKv); valid {
+					ok = w.remove(node.Id)
+				}
+			}
+			if !ok {
+				return nil
+			}
+		}
+	}
+	return errors.New("watch channel closed")
+}
+
+// waitChange returns after the first change below prefix since revision rev.
+func (c *EtcdRegistry) waitChange(ctx context.Context, prefix string, rev int64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wch := c.client.Watch(clientv3.WithRequireLeader(ctx), prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+	for resp := range wch {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		if len(resp.Events) > 0 {
+			return nil
+		}
+	}
+	return ctx.Err()
 }
 
 func (c *EtcdRegistry) ListServices() ([]*Service, error) {
@@ -200,27 +404,154 @@ func (c *EtcdRegistry) ListServices() ([]*Service, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), c.reqTimeout)
 	defer cancel()
 
-	key := fmt.Sprintf("/%s", DefaultPrefixService)
-	resp, err := c.client.Get(ctx, key, clientv3.WithPrefix())
+	resp, err := c.client.Get(ctx, c.root+"/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
 	if err != nil || resp == nil {
 		log.Errorf("etcd GetWithPrefix error:%v", err)
 		return nil, err
 	}
 
-	services := make([]*Service, 0, len(resp.Kvs))
+	var names []string
+	seen := make(map[string]bool)
 	for _, ev := range resp.Kvs {
-		keys := strings.Split(string(ev.Key), "/")
-		fmt.Println("keysdsddd: ", keys)
-		if len(keys) > 3 {
-			services = append(services, &Service{Name: keys[2]})
+		if keys, ok := etcdKeyParts(c.root, ev.Key); ok && !seen[keys[0]] {
+			seen[keys[0]] = true
+			names = append(names, keys[0])
 		}
 	}
+	sort.Strings(names)
+	services := make([]*Service, 0, len(names))
+	for _, name := range names {
+		services = append(services, &Service{Name: name})
+	}
 	return services, nil
 }
 
 func (c *EtcdRegistry) Close() error {
 	if c != nil {
+		c.mu.Lock()
+		for id, l := range c.leases {
+			delete(c.leases, id)
+			c.stopLease(l)
+		}
+		c.mu.Unlock()
 		c.client.Close()
 	}
 	return nil
 }
+
+// etcdLease is a node registered with RegisterWithTTL.
+type etcdLease struct {
+	ttl    int64 // seconds
+	cancel context.CancelFunc
+	done   chan struct{} // closed when keepAlive returns
+
+	mu      sync.Mutex
+	service *Service
+	id      clientv3.LeaseID
+}
+
+func (l *etcdLease) leaseID() clientv3.LeaseID {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.id
+}
+
+func (l *etcdLease) getService() *Service {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.service
+}
+
+// leaseTTL converts a TTL to whole seconds, rounding up.
+func leaseTTL(d time.Duration) int64 {
+	ttl := int64((d + time.Second - 1) / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+	return ttl
+}
+
+func (c *EtcdRegistry) putWithLease(s *Service, id clientv3.LeaseID) error {
+	key := c.key(s)
+	val, err := etcdValue(s)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.reqTimeout)
+	defer cancel()
+
+	if _, err := c.client.Put(ctx, key, val, clientv3.WithLease(id)); err != nil {
+		log.Errorf("set service %s etcd3 failed: %v", key, err)
+		return err
+	}
+	return nil
+}
+
+// grantAndPut grants a new lease for l and stores its node under it.
+func (c *EtcdRegistry) grantAndPut(l *etcdLease) error {
+	s := l.getService()
+	ctx, cancel := context.WithTimeout(context.Background(), c.reqTimeout)
+	resp, err := c.client.Grant(ctx, l.ttl)
+	cancel()
+	if err != nil {
+		log.Errorf("grant lease for %s failed: %v", s.GetId(), err)
+		return err
+	}
+	if err := c.putWithLease(s, resp.ID); err != nil {
+		c.revoke(resp.ID)
+		return err
+	}
+	l.mu.Lock()
+	l.id = resp.ID
+	l.mu.Unlock()
+	return nil
+}
+
+func (c *EtcdRegistry) revoke(id clientv3.LeaseID) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.reqTimeout)
+	defer cancel()
+	if _, err := c.client.Revoke(ctx, id); err != nil && err != rpctypes.ErrLeaseNotFound {
+		log.Warnf("revoke lease %x failed: %v", id, err)
+	}
+}
+
+// stopLease ends the keepalive of l and revokes its lease, which deletes the
+// node.
+// note: callers must hold c.mu
+func (c *EtcdRegistry) stopLease(l *etcdLease) {
+	l.cancel()
+	<-l.done
+	c.revoke(l.leaseID())
+}
+
+// keepAlive renews the lease of l until ctx is canceled. If the lease is
+// lost, the node is registered again under a new lease.
+func (c *EtcdRegistry) keepAlive(ctx context.Context, l *etcdLease) {
+	defer close(l.done)
+
+	for {
+		ch, err := c.client.KeepAlive(ctx, l.leaseID())
+		if err == nil {
+			// The channel is closed when the lease can't be renewed anymore.
+			for range ch {
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warnf("lease of %s lost, registering again", l.getService().GetId())
+
+		for {
+			timer := time.NewTimer(LeaseRetryInterval)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+			if err := c.grantAndPut(l); err == nil {
+				break
+			}
+		}
+	}
+}
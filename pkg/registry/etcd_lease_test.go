@@ -0,0 +1,291 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+// The embedded etcd server uses a bbolt version that fails the pointer checks
+// of the race detector.
+
+//go:build !race
+
+package registry
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+)
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// newTestEtcd starts an in-process etcd server and returns a registry
+// connected to it.
+func newTestEtcd(t *testing.T) (*EtcdRegistry, func()) {
+	dir, err := ioutil.TempDir("", "etcd_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	clientURL, _ := url.Parse("http://" + freeAddr(t))
+	peerURL, _ := url.Parse("http://" + freeAddr(t))
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*clientURL}, []url.URL{*clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peerURL}, []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Close()
+		os.RemoveAll(dir)
+		t.Fatal("etcd server not ready")
+	}
+	r, err := newEtcdRegistry(dialTimeout, requestTimeout, []string{clientURL.Host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, func() {
+		r.Close()
+		e.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func etcdLeaseOf(t *testing.T, r *EtcdRegistry, key string) (clientv3.LeaseID, bool) {
+	resp, err := r.client.Get(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, false
+	}
+	return clientv3.LeaseID(resp.Kvs[0].Lease), true
+}
+
+func TestLeaseTTL(t *testing.T) {
+	for d, want := range map[time.Duration]int64{0: 1, 1500 * time.Millisecond: 2, 3 * time.Second: 3} {
+		if ttl := leaseTTL(d); ttl != want {
+			t.Errorf("leaseTTL(%v) = %d, want %d", d, ttl, want)
+		}
+	}
+}
+
+func TestEtcdRegisterWithTTL(t *testing.T) {
+	defer func(d time.Duration) { LeaseRetryInterval = d }(LeaseRetryInterval)
+	LeaseRetryInterval = 10 * time.Millisecond
+
+	r, cleanup := newTestEtcd(t)
+	defer cleanup()
+
+	s := NewService("task", "1.0.0", "10.0.0.1", 8080)
+	if err := r.RegisterWithTTL(s, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	lease, ok := etcdLeaseOf(t, r, r.key(s))
+	if !ok || lease == 0 {
+		t.Fatal("node not registered under a lease")
+	}
+	ttl, err := r.client.TimeToLive(context.Background(), lease)
+	if err != nil || ttl.GrantedTTL != 2 {
+		t.Fatalf("lease has TTL %v (%v), want 2", ttl, err)
+	}
+
+	// The lease is kept alive past its TTL and kept on refresh.
+	time.Sleep(3 * time.Second)
+	if err := r.RegisterWithTTL(s, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if l, ok := etcdLeaseOf(t, r, r.key(s)); !ok || l != lease {
+		t.Fatalf("lease changed from %x to %x (registered %v)", lease, l, ok)
+	}
+
+	// A lost lease is replaced.
+	if _, err := r.client.Revoke(context.Background(), lease); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if l, ok := etcdLeaseOf(t, r, r.key(s)); ok && l != lease {
+			lease = l
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("node not registered again after lease loss")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Deregister revokes the lease.
+	if err := r.Deregister(s); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := etcdLeaseOf(t, r, r.key(s)); ok {
+		t.Fatal("node still registered after deregister")
+	}
+	if ttl, err := r.client.TimeToLive(context.Background(), lease); err != nil || ttl.TTL != -1 {
+		t.Fatalf("lease not revoked after deregister: %v %v", ttl, err)
+	}
+}
+
+func TestEtcdCloseRevokesLeases(t *testing.T) {
+	r, cleanup := newTestEtcd(t)
+	defer cleanup()
+
+	other, err := newEtcdRegistry(dialTimeout, requestTimeout, r.endPoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	s := NewService("task", "1.0.0", "10.0.0.1", 8080)
+	if err := other.RegisterWithTTL(s, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := etcdLeaseOf(t, r, r.key(s)); !ok {
+		t.Fatal("node not registered")
+	}
+	other.Close()
+	if _, ok := etcdLeaseOf(t, r, r.key(s)); ok {
+		t.Fatal("node still registered after close")
+	}
+}
+
+func TestEtcdFind(t *testing.T) {
+	r, cleanup := newTestEtcd(t)
+	defer cleanup()
+
+	for _, s := range queryServices() {
+		if err := r.Register(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testFind(t, "etcd", r)
+}
+
+func TestEtcdNamespace(t *testing.T) {
+	r, cleanup := newTestEtcd(t)
+	defer cleanup()
+	staging, err := NewEtcdRegistryWithOptions(dialTimeout, requestTimeout, r.endPoints, Options{Namespace: "staging"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer staging.Close()
+
+	prod := NewService("task", "1.0.0", "10.0.0.1", 8080)
+	test := NewService("task", "1.1.0", "10.0.0.2", 8080)
+	if err := r.Register(prod); err != nil {
+		t.Fatal(err)
+	}
+	if err := staging.Register(test); err != nil {
+		t.Fatal(err)
+	}
+	if key := staging.key(test); key != "/airman/staging/task/10.0.0.2/8080" {
+		t.Fatalf("staging key %s", key)
+	}
+
+	for _, c := range []struct {
+		r    *EtcdRegistry
+		host string
+	}{{r, "10.0.0.1"}, {staging, "10.0.0.2"}} {
+		ss, err := c.r.GetService("task", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ss) != 1 || len(ss[0].Nodes) != 1 || ss[0].Nodes[0].Host != c.host {
+			t.Fatalf("%s: unexpected services %v", c.r.root, ss)
+		}
+		list, err := c.r.ListServices()
+		if err != nil || len(list) != 1 || list[0].Name != "task" {
+			t.Fatalf("%s: unexpected list %v %v", c.r.root, list, err)
+		}
+	}
+}
+
+func TestEtcdNodeIds(t *testing.T) {
+	r, cleanup := newTestEtcd(t)
+	defer cleanup()
+
+	ch := make(chan *Event, 4)
+	sub, err := r.Watch("task", ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	// Nodes keep the id they were registered with, not their key.
+	s := NewService("task", "1.0.0", "10.0.0.1", 8080)
+	if err := r.Register(s); err != nil {
+		t.Fatal(err)
+	}
+	if ev := expectEvent(t, ch, EventAdd, "10.0.0.1"); ev.Node.Id != s.GetId() {
+		t.Fatalf("watched id %s, want %s", ev.Node.Id, s.GetId())
+	}
+	ss, err := r.GetService("task", "")
+	if err != nil || len(ss) != 1 || ss[0].Nodes[0].Id != s.GetId() {
+		t.Fatalf("unexpected services %v %v", ss, err)
+	}
+	if err := r.Deregister(s); err != nil {
+		t.Fatal(err)
+	}
+	if ev := expectEvent(t, ch, EventRemove, "10.0.0.1"); ev.Node.Id != s.GetId() {
+		t.Fatalf("removed id %s, want %s", ev.Node.Id, s.GetId())
+	}
+
+	// Nodes written in the <name><version> layout of older versions are found.
+	if _, err := r.client.Put(context.Background(), "/airman/task2.0.0/10.0.0.2/8080", "a-service,v-2.0.0,h-10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, ch, EventAdd, "10.0.0.2")
+	ss, err = r.GetService("task", "")
+	if err != nil || len(ss) != 1 || ss[0].Version != "2.0.0" {
+		t.Fatalf("unexpected services %v %v", ss, err)
+	}
+}
+
+func TestEtcdElection(t *testing.T) {
+	r, cleanup := newTestEtcd(t)
+	defer cleanup()
+	testElection(t, r)
+	testMutex(t, r)
+
+	// Coordination keys are not mistaken for services.
+	if list, err := r.ListServices(); err != nil || len(list) != 0 {
+		t.Fatalf("unexpected services %v %v", list, err)
+	}
+}
+
+func TestEtcdConfig(t *testing.T) {
+	r, cleanup := newTestEtcd(t)
+	defer cleanup()
+	testConfigSource(t, r)
+}
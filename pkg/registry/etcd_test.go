@@ -16,8 +16,11 @@
 package registry
 
 import (
+	"reflect"
 	"testing"
 	"time"
+
+	"github.com/coreos/etcd/mvcc/mvccpb"
 )
 
 var (
@@ -57,3 +60,62 @@ func TestEtcdRegister(t *testing.T) {
 	}
 	es.Close()
 }
+
+func TestEtcdParseNodes(t *testing.T) {
+	kvs := []*mvccpb.KeyValue{
+		{Key: []byte("/airman/task/10.0.0.1/8080"), Value: []byte("a-service,v-1.0.0,h-10.0.0.1")},
+		{Key: []byte("/airman/task/10.0.0.2/8080"), Value: []byte("a-service,v-2.0.0,h-10.0.0.2")},
+		{Key: []byte("/airman/other/10.0.0.3/8080"), Value: []byte("a-service,v-1.0.0")},
+		{Key: []byte("/airman/task/10.0.0.4"), Value: []byte("a-service,v-1.0.0")},
+	}
+	version, node, ok := etcdNode("/airman", "task", kvs[0])
+	if !ok || version != "1.0.0" || node.Host != "10.0.0.1" || node.Port != 8080 || node.Id != string(kvs[0].Key) {
+		t.Fatalf("parsed %v %s %#v", ok, version, node)
+	}
+	if _, _, ok := etcdNode("/airman", "task", kvs[3]); ok {
+		t.Fatal("parsed key without port")
+	}
+	if ss := servicesFromKvs("/airman", "task", "", kvs); len(ss) != 2 {
+		t.Fatalf("got %d versions, want 2", len(ss))
+	}
+	// nodes are stored as json records
+	svc := newMetaService()
+	value, err := etcdValue(svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := &mvccpb.KeyValue{Key: []byte("/airman/task/10.0.0.1/8080"), Value: []byte(value)}
+	version, node, ok = etcdNode("/airman", "task", kv)
+	if !ok || version != "1.0.0" || node.Id != svc.GetId() {
+		t.Fatalf("parsed %v %s %#v", ok, version, node)
+	}
+	want := *svc.Nodes[0]
+	want.Tags = svc.GetTags()
+	if !reflect.DeepEqual(node, &want) {
+		t.Fatalf("json round trip:\ngot  %#v\nwant %#v", node, &want)
+	}
+}
+
+func TestEtcdParseLegacyKeys(t *testing.T) {
+	kvs := []*mvccpb.KeyValue{
+		{Key: []byte("/airman/task1.0.0/10.0.0.1/8080"), Value: []byte("a-service,v-1.0.0,h-10.0.0.1")},
+		{Key: []byte("/airman/task/10.0.0.1/8080"), Value: []byte("a-service,v-1.0.0,h-10.0.0.1")},
+		{Key: []byte("/airman/tasks/10.0.0.2/8080"), Value: []byte("a-service,v-1.0.0,h-10.0.0.2")},
+		{Key: []byte("/airman/task2.0.0/10.0.0.3/8080"), Value: []byte("a-service,v-1.0.0,h-10.0.0.3")},
+	}
+	version, node, ok := etcdNode("/airman", "task", kvs[0])
+	if !ok || version != "1.0.0" || node.Id != string(kvs[0].Key) {
+		t.Fatalf("parsed %v %s %#v", ok, version, node)
+	}
+	for _, kv := range kvs[2:] {
+		if _, _, ok := etcdNode("/airman", "task", kv); ok {
+			t.Fatalf("parsed %s as task", kv.Key)
+		}
+	}
+	// A node stored under both layouts is listed once.
+	kvs[1].Value = []byte(`{"id":"/airman/task1.0.0/10.0.0.1/8080","host":"10.0.0.1","port":8080,"version":"1.0.0"}`)
+	ss := servicesFromKvs("/airman", "task", "", kvs)
+	if len(ss) != 1 || len(ss[0].Nodes) != 1 {
+		t.Fatalf("unexpected services %v", ss)
+	}
+}
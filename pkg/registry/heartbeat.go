@@ -0,0 +1,147 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HealthReporter is implemented by registries whose TTL registrations carry
+// a health status.
+type HealthReporter interface {
+	// ReportHealth marks the first node of s healthy if err is nil and
+	// failing otherwise.
+	ReportHealth(s *Service, err error) error
+
+	// RegisterWithHealth is like RegisterWithTTL, but the node starts out
+	// with the status of err instead of being marked healthy.
+	RegisterWithHealth(s *Service, ttl time.Duration, err error) error
+}
+
+var _ HealthReporter = (*ConsulRegistry)(nil)
+
+// MinHeartbeatTTL is the shortest TTL accepted by StartHeartbeat. Etcd
+// leases and consul TTL checks are kept in whole seconds.
+var MinHeartbeatTTL = time.Second
+
+// ErrInvalidTTL is returned by StartHeartbeat for a ttl below MinHeartbeatTTL.
+var ErrInvalidTTL = errors.New("heartbeat ttl too short")
+
+// Heartbeat keeps the TTL registration of a node alive while it is healthy.
+type Heartbeat struct {
+	r     Registry
+	s     *Service
+	ttl   time.Duration
+	check func() error
+
+	registered bool // only accessed by the beating goroutine after start
+
+	stopOnce sync.Once
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// StartHeartbeat registers the first node of s with ttl and refreshes the
+// registration every third of ttl. The check, e.g. the readiness report of
+// package health, runs before every refresh. Registries implementing
+// HealthReporter are told the result and flag a failing node. On the others
+// a failing node is deregistered until the check passes again. The ttl must
+// be at least MinHeartbeatTTL.
+func StartHeartbeat(r Registry, s *Service, ttl time.Duration, check func() error) (*Heartbeat, error) {
+	if ttl < MinHeartbeatTTL {
+		return nil, fmt.Errorf("%w: %v is below the minimum of %v", ErrInvalidTTL, ttl, MinHeartbeatTTL)
+	}
+	h := &Heartbeat{
+		r:     r,
+		s:     s,
+		ttl:   ttl,
+		check: check,
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if err := h.beat(); err != nil {
+		return nil, err
+	}
+	go h.loop()
+	return h, nil
+}
+
+// Stop ends the heartbeat and deregisters the node.
+func (h *Heartbeat) Stop() error {
+	h.stopOnce.Do(func() { close(h.quit) })
+	<-h.done
+	return h.r.Deregister(h.s)
+}
+
+func (h *Heartbeat) loop() {
+	defer close(h.done)
+
+	ticker := time.NewTicker(h.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := h.beat(); err != nil {
+				log.Warnf("heartbeat of %s failed: %v", h.s.GetId(), err)
+			}
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+// beat runs the check and refreshes the registration with its result.
+func (h *Heartbeat) beat() error {
+	var failure error
+	if h.check != nil {
+		failure = h.check()
+	}
+
+	if reporter, ok := h.r.(HealthReporter); ok {
+		if !h.registered {
+			if err := reporter.RegisterWithHealth(h.s, h.ttl, failure); err != nil {
+				return err
+			}
+			h.registered = true
+			return nil
+		}
+		if err := reporter.ReportHealth(h.s, failure); err != nil {
+			// The registration may be gone, e.g. after an agent restart.
+			h.registered = false
+			return err
+		}
+		return nil
+	}
+
+	if failure != nil {
+		if !h.registered {
+			return nil
+		}
+		log.Warnf("deregistering unhealthy %s: %v", h.s.GetId(), failure)
+		h.registered = false
+		return h.r.Deregister(h.s)
+	}
+	if err := h.r.RegisterWithTTL(h.s, h.ttl); err != nil {
+		return err
+	}
+	h.registered = true
+	return nil
+}
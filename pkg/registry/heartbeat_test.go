@@ -0,0 +1,241 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// toggleCheck is a health check that can be made to fail.
+type toggleCheck struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (c *toggleCheck) set(err error) {
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+}
+
+func (c *toggleCheck) check() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// shortTTL lets tests beat faster than MinHeartbeatTTL allows.
+func shortTTL() func() {
+	min := MinHeartbeatTTL
+	MinHeartbeatTTL = 0
+	return func() { MinHeartbeatTTL = min }
+}
+
+func TestHeartbeat(t *testing.T) {
+	defer shortTTL()()
+	r := NewMemoryRegistry()
+	defer r.Close()
+	s := NewService("task", "1.0.0", "10.0.0.1", 8080)
+	registered := func() bool {
+		ss, _ := r.GetService("task", "")
+		return len(ss) == 1
+	}
+
+	check := new(toggleCheck)
+	hb, err := StartHeartbeat(r, s, 60*time.Millisecond, check.check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !registered() {
+		t.Fatal("node not registered")
+	}
+	// the registration outlives its TTL
+	time.Sleep(150 * time.Millisecond)
+	if !registered() {
+		t.Fatal("node expired while healthy")
+	}
+
+	check.set(errors.New("down"))
+	waitFor(t, "deregistration", func() bool { return !registered() })
+	check.set(nil)
+	waitFor(t, "registration", registered)
+
+	if err := hb.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if registered() {
+		t.Fatal("node registered after stop")
+	}
+}
+
+// fakeAgent serves the consul agent endpoints used by TTL registrations.
+type fakeAgent struct {
+	mu       sync.Mutex
+	services map[string]bool
+	status   map[string]string // check id -> status
+	output   map[string]string
+	history  []string // statuses in the order they were set
+}
+
+func (f *fakeAgent) get(id string) (string, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status["service:"+id], f.output["service:"+id]
+}
+
+func (f *fakeAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := r.URL.Path
+	switch {
+	case path == "/v1/agent/service/register":
+		var reg struct{ ID string }
+		json.NewDecoder(r.Body).Decode(&reg)
+		f.services[reg.ID] = true
+	case strings.HasPrefix(path, "/v1/agent/service/deregister/"):
+		delete(f.services, strings.TrimPrefix(path, "/v1/agent/service/deregister/"))
+	case strings.HasPrefix(path, "/v1/agent/check/pass/"):
+		id := strings.TrimPrefix(path, "/v1/agent/check/pass/")
+		if !f.services[strings.TrimPrefix(id, "service:")] {
+			http.Error(w, "unknown check", http.StatusInternalServerError)
+			return
+		}
+		f.status[id], f.output[id] = "passing", ""
+		f.history = append(f.history, "passing")
+	case strings.HasPrefix(path, "/v1/agent/check/update/"):
+		id := strings.TrimPrefix(path, "/v1/agent/check/update/")
+		if !f.services[strings.TrimPrefix(id, "service:")] {
+			http.Error(w, "unknown check", http.StatusInternalServerError)
+			return
+		}
+		var update struct{ Status, Output string }
+		json.NewDecoder(r.Body).Decode(&update)
+		f.status[id], f.output[id] = update.Status, update.Output
+		f.history = append(f.history, update.Status)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestHeartbeatInvalidTTL(t *testing.T) {
+	r := NewMemoryRegistry()
+	defer r.Close()
+	s := NewService("task", "1.0.0", "10.0.0.1", 8080)
+
+	for _, ttl := range []time.Duration{-time.Second, 0, 2, MinHeartbeatTTL - 1} {
+		if _, err := StartHeartbeat(r, s, ttl, nil); !errors.Is(err, ErrInvalidTTL) {
+			t.Fatalf("ttl %v: expected %v, got %v", ttl, ErrInvalidTTL, err)
+		}
+	}
+	if ss, _ := r.GetService("task", ""); len(ss) != 0 {
+		t.Fatal("node registered with invalid ttl")
+	}
+}
+
+func TestConsulHeartbeat(t *testing.T) {
+	defer shortTTL()()
+	agent := &fakeAgent{services: make(map[string]bool), status: make(map[string]string), output: make(map[string]string)}
+	srv := httptest.NewServer(agent)
+	defer srv.Close()
+	r, err := NewConsulRegistry(srv.Listener.Addr().String(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewService("task", "1.0.0", "10.0.0.1", 8080)
+	check := new(toggleCheck)
+	check.set(errors.New("db down"))
+	hb, err := StartHeartbeat(r, s, 60*time.Millisecond, check.check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, output := agent.get(s.GetId()); status != "critical" || output != "db down" {
+		t.Fatalf("got %s %q, want critical", status, output)
+	}
+	agent.mu.Lock()
+	if len(agent.history) != 1 {
+		t.Fatalf("failing node registered with statuses %q", agent.history)
+	}
+	agent.mu.Unlock()
+	check.set(nil)
+	waitFor(t, "passing check", func() bool {
+		status, _ := agent.get(s.GetId())
+		return status == "passing"
+	})
+
+	// the node is registered again after the agent lost it
+	agent.mu.Lock()
+	agent.services = make(map[string]bool)
+	agent.status = make(map[string]string)
+	agent.mu.Unlock()
+	waitFor(t, "registration", func() bool {
+		status, _ := agent.get(s.GetId())
+		return status == "passing"
+	})
+
+	if err := hb.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if len(agent.services) != 0 {
+		t.Fatal("service registered after stop")
+	}
+}
+
+// A node that is still registered, e.g. by a previous run, isn't marked
+// passing before its check ran.
+func TestConsulHeartbeatRegistered(t *testing.T) {
+	defer shortTTL()()
+	agent := &fakeAgent{services: make(map[string]bool), status: make(map[string]string), output: make(map[string]string)}
+	srv := httptest.NewServer(agent)
+	defer srv.Close()
+	r, err := NewConsulRegistry(srv.Listener.Addr().String(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewService("task", "1.0.0", "10.0.0.1", 8080)
+	agent.services[s.GetId()] = true
+	hb, err := StartHeartbeat(r, s, time.Minute, func() error { return errors.New("db down") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hb.Stop()
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if len(agent.history) != 1 || agent.history[0] != "critical" {
+		t.Fatalf("failing node got statuses %q", agent.history)
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"airman.com/airfk/pkg/event"
+)
+
+type memoryNode struct {
+	service *Service
+	node    *Node
+	tags    []string
+	expires time.Time // zero if the node doesn't expire
+}
+
+// MemoryRegistry is a registry kept in process memory. It is meant for tests
+// and single process setups.
+type MemoryRegistry struct {
+	mu       sync.RWMutex
+	services map[string]map[string]*memoryNode // name -> node id -> node
+	wakeups  map[chan struct{}]struct{}        // watchers to notify about changes
+	locks    map[string]*memoryLock            // elections and mutexes
+	configs  map[string]map[string][]byte      // service -> key -> config value
+	opts     Options
+}
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		services: make(map[string]map[string]*memoryNode),
+		wakeups:  make(map[chan struct{}]struct{}),
+		locks:    make(map[string]*memoryLock),
+		configs:  make(map[string]map[string][]byte),
+	}
+}
+
+// NewMemoryRegistryWithOptions creates a memory registry whose options are
+// used by NewServiceFor. Nodes of other registries are never visible, so the
+// namespace only shows in the node ids.
+func NewMemoryRegistryWithOptions(opts Options) (*MemoryRegistry, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	m := NewMemoryRegistry()
+	m.opts = opts
+	return m, nil
+}
+
+// Options returns the options the registry was created with.
+func (m *MemoryRegistry) Options() Options {
+	return m.opts
+}
+
+func (m *MemoryRegistry) Register(s *Service) error {
+	return m.RegisterWithTTL(s, 0)
+}
+
+func (m *MemoryRegistry) RegisterWithTTL(s *Service, timeTTL time.Duration) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
+	}
+	node := *s.Nodes[0]
+	entry := &memoryNode{
+		service: s,
+		node:    &node,
+		tags:    s.GetTags(),
+	}
+	if timeTTL > 0 {
+		entry.expires = time.Now().Add(timeTTL)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nodes, ok := m.services[s.Name]
+	if !ok {
+		nodes = make(map[string]*memoryNode)
+		m.services[s.Name] = nodes
+	}
+	nodes[node.Id] = entry
+	m.notify()
+	return nil
+}
+
+func (m *MemoryRegistry) Deregister(s *Service) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if nodes, ok := m.services[s.Name]; ok {
+		delete(nodes, s.Nodes[0].Id)
+		if len(nodes) == 0 {
+			delete(m.services, s.Name)
+		}
+		m.notify()
+	}
+	return nil
+}
+
+func (m *MemoryRegistry) GetService(name, tag string) ([]*Service, error) {
+	if name == "" {
+		return nil, ErrNilKey
+	}
+	now := time.Now()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	serviceMap := map[string]*Service{}
+	for _, entry := range m.services[name] {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			continue
+		}
+		if tag != "" && !hasTag(entry.tags, tag) {
+			continue
+		}
+		version := entry.service.Version
+		svc, ok := serviceMap[version]
+		if !ok {
+			svc = &Service{
+				Name:    name,
+				Version: version,
+				Check:   entry.service.Check,
+				TTL:     entry.service.TTL,
+				Tags:    entry.tags,
+			}
+			serviceMap[version] = svc
+		}
+		node := *entry.node
+		node.Tags = entry.tags
+		svc.Nodes = append(svc.Nodes, &node)
+	}
+
+	var services []*Service
+	for _, service := range serviceMap {
+		sort.Slice(service.Nodes, func(i, j int) bool { return service.Nodes[i].Id < service.Nodes[j].Id })
+		services = append(services, service)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Version < services[j].Version })
+	return services, nil
+}
+
+func (m *MemoryRegistry) ListServices() ([]*Service, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	services := make([]*Service, 0, len(m.services))
+	for name := range m.services {
+		services = append(services, &Service{Name: name})
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services, nil
+}
+
+func (m *MemoryRegistry) Close() error {
+	return nil
+}
+
+// Watch implements Watcher. Watchers compare snapshots of the service after
+// every change and when a node expires.
+func (m *MemoryRegistry) Watch(name string, ch chan<- *Event) (event.Subscription, error) {
+	if name == "" {
+		return nil, ErrNilKey
+	}
+	w := newWatch(name, ch)
+	wake := make(chan struct{}, 1)
+	m.mu.Lock()
+	m.wakeups[wake] = struct{}{}
+	m.mu.Unlock()
+
+	go func() {
+		defer w.exit()
+		defer func() {
+			m.mu.Lock()
+			delete(m.wakeups, wake)
+			m.mu.Unlock()
+		}()
+
+		for {
+			services, _ := m.GetService(name, "")
+			if !w.sync(services) {
+				return
+			}
+			var (
+				timer  *time.Timer
+				expiry <-chan time.Time
+			)
+			if next := m.nextExpiry(name); !next.IsZero() {
+				timer = time.NewTimer(time.Until(next))
+				expiry = timer.C
+			}
+			select {
+			case <-wake:
+			case <-expiry:
+			case <-w.ctx.Done():
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			if w.ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+	return w, nil
+}
+
+// notify wakes up all watchers.
+// note: callers must hold m.mu
+func (m *MemoryRegistry) notify() {
+	for wake := range m.wakeups {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// nextExpiry returns the earliest expiry of the live nodes of a service.
+func (m *MemoryRegistry) nextExpiry(name string) time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var next time.Time
+	now := time.Now()
+	for _, entry := range m.services[name] {
+		if entry.expires.IsZero() || now.After(entry.expires) {
+			continue
+		}
+		if next.IsZero() || entry.expires.Before(next) {
+			next = entry.expires
+		}
+	}
+	return next
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
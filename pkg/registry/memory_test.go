@@ -0,0 +1,129 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryRegister(t *testing.T) {
+	r := NewMemoryRegistry()
+	defer r.Close()
+
+	v1 := NewService("task", "1.0.0", "10.0.0.1", 8080)
+	v1b := NewService("task", "1.0.0", "10.0.0.2", 8080)
+	v2 := NewService("task", "2.0.0", "10.0.0.3", 8080)
+	for _, s := range []*Service{v1, v1b, v2} {
+		if err := r.Register(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ss, err := r.GetService("task", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 2 || ss[0].Version != "1.0.0" || len(ss[0].Nodes) != 2 || len(ss[1].Nodes) != 1 {
+		t.Fatalf("unexpected services: %#v", ss)
+	}
+	if ss, _ := r.GetService("task", "v-2.0.0"); len(ss) != 1 || ss[0].Nodes[0].Host != "10.0.0.3" {
+		t.Fatalf("tag query returned %#v", ss)
+	}
+	if _, err := r.GetService("", ""); err != ErrNilKey {
+		t.Fatalf("empty name returned %v", err)
+	}
+
+	r.Deregister(v2)
+	if ss, _ := r.GetService("task", ""); len(ss) != 1 {
+		t.Fatalf("got %d versions after deregister, want 1", len(ss))
+	}
+	if list, _ := r.ListServices(); len(list) != 1 || list[0].Name != "task" {
+		t.Fatalf("unexpected service list: %#v", list)
+	}
+}
+
+func TestMemoryRegisterWithTTL(t *testing.T) {
+	r := NewMemoryRegistry()
+	s := NewService("task", "1.0.0", "10.0.0.1", 8080)
+	if err := r.RegisterWithTTL(s, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if ss, _ := r.GetService("task", ""); len(ss) != 1 {
+		t.Fatal("node not registered")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if ss, _ := r.GetService("task", ""); len(ss) != 0 {
+		t.Fatal("node not expired")
+	}
+}
+
+func TestNewRegistry(t *testing.T) {
+	r, err := New("memory://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.(*MemoryRegistry); !ok {
+		t.Fatalf("memory url created %T", r)
+	}
+	r, err = New("memory://?prefix=svc&namespace=dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := r.(*MemoryRegistry); !ok || m.Options().root() != "/svc/dev" {
+		t.Fatalf("memory url created %#v", r)
+	}
+	if id := NewServiceFor(r, "task", "1.0.0", "10.0.0.1", 8080).GetId(); id != "/svc/dev/task1.0.0/10.0.0.1/8080" {
+		t.Fatalf("memory node id %s", id)
+	}
+	r, err = New("consul://127.0.0.1:8501?timeout=3s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := r.(*ConsulRegistry); !ok || c.addr != "127.0.0.1:8501" || c.timeout != 3*time.Second {
+		t.Fatalf("consul url created %#v", r)
+	}
+	r, err = New("consul://127.0.0.1:8501?namespace=staging&dc=eu-west")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := r.(*ConsulRegistry); !ok || c.opts.Namespace != "staging" || c.queryOptions.Datacenter != "eu-west" {
+		t.Fatalf("consul url created %#v", r)
+	}
+	r, err = New("zk://127.0.0.1:2181,127.0.0.2:2181?timeout=1s&prefix=svc&namespace=dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if z, ok := r.(*ZookeeperRegistry); !ok || len(z.servers) != 2 || z.root != "/svc/dev" {
+		t.Fatalf("zk url created %#v", r)
+	}
+	r.Close()
+	r, err = New("dns://example.com?server=127.0.0.1:5353&refresh=10s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := r.(*DNSRegistry); !ok || d.config.Domain != "example.com" || d.config.RefreshInterval != 10*time.Second {
+		t.Fatalf("dns url created %#v", r)
+	}
+	r.Close()
+
+	for _, url := range []string{"redis://localhost", "localhost:8500", "consul://localhost?timeout=x", "consul://localhost?namespace=a/b", "dns://",
+		"memory://?dc=eu-west", "memory://?namespace=a/b", "etcd://localhost?dc=eu-west", "dns://example.com?namespace=dev", "consul://localhost?timout=3s"} {
+		if _, err := New(url); err == nil {
+			t.Errorf("New(%q) succeeded", url)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import "sort"
+
+// Query selects the nodes of a service by version range, tags, zone and
+// metadata. Empty fields match any node.
+type Query struct {
+	Name     string
+	Version  string            // semver range, see VersionConstraint
+	Tags     []string          // tags the node must have
+	Zone     string            // zone the node must be in
+	Metadata map[string]string // metadata the node must have
+}
+
+// Matcher returns a function reporting whether a node of the given version
+// is selected by the query.
+func (q *Query) Matcher() (func(version string, node *Node) bool, error) {
+	constraint, err := ParseVersionConstraint(q.Version)
+	if err != nil {
+		return nil, err
+	}
+	return func(version string, node *Node) bool {
+		return constraint.Match(version) && q.matchNode(node)
+	}, nil
+}
+
+func (q *Query) matchNode(node *Node) bool {
+	if q.Zone != "" && node.Zone != q.Zone {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !hasTag(node.Tags, tag) {
+			return false
+		}
+	}
+	for k, v := range q.Metadata {
+		if value, ok := node.Metadata[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Find returns the nodes of r selected by q, grouped by version and ordered
+// from the lowest to the highest version. Selection happens on the client,
+// so it behaves the same on every backend.
+func Find(r Registry, q *Query) ([]*Service, error) {
+	if q.Name == "" {
+		return nil, ErrNilKey
+	}
+	match, err := q.Matcher()
+	if err != nil {
+		return nil, err
+	}
+	services, err := r.GetService(q.Name, "")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[string]*Service)
+	for _, s := range services {
+		for _, node := range s.Nodes {
+			if !match(s.Version, node) {
+				continue
+			}
+			found, ok := byVersion[s.Version]
+			if !ok {
+				copied := *s
+				copied.Nodes = nil
+				found = &copied
+				byVersion[s.Version] = found
+			}
+			found.Nodes = append(found.Nodes, node)
+		}
+	}
+	found := make([]*Service, 0, len(byVersion))
+	for _, s := range byVersion {
+		sort.Slice(s.Nodes, func(i, j int) bool { return s.Nodes[i].Id < s.Nodes[j].Id })
+		found = append(found, s)
+	}
+	sort.Slice(found, func(i, j int) bool { return compareVersions(found[i].Version, found[j].Version) < 0 })
+	return found, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+// queryServices are registered with every backend in TestFind.
+func queryServices() []*Service {
+	var services []*Service
+	for i, v := range []struct {
+		version, zone, stage string
+	}{
+		{"1.2.0", "a", "stable"},
+		{"1.4.1", "a", "stable"},
+		{"1.4.1", "b", "stable"},
+		{"1.5.0-canary", "a", "canary"},
+		{"2.0.0", "a", "stable"},
+	} {
+		s := NewService("task", v.version, fmt.Sprintf("10.0.0.%d", i+1), 8080)
+		s.Nodes[0].Zone = v.zone
+		s.Nodes[0].Metadata = map[string]string{"stage": v.stage}
+		services = append(services, s)
+	}
+	return services
+}
+
+func testFind(t *testing.T, backend string, r Registry) {
+	tests := []struct {
+		query Query
+		want  string
+	}{
+		{Query{Name: "task"}, "[1.2.0:[10.0.0.1] 1.4.1:[10.0.0.2 10.0.0.3] 1.5.0-canary:[10.0.0.4] 2.0.0:[10.0.0.5]]"},
+		{Query{Name: "task", Version: "1.x", Zone: "a"}, "[1.2.0:[10.0.0.1] 1.4.1:[10.0.0.2]]"},
+		{Query{Name: "task", Version: "^1.3", Tags: []string{"v-1.4.1"}}, "[1.4.1:[10.0.0.2 10.0.0.3]]"},
+		{Query{Name: "task", Version: "^1.5.0-canary", Metadata: map[string]string{"stage": "canary"}}, "[1.5.0-canary:[10.0.0.4]]"},
+		{Query{Name: "task", Version: ">=3"}, "[]"},
+		{Query{Name: "task", Zone: "c"}, "[]"},
+	}
+	for _, test := range tests {
+		found, err := Find(r, &test.query)
+		if err != nil {
+			t.Fatalf("%s: %+v: %v", backend, test.query, err)
+		}
+		var groups []string
+		for _, s := range found {
+			var hosts []string
+			for _, node := range s.Nodes {
+				hosts = append(hosts, node.Host)
+			}
+			groups = append(groups, fmt.Sprintf("%s:%v", s.Version, hosts))
+		}
+		if got := fmt.Sprint(groups); got != test.want {
+			t.Errorf("%s: %+v: got %s, want %s", backend, test.query, got, test.want)
+		}
+	}
+	if _, err := Find(r, &Query{Name: "task", Version: "~x"}); err == nil {
+		t.Errorf("%s: invalid version range accepted", backend)
+	}
+}
+
+func TestFind(t *testing.T) {
+	mem := NewMemoryRegistry()
+	defer mem.Close()
+	for _, s := range queryServices() {
+		mem.Register(s)
+	}
+	testFind(t, "memory", mem)
+
+	// consul stores the node fields as service meta
+	fake := newFakeConsul()
+	for i, s := range queryServices() {
+		node := s.Nodes[0]
+		entry := consulEntry(fmt.Sprint(i), node.Host, node.Port, s.Version)
+		entry.Service.Tags = s.GetTags()
+		meta, err := serviceMeta(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.Service.Meta = meta
+		fake.entries = append(fake.entries, entry)
+	}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	r, err := NewConsulRegistry(srv.Listener.Addr().String(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFind(t, "consul", r)
+}
@@ -0,0 +1,214 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultDialTimeout    = 5 * time.Second
+	DefaultRequestTimeout = 10 * time.Second
+)
+
+// Registry is a service registry backend.
+type Registry interface {
+	// Register registers the first node of s.
+	Register(s *Service) error
+	// RegisterWithTTL registers the first node of s, which expires unless it
+	// is registered again within ttl.
+	RegisterWithTTL(s *Service, ttl time.Duration) error
+	// Deregister removes the first node of s.
+	Deregister(s *Service) error
+	// GetService returns the nodes registered under name, grouped by version.
+	// If tag is not empty, only nodes with that tag are returned.
+	GetService(name, tag string) ([]*Service, error)
+	// ListServices returns the names of all registered services.
+	ListServices() ([]*Service, error)
+	// Close releases the resources of the registry.
+	Close() error
+}
+
+var (
+	_ Registry = (*CacheRegistry)(nil)
+	_ Registry = (*ConsulRegistry)(nil)
+	_ Registry = (*DNSRegistry)(nil)
+	_ Registry = (*EtcdRegistry)(nil)
+	_ Registry = (*MemoryRegistry)(nil)
+	_ Registry = (*ZookeeperRegistry)(nil)
+)
+
+// Options contains the settings shared by the registry backends.
+type Options struct {
+	// Prefix is the root of the etcd keys and zookeeper paths, it defaults to
+	// DefaultPrefixService.
+	Prefix string
+	// Namespace separates environments sharing a backend, e.g. "staging".
+	// Nodes are stored below /<prefix>/<namespace> in etcd and zookeeper and
+	// tagged with the namespace in consul. Lookups only see the nodes of the
+	// same namespace.
+	Namespace string
+	// Datacenter is the consul datacenter queried by lookups, that of the
+	// agent if empty.
+	Datacenter string
+}
+
+// root returns the path nodes are stored under.
+func (o Options) root() string {
+	prefix := strings.Trim(o.Prefix, "/")
+	if prefix == "" {
+		prefix = DefaultPrefixService
+	}
+	if o.Namespace == "" {
+		return "/" + prefix
+	}
+	return "/" + prefix + "/" + o.Namespace
+}
+
+func (o Options) validate() error {
+	if strings.Contains(o.Namespace, "/") {
+		return fmt.Errorf("invalid registry namespace %q", o.Namespace)
+	}
+	return nil
+}
+
+// namespaceTag returns the consul tag of the namespace.
+func (o Options) namespaceTag() string {
+	if o.Namespace == "" {
+		return ""
+	}
+	return namespaceTagPrefix + o.Namespace
+}
+
+const namespaceTagPrefix = "ns-"
+
+// New creates the registry described by rawurl. Supported forms are:
+//
+//	consul://host:8500
+//	etcd://host1:2379,host2:2379
+//	zk://host1:2181,host2:2181
+//	memory://
+//	dns://service.example.com?server=10.0.0.2:53
+//
+// The timeouts can be set with the query parameters "timeout" (consul and
+// etcd request timeout, zookeeper session timeout) and "dial_timeout" (etcd), e.g.
+// etcd://localhost:2379?dial_timeout=3s.
+//
+// The parameters "prefix", "namespace" and "dc" set the Options, e.g.
+// consul://localhost:8500?namespace=staging&dc=eu-west. The datacenter is
+// only supported by consul, the prefix and namespace by all but dns.
+// Parameters a scheme doesn't support are rejected.
+//
+// The dns registry resolves SRV records below the domain, with the system
+// resolver unless "server" is set. The parameter "refresh" sets its refresh
+// interval.
+func New(rawurl string) (Registry, error) {
+	parts := strings.SplitN(rawurl, "://", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid registry url %q", rawurl)
+	}
+	scheme, hosts := strings.ToLower(parts[0]), parts[1]
+	var query url.Values
+	if i := strings.IndexByte(hosts, '?'); i >= 0 {
+		var err error
+		if query, err = url.ParseQuery(hosts[i+1:]); err != nil {
+			return nil, fmt.Errorf("invalid registry url %q: %v", rawurl, err)
+		}
+		hosts = hosts[:i]
+	}
+	hosts = strings.TrimSuffix(hosts, "/")
+	for name := range query {
+		if !schemeParams[scheme][name] {
+			return nil, fmt.Errorf("unsupported registry parameter %q for %s", name, scheme)
+		}
+	}
+
+	timeout, err := durationParam(query, "timeout", DefaultRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	opts := Options{
+		Prefix:     query.Get("prefix"),
+		Namespace:  query.Get("namespace"),
+		Datacenter: query.Get("dc"),
+	}
+	switch scheme {
+	case "consul":
+		return NewConsulRegistryWithOptions(hosts, timeout, opts)
+	case "etcd":
+		dialTimeout, err := durationParam(query, "dial_timeout", DefaultDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		endpoints := splitHosts(hosts)
+		if len(endpoints) == 0 {
+			endpoints = []string{"localhost:2379"}
+		}
+		return NewEtcdRegistryWithOptions(dialTimeout, timeout, endpoints, opts)
+	case "zk", "zookeeper":
+		return NewZookeeperRegistryWithOptions(splitHosts(hosts), timeout, opts)
+	case "memory":
+		return NewMemoryRegistryWithOptions(opts)
+	case "dns":
+		refresh, err := durationParam(query, "refresh", DefaultDNSRefreshInterval)
+		if err != nil {
+			return nil, err
+		}
+		return NewDNSRegistry(DNSConfig{
+			Domain:          hosts,
+			Server:          query.Get("server"),
+			Timeout:         timeout,
+			RefreshInterval: refresh,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported registry scheme %q", scheme)
+	}
+}
+
+// schemeParams lists the query parameters New accepts for each scheme.
+var schemeParams = map[string]map[string]bool{
+	"consul":    {"timeout": true, "prefix": true, "namespace": true, "dc": true},
+	"etcd":      {"timeout": true, "dial_timeout": true, "prefix": true, "namespace": true},
+	"zk":        {"timeout": true, "prefix": true, "namespace": true},
+	"zookeeper": {"timeout": true, "prefix": true, "namespace": true},
+	"memory":    {"prefix": true, "namespace": true},
+	"dns":       {"timeout": true, "server": true, "refresh": true},
+}
+
+func splitHosts(hosts string) []string {
+	var list []string
+	for _, host := range strings.Split(hosts, ",") {
+		if host != "" {
+			list = append(list, host)
+		}
+	}
+	return list
+}
+
+func durationParam(query url.Values, name string, def time.Duration) (time.Duration, error) {
+	value := query.Get(name)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid registry parameter %s: %v", name, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,321 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semver is a parsed semantic version, build metadata is dropped.
+type semver struct {
+	major, minor, patch int
+	pre                 string
+}
+
+func (v semver) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+	if v.pre != "" {
+		s += "-" + v.pre
+	}
+	return s
+}
+
+// parseVersion parses a version like "1.2.3", "v1.2.3-beta.1" or "1.2".
+// Missing minor and patch numbers are zero.
+func parseVersion(s string) (semver, error) {
+	v, n, err := parsePartial(s)
+	if err == nil && n == 0 {
+		err = fmt.Errorf("invalid version %q", s)
+	}
+	return v, err
+}
+
+// parsePartial parses a possibly partial version and returns the number of
+// version numbers given. Wildcards ("x", "X" or "*") end the version.
+func parsePartial(s string) (semver, int, error) {
+	var v semver
+	orig := s
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		s, v.pre = s[:i], s[i+1:]
+		if v.pre == "" {
+			return v, 0, fmt.Errorf("invalid version %q", orig)
+		}
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, 0, fmt.Errorf("invalid version %q", orig)
+	}
+	nums := []*int{&v.major, &v.minor, &v.patch}
+	n := 0
+	for _, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		num, err := strconv.Atoi(part)
+		if err != nil || num < 0 {
+			return v, 0, fmt.Errorf("invalid version %q", orig)
+		}
+		*nums[n] = num
+		n++
+	}
+	if v.pre != "" && n < 3 {
+		return v, 0, fmt.Errorf("invalid version %q", orig)
+	}
+	return v, n, nil
+}
+
+// compare returns -1, 0 or 1 if v is lower, equal or greater than o.
+func (v semver) compare(o semver) int {
+	switch {
+	case v.major != o.major:
+		return compareInt(v.major, o.major)
+	case v.minor != o.minor:
+		return compareInt(v.minor, o.minor)
+	case v.patch != o.patch:
+		return compareInt(v.patch, o.patch)
+	}
+	return comparePre(v.pre, o.pre)
+}
+
+func compareInt(a, b int) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// comparePre compares pre-release versions, a release is greater than any of
+// its pre-releases.
+func comparePre(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return 1
+	case b == "":
+		return -1
+	}
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		switch {
+		case aerr == nil && berr == nil:
+			if c := compareInt(an, bn); c != 0 {
+				return c
+			}
+		case aerr == nil:
+			return -1 // numeric identifiers are lower
+		case berr == nil:
+			return 1
+		default:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareInt(len(as), len(bs))
+}
+
+type comparator struct {
+	op string // one of "=", "!=", ">", ">=", "<", "<="
+	v  semver
+}
+
+func (c comparator) match(v semver) bool {
+	cmp := v.compare(c.v)
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	default:
+		return cmp <= 0
+	}
+}
+
+// VersionConstraint is a semver range. It is a list of alternatives separated
+// by "||", each a space separated list of conditions that must all hold:
+//
+//	1.2.3, =1.2.3   exactly 1.2.3
+//	1.2, 1.2.x      any 1.2 version
+//	>1.2.3, >=1.2   greater (or equal), likewise < and <=, != excludes a version
+//	~1.2.3          >=1.2.3 <1.3.0
+//	^1.2.3          >=1.2.3 <2.0.0, ^0.2.3 is >=0.2.3 <0.3.0
+//	*, ""           any version
+//
+// Pre-releases like 1.3.0-beta only match if a condition of the alternative
+// names a pre-release of the same version, so canaries aren't selected by
+// accident.
+type VersionConstraint struct {
+	alternatives [][]comparator
+}
+
+// ParseVersionConstraint parses a semver range, see VersionConstraint.
+func ParseVersionConstraint(s string) (*VersionConstraint, error) {
+	c := new(VersionConstraint)
+	for _, alt := range strings.Split(s, "||") {
+		var cmps []comparator
+		fields := strings.Fields(alt)
+		for i := 0; i < len(fields); i++ {
+			cond := fields[i]
+			// allow a space between operator and version, e.g. ">= 1.2"
+			if strings.Trim(cond, "<>=!~^") == "" && i+1 < len(fields) {
+				i++
+				cond += fields[i]
+			}
+			parsed, err := parseCondition(cond)
+			if err != nil {
+				return nil, fmt.Errorf("invalid version constraint %q: %v", s, err)
+			}
+			cmps = append(cmps, parsed...)
+		}
+		c.alternatives = append(c.alternatives, cmps)
+	}
+	return c, nil
+}
+
+func parseCondition(cond string) ([]comparator, error) {
+	op := ""
+	for _, prefix := range []string{">=", "<=", "!=", ">", "<", "=", "~", "^"} {
+		if strings.HasPrefix(cond, prefix) {
+			op, cond = prefix, cond[len(prefix):]
+			break
+		}
+	}
+	v, n, err := parsePartial(cond)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		if op != "" && op != "=" && op != ">=" && op != "<=" {
+			return nil, fmt.Errorf("invalid condition %q", op+cond)
+		}
+		return nil, nil
+	}
+	// next returns the lowest version above the given prefix
+	next := func(n int) semver {
+		switch n {
+		case 1:
+			return semver{major: v.major + 1}
+		case 2:
+			return semver{major: v.major, minor: v.minor + 1}
+		}
+		return semver{major: v.major, minor: v.minor, patch: v.patch + 1}
+	}
+	switch op {
+	case "", "=":
+		if n == 3 {
+			return []comparator{{"=", v}}, nil
+		}
+		return []comparator{{">=", v}, {"<", next(n)}}, nil
+	case "!=":
+		if n < 3 {
+			return nil, fmt.Errorf("partial version in %q", op+cond)
+		}
+		return []comparator{{"!=", v}}, nil
+	case ">":
+		if n == 3 {
+			return []comparator{{">", v}}, nil
+		}
+		return []comparator{{">=", next(n)}}, nil
+	case "<=":
+		if n == 3 {
+			return []comparator{{"<=", v}}, nil
+		}
+		return []comparator{{"<", next(n)}}, nil
+	case ">=", "<":
+		return []comparator{{op, v}}, nil
+	case "~":
+		if n == 1 {
+			return []comparator{{">=", v}, {"<", next(1)}}, nil
+		}
+		return []comparator{{">=", v}, {"<", next(2)}}, nil
+	default: // "^"
+		switch {
+		case v.major > 0 || n == 1:
+			return []comparator{{">=", v}, {"<", next(1)}}, nil
+		case v.minor > 0 || n == 2:
+			return []comparator{{">=", v}, {"<", next(2)}}, nil
+		}
+		return []comparator{{">=", v}, {"<", next(3)}}, nil
+	}
+}
+
+// Match reports whether version satisfies the constraint. Versions that
+// can't be parsed only match an alternative without conditions, like "*".
+func (c *VersionConstraint) Match(version string) bool {
+	v, err := parseVersion(version)
+	for _, cmps := range c.alternatives {
+		if len(cmps) == 0 {
+			return true
+		}
+		if err != nil {
+			continue
+		}
+		if matchAll(cmps, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAll(cmps []comparator, v semver) bool {
+	preAllowed := v.pre == ""
+	for _, c := range cmps {
+		if !c.match(v) {
+			return false
+		}
+		if c.v.pre != "" && c.v.major == v.major && c.v.minor == v.minor && c.v.patch == v.patch {
+			preAllowed = true
+		}
+	}
+	return preAllowed
+}
+
+// compareVersions orders version strings by semver precedence. Versions that
+// can't be parsed sort first, by string.
+func compareVersions(a, b string) int {
+	va, erra := parseVersion(a)
+	vb, errb := parseVersion(b)
+	switch {
+	case erra != nil && errb != nil:
+		return strings.Compare(a, b)
+	case erra != nil:
+		return -1
+	case errb != nil:
+		return 1
+	}
+	if c := va.compare(vb); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import "testing"
+
+func TestVersionConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		match      []string
+		nomatch    []string
+	}{
+		{"", []string{"1.0.0", "0.0.1", "2.0.0-beta", "latest"}, nil},
+		{"*", []string{"1.0.0", "3.2.1", "latest"}, nil},
+		{">= 1.2 < 2", []string{"1.2.0", "1.9.0"}, []string{"2.0.0", "1.1.0"}},
+		{"1.2.3", []string{"1.2.3", "v1.2.3", "1.2.3+build"}, []string{"1.2.4", "1.2.3-beta"}},
+		{"1.x", []string{"1.0.0", "1.9.9"}, []string{"0.9.0", "2.0.0", "1.5.0-beta"}},
+		{"1.2", []string{"1.2.0", "1.2.9"}, []string{"1.3.0", "1.1.9"}},
+		{">1.2.3", []string{"1.2.4", "2.0.0"}, []string{"1.2.3", "1.0.0"}},
+		{">1.2", []string{"1.3.0"}, []string{"1.2.9"}},
+		{"<=1.2", []string{"1.2.9", "1.0.0"}, []string{"1.3.0"}},
+		{">=1.0.0 <2.0.0", []string{"1.0.0", "1.9.0"}, []string{"2.0.0", "0.9.0", "2.0.0-rc.1"}},
+		{"~1.2.3", []string{"1.2.3", "1.2.9"}, []string{"1.3.0", "1.2.2"}},
+		{"^1.2.3", []string{"1.2.3", "1.9.0"}, []string{"2.0.0", "1.2.2"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{"1.x != 1.2.0", []string{"1.1.0", "1.3.0"}, []string{"1.2.0"}},
+		{"1.x || >=3.0.0", []string{"1.0.0", "3.1.0"}, []string{"2.0.0"}},
+		{"^1.3.0-beta", []string{"1.3.0-beta", "1.3.0-beta.2", "1.3.0", "1.4.0"}, []string{"1.3.0-alpha", "1.4.0-beta"}},
+	}
+	for _, test := range tests {
+		c, err := ParseVersionConstraint(test.constraint)
+		if err != nil {
+			t.Fatalf("%q: %v", test.constraint, err)
+		}
+		for _, v := range test.match {
+			if !c.Match(v) {
+				t.Errorf("%q doesn't match %s", test.constraint, v)
+			}
+		}
+		for _, v := range test.nomatch {
+			if c.Match(v) {
+				t.Errorf("%q matches %s", test.constraint, v)
+			}
+		}
+	}
+
+	for _, invalid := range []string{"1.2.3.4", "a.b", "~*", "!=1.x", ">=1.2.3-"} {
+		if _, err := ParseVersionConstraint(invalid); err == nil {
+			t.Errorf("%q parsed", invalid)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	ordered := []string{"latest", "0.9.0", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0", "1.2.0", "1.10.0"}
+	for i := 0; i < len(ordered)-1; i++ {
+		if compareVersions(ordered[i], ordered[i+1]) >= 0 {
+			t.Errorf("%s not lower than %s", ordered[i], ordered[i+1])
+		}
+	}
+}
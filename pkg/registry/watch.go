@@ -0,0 +1,210 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"airman.com/airfk/pkg/event"
+)
+
+// WatchRetryInterval is the delay before a failed watch reconnects.
+var WatchRetryInterval = time.Second
+
+// EventType is the kind of a registry change.
+type EventType int
+
+const (
+	EventAdd EventType = iota
+	EventUpdate
+	EventRemove
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventAdd:
+		return "add"
+	case EventUpdate:
+		return "update"
+	case EventRemove:
+		return "remove"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a change of a node of a watched service.
+type Event struct {
+	Type    EventType
+	Service string // service name
+	Version string
+	Node    *Node
+}
+
+// Watcher is implemented by registries that can stream service changes.
+type Watcher interface {
+	// Watch delivers the changes of the nodes registered under name on ch.
+	// The currently registered nodes are delivered as EventAdd first. Watching
+	// reconnects after failures and continues with the events needed to bring
+	// the receiver up to date.
+	Watch(name string, ch chan<- *Event) (event.Subscription, error)
+}
+
+var (
+	_ Watcher = (*ConsulRegistry)(nil)
+	_ Watcher = (*DNSRegistry)(nil)
+	_ Watcher = (*EtcdRegistry)(nil)
+	_ Watcher = (*MemoryRegistry)(nil)
+)
+
+// subLoop is the lifecycle of a subscription fed by a goroutine.
+type subLoop struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	unsubOnce sync.Once
+	err       chan error
+	done      chan struct{}
+}
+
+func newSubLoop() subLoop {
+	ctx, cancel := context.WithCancel(context.Background())
+	return subLoop{
+		ctx:    ctx,
+		cancel: cancel,
+		err:    make(chan error, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+func (l *subLoop) Unsubscribe() {
+	l.unsubOnce.Do(l.cancel)
+	<-l.done
+}
+
+func (l *subLoop) Err() <-chan error {
+	return l.err
+}
+
+// exit ends the subscription, it must be called when the goroutine returns.
+func (l *subLoop) exit() {
+	close(l.err)
+	close(l.done)
+}
+
+// wait sleeps before a reconnection. It returns false if the subscription
+// was unsubscribed.
+func (l *subLoop) wait() bool {
+	return retryWait(l.ctx)
+}
+
+// retryWait sleeps for WatchRetryInterval. It returns false if ctx is done
+// first.
+func retryWait(ctx context.Context) bool {
+	timer := time.NewTimer(WatchRetryInterval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// watch is the subscription returned by Watch. It keeps the last known state
+// of the nodes so full snapshots can be turned into changes.
+type watch struct {
+	subLoop
+	name  string
+	ch    chan<- *Event
+	nodes map[string]*Event // node id -> last add or update
+}
+
+func newWatch(name string, ch chan<- *Event) *watch {
+	return &watch{
+		subLoop: newSubLoop(),
+		name:    name,
+		ch:      ch,
+		nodes:   make(map[string]*Event),
+	}
+}
+
+func (w *watch) send(ev *Event) bool {
+	select {
+	case w.ch <- ev:
+		return true
+	case <-w.ctx.Done():
+		return false
+	}
+}
+
+// put delivers an add or update event for node unless it is unchanged.
+func (w *watch) put(version string, node *Node) bool {
+	ev := &Event{Type: EventAdd, Service: w.name, Version: version, Node: node}
+	if old, ok := w.nodes[node.Id]; ok {
+		if sameNode(old, ev) {
+			return true
+		}
+		ev.Type = EventUpdate
+	}
+	w.nodes[node.Id] = ev
+	return w.send(ev)
+}
+
+// remove delivers a remove event for the node with the given id if it is known.
+func (w *watch) remove(id string) bool {
+	old, ok := w.nodes[id]
+	if !ok {
+		return true
+	}
+	delete(w.nodes, id)
+	return w.send(&Event{Type: EventRemove, Service: w.name, Version: old.Version, Node: old.Node})
+}
+
+// sync delivers the changes between the known state and a full snapshot.
+// It returns false if the watch was unsubscribed.
+func (w *watch) sync(services []*Service) bool {
+	seen := make(map[string]bool)
+	for _, svc := range services {
+		for _, node := range svc.Nodes {
+			seen[node.Id] = true
+			if !w.put(svc.Version, node) {
+				return false
+			}
+		}
+	}
+	var gone []string
+	for id := range w.nodes {
+		if !seen[id] {
+			gone = append(gone, id)
+		}
+	}
+	sort.Strings(gone)
+	for _, id := range gone {
+		if !w.remove(id) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameNode(a, b *Event) bool {
+	return a.Version == b.Version && reflect.DeepEqual(a.Node, b.Node)
+}
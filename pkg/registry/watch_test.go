@@ -0,0 +1,249 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+func expectEvent(t *testing.T, ch <-chan *Event, typ EventType, host string) *Event {
+	select {
+	case ev := <-ch:
+		if ev.Type != typ || ev.Node.Host != host {
+			t.Fatalf("got %s event for %s, want %s for %s", ev.Type, ev.Node.Host, typ, host)
+		}
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for %s event for %s", typ, host)
+	}
+	return nil
+}
+
+func expectNoEvent(t *testing.T, ch <-chan *Event) {
+	select {
+	case ev := <-ch:
+		t.Fatalf("unexpected %s event for %s", ev.Type, ev.Node.Host)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryWatch(t *testing.T) {
+	r := NewMemoryRegistry()
+	a := NewService("task", "1.0.0", "10.0.0.1", 8080)
+	r.Register(a)
+
+	ch := make(chan *Event)
+	sub, err := r.Watch("task", ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	expectEvent(t, ch, EventAdd, "10.0.0.1")
+
+	b := NewService("task", "1.0.0", "10.0.0.2", 8080)
+	r.RegisterWithTTL(b, 100*time.Millisecond)
+	expectEvent(t, ch, EventAdd, "10.0.0.2")
+
+	// same node id with a new version
+	a2 := NewService("task", "1.1.0", "10.0.0.1", 8080)
+	a2.Nodes[0].Id = a.GetId()
+	r.Register(a2)
+	if ev := expectEvent(t, ch, EventUpdate, "10.0.0.1"); ev.Version != "1.1.0" {
+		t.Fatalf("update has version %s", ev.Version)
+	}
+	// refreshing without changes is not an event
+	r.Register(a2)
+	expectNoEvent(t, ch)
+
+	r.Deregister(a2)
+	expectEvent(t, ch, EventRemove, "10.0.0.1")
+	expectEvent(t, ch, EventRemove, "10.0.0.2") // expired
+
+	sub.Unsubscribe()
+	if _, ok := <-sub.Err(); ok {
+		t.Error("error channel not closed after unsubscribe")
+	}
+}
+
+// fakeConsul serves the health endpoint of the consul HTTP API with
+// blocking query support.
+type fakeConsul struct {
+	mu      sync.Mutex
+	index   uint64
+	entries []*consul.ServiceEntry
+	changed chan struct{}
+	fail    int    // number of requests to fail
+	dc      string // datacenter of the last request
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{index: 1, changed: make(chan struct{})}
+}
+
+func (f *fakeConsul) set(entries ...*consul.ServiceEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries = entries
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/v1/health/service/") {
+		http.NotFound(w, r)
+		return
+	}
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+
+	f.mu.Lock()
+	f.dc = r.URL.Query().Get("dc")
+	if f.fail > 0 {
+		f.fail--
+		f.mu.Unlock()
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+	if index >= f.index {
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		case <-time.After(time.Second):
+		}
+		f.mu.Lock()
+	}
+	entries, current := f.entries, f.index
+	f.mu.Unlock()
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(current, 10))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func consulEntry(id, host string, port int, version string) *consul.ServiceEntry {
+	return &consul.ServiceEntry{
+		Node: &consul.Node{Address: host},
+		Service: &consul.AgentService{
+			ID:      id,
+			Service: "task",
+			Tags:    []string{"a-service", "v-" + version},
+			Address: host,
+			Port:    port,
+		},
+		Checks: consul.HealthChecks{{Status: "passing"}},
+	}
+}
+
+func TestConsulWatch(t *testing.T) {
+	defer func(d time.Duration) { WatchRetryInterval = d }(WatchRetryInterval)
+	WatchRetryInterval = 10 * time.Millisecond
+
+	fake := newFakeConsul()
+	fake.entries = []*consul.ServiceEntry{consulEntry("a", "10.0.0.1", 8080, "1.0.0")}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	r, err := NewConsulRegistry(srv.Listener.Addr().String(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan *Event, 10)
+	sub, err := r.Watch("task", ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+	expectEvent(t, ch, EventAdd, "10.0.0.1")
+
+	fake.set(consulEntry("a", "10.0.0.1", 8080, "1.0.0"), consulEntry("b", "10.0.0.2", 8080, "1.0.0"))
+	expectEvent(t, ch, EventAdd, "10.0.0.2")
+
+	// The watch reconnects after failures and catches up on missed changes.
+	fake.mu.Lock()
+	fake.fail = 2
+	fake.mu.Unlock()
+	fake.set(consulEntry("b", "10.0.0.2", 9090, "1.0.0"))
+	expectEvent(t, ch, EventUpdate, "10.0.0.2")
+	expectEvent(t, ch, EventRemove, "10.0.0.1")
+
+	// critical nodes are removed
+	critical := consulEntry("b", "10.0.0.2", 9090, "1.0.0")
+	critical.Checks[0].Status = "critical"
+	fake.set(critical)
+	expectEvent(t, ch, EventRemove, "10.0.0.2")
+	expectNoEvent(t, ch)
+
+	done := make(chan struct{})
+	go func() {
+		sub.Unsubscribe()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Unsubscribe blocked on a pending blocking query")
+	}
+}
+
+func TestConsulNamespace(t *testing.T) {
+	fake := newFakeConsul()
+	staged := consulEntry("b", "10.0.0.2", 8080, "1.1.0")
+	staged.Service.Tags = append(staged.Service.Tags, "ns-staging")
+	fake.entries = []*consul.ServiceEntry{consulEntry("a", "10.0.0.1", 8080, "1.0.0"), staged}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	for _, c := range []struct {
+		opts Options
+		host string
+	}{
+		{Options{}, "10.0.0.1"},
+		{Options{Namespace: "staging", Datacenter: "eu-west"}, "10.0.0.2"},
+	} {
+		r, err := NewConsulRegistryWithOptions(srv.Listener.Addr().String(), 0, c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss, err := r.GetService("task", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ss) != 1 || len(ss[0].Nodes) != 1 || ss[0].Nodes[0].Host != c.host {
+			t.Fatalf("namespace %q: unexpected services %v", c.opts.Namespace, ss)
+		}
+		fake.mu.Lock()
+		dc := fake.dc
+		fake.mu.Unlock()
+		if dc != c.opts.Datacenter {
+			t.Fatalf("queried datacenter %q, want %q", dc, c.opts.Datacenter)
+		}
+		if tags := r.tags(NewService("task", "1.0.0", "", 0)); c.opts.Namespace != "" && !hasTag(tags, "ns-staging") {
+			t.Fatalf("registration tags %v lack the namespace", tags)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+	log "github.com/sirupsen/logrus"
+)
+
+// zkConn is the part of *zk.Conn used by the registry.
+type zkConn interface {
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Children(path string) ([]string, *zk.Stat, error)
+	Get(path string) ([]byte, *zk.Stat, error)
+	Delete(path string, version int32) error
+	Exists(path string) (bool, *zk.Stat, error)
+	Close()
+}
+
+// zkRegistration is a node registered by this registry.
+type zkRegistration struct {
+	service *Service
+	path    string // path of the ephemeral znode
+}
+
+// zookeeper registry
+//
+// Every node is stored as an ephemeral sequential znode under /<prefix>/<name>,
+// so it disappears together with the session that registered it. When the
+// session expires, the registry registers its nodes again on the new session.
+// ZooKeeper has no per-node TTL, the TTL of RegisterWithTTL is ignored.
+type ZookeeperRegistry struct {
+	servers []string
+	root    string // nodes are stored below root
+	opts    Options
+	conn    zkConn
+
+	mu         sync.Mutex
+	registered map[string]*zkRegistration // node id -> registration
+
+	closeOnce sync.Once
+	quit      chan struct{}
+	wg        sync.WaitGroup
+}
+
+func NewZookeeperRegistry(servers []string, timeout time.Duration) (*ZookeeperRegistry, error) {
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:2181"}
+	}
+	conn, events, err := zk.Connect(servers, timeout, zk.WithLogger(log.StandardLogger()))
+	if err != nil {
+		return nil, err
+	}
+	return newZookeeperRegistry(servers, conn, events), nil
+}
+
+// NewZookeeperRegistryWithOptions creates a zookeeper registry storing its
+// nodes below the prefix and namespace of opts.
+func NewZookeeperRegistryWithOptions(servers []string, timeout time.Duration, opts Options) (*ZookeeperRegistry, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	z, err := NewZookeeperRegistry(servers, timeout)
+	if err != nil {
+		return nil, err
+	}
+	z.root = opts.root()
+	z.opts = opts
+	return z, nil
+}
+
+// Options returns the options the registry was created with.
+func (z *ZookeeperRegistry) Options() Options {
+	return z.opts
+}
+
+func newZookeeperRegistry(servers []string, conn zkConn, events <-chan zk.Event) *ZookeeperRegistry {
+	z := &ZookeeperRegistry{
+		servers:    servers,
+		root:       Options{}.root(),
+		conn:       conn,
+		registered: make(map[string]*zkRegistration),
+		quit:       make(chan struct{}),
+	}
+	z.wg.Add(1)
+	go z.watchSession(events)
+	return z
+}
+
+// watchSession registers the nodes again after the session expired.
+func (z *ZookeeperRegistry) watchSession(events <-chan zk.Event) {
+	defer z.wg.Done()
+
+	expired := false
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			switch ev.State {
+			case zk.StateExpired:
+				log.Warnf("zookeeper session expired")
+				expired = true
+			case zk.StateHasSession:
+				if expired {
+					expired = false
+					z.reregister()
+				}
+			}
+		case <-z.quit:
+			return
+		}
+	}
+}
+
+func (z *ZookeeperRegistry) reregister() {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	for id, reg := range z.registered {
+		p, err := z.create(reg.service)
+		if err != nil {
+			log.Errorf("zookeeper re-register %s failed: %v", id, err)
+			continue
+		}
+		reg.path = p
+		log.Infof("zookeeper re-registered %s at %s", id, p)
+	}
+}
+
+func (z *ZookeeperRegistry) servicePath(name string) string {
+	return z.root + "/" + name
+}
+
+// ensurePath creates the persistent znodes of p that don't exist.
+func (z *ZookeeperRegistry) ensurePath(p string) error {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	for i := range parts {
+		cur := "/" + strings.Join(parts[:i+1], "/")
+		if _, err := z.conn.Create(cur, nil, 0, zk.WorldACL(zk.PermAll)); err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// create stores the first node of s in a new ephemeral sequential znode.
+func (z *ZookeeperRegistry) create(s *Service) (string, error) {
+	data, err := json.Marshal(newNodeRecord(s))
+	if err != nil {
+		return "", err
+	}
+	parent := z.servicePath(s.Name)
+	if err := z.ensurePath(parent); err != nil {
+		return "", err
+	}
+	return z.conn.Create(parent+"/node-", data, zk.FlagEphemeral|zk.FlagSequence, zk.WorldACL(zk.PermAll))
+}
+
+func (z *ZookeeperRegistry) Register(s *Service) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
+	}
+	node := s.Nodes[0]
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	// refresh
+	if reg, ok := z.registered[node.Id]; ok {
+		if exists, _, err := z.conn.Exists(reg.path); err == nil && exists {
+			reg.service = s
+			return nil
+		}
+	}
+	p, err := z.create(s)
+	if err != nil {
+		log.Errorf("zookeeper register %s failed: %v", node.Id, err)
+		return err
+	}
+	z.registered[node.Id] = &zkRegistration{service: s, path: p}
+	return nil
+}
+
+func (z *ZookeeperRegistry) RegisterWithTTL(s *Service, timeTTL time.Duration) error {
+	return z.Register(s)
+}
+
+func (z *ZookeeperRegistry) Deregister(s *Service) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("require at least one node")
+	}
+	node := s.Nodes[0]
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	reg, ok := z.registered[node.Id]
+	if !ok {
+		return nil
+	}
+	delete(z.registered, node.Id)
+	if err := z.conn.Delete(reg.path, -1); err != nil && err != zk.ErrNoNode {
+		log.Errorf("zookeeper delete %s failed: %v", reg.path, err)
+		return err
+	}
+	return nil
+}
+
+func (z *ZookeeperRegistry) GetService(name, tag string) ([]*Service, error) {
+	if name == "" {
+		return nil, ErrNilKey
+	}
+	parent := z.servicePath(name)
+	children, _, err := z.conn.Children(parent)
+	if err == zk.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(children)
+
+	serviceMap := map[string]*Service{}
+	var versions []string
+	for _, child := range children {
+		if !isZkNode(child) {
+			// a namespace below the root
+			continue
+		}
+		data, _, err := z.conn.Get(path.Join(parent, child))
+		if err == zk.ErrNoNode {
+			// removed in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var nd nodeRecord
+		if err := json.Unmarshal(data, &nd); err != nil {
+			log.Warnf("zookeeper node %s/%s has invalid data: %v", parent, child, err)
+			continue
+		}
+		if tag != "" && !hasTag(nd.Tags, tag) {
+			continue
+		}
+		svc, ok := serviceMap[nd.Version]
+		if !ok {
+			svc = &Service{
+				Name:    name,
+				Version: nd.Version,
+				Tags:    nd.Tags,
+			}
+			serviceMap[nd.Version] = svc
+			versions = append(versions, nd.Version)
+		}
+		svc.Nodes = append(svc.Nodes, nd.node())
+	}
+
+	sort.Strings(versions)
+	services := make([]*Service, 0, len(versions))
+	for _, version := range versions {
+		services = append(services, serviceMap[version])
+	}
+	return services, nil
+}
+
+func (z *ZookeeperRegistry) ListServices() ([]*Service, error) {
+	children, _, err := z.conn.Children(z.root)
+	if err == zk.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(children)
+
+	services := make([]*Service, 0, len(children))
+	for _, name := range children {
+		// skip namespaces and services without nodes
+		nodes, _, err := z.conn.Children(z.servicePath(name))
+		if err != nil && err != zk.ErrNoNode {
+			return nil, err
+		}
+		for _, node := range nodes {
+			if isZkNode(node) {
+				services = append(services, &Service{Name: name})
+				break
+			}
+		}
+	}
+	return services, nil
+}
+
+// isZkNode reports whether the znode name is that of a registered node.
+func isZkNode(name string) bool {
+	return strings.HasPrefix(name, "node-")
+}
+
+func (z *ZookeeperRegistry) Close() error {
+	z.closeOnce.Do(func() {
+		close(z.quit)
+		z.conn.Close()
+		z.wg.Wait()
+	})
+	return nil
+}
@@ -0,0 +1,268 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package registry
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// fakeZK is an in-process stand-in for a ZooKeeper server with a single
+// client session. It implements the znode semantics used by the registry:
+// persistent and ephemeral sequential nodes and session expiry.
+type fakeZK struct {
+	mu      sync.Mutex
+	nodes   map[string]*fakeZNode
+	seq     map[string]int // parent -> next sequence number
+	session int64
+	events  chan zk.Event
+	closed  bool
+}
+
+type fakeZNode struct {
+	data  []byte
+	owner int64 // session of an ephemeral node, 0 for persistent ones
+}
+
+func newFakeZK() *fakeZK {
+	return &fakeZK{
+		nodes:   map[string]*fakeZNode{"/": {}},
+		seq:     make(map[string]int),
+		session: 1,
+		events:  make(chan zk.Event, 10),
+	}
+}
+
+func (f *fakeZK) Create(p string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return "", zk.ErrClosing
+	}
+	parent := path.Dir(p)
+	if _, ok := f.nodes[parent]; !ok {
+		return "", zk.ErrNoNode
+	}
+	if flags&zk.FlagSequence != 0 {
+		p = fmt.Sprintf("%s%010d", p, f.seq[parent])
+		f.seq[parent]++
+	}
+	if _, ok := f.nodes[p]; ok {
+		return "", zk.ErrNodeExists
+	}
+	node := &fakeZNode{data: data}
+	if flags&zk.FlagEphemeral != 0 {
+		node.owner = f.session
+	}
+	f.nodes[p] = node
+	return p, nil
+}
+
+func (f *fakeZK) Children(p string) ([]string, *zk.Stat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.nodes[p]; !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	var children []string
+	for np := range f.nodes {
+		if np != "/" && path.Dir(np) == p {
+			children = append(children, path.Base(np))
+		}
+	}
+	sort.Strings(children)
+	return children, &zk.Stat{NumChildren: int32(len(children))}, nil
+}
+
+func (f *fakeZK) Get(p string) ([]byte, *zk.Stat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	node, ok := f.nodes[p]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	return node.data, &zk.Stat{EphemeralOwner: node.owner}, nil
+}
+
+func (f *fakeZK) Delete(p string, version int32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.nodes[p]; !ok {
+		return zk.ErrNoNode
+	}
+	for np := range f.nodes {
+		if strings.HasPrefix(np, p+"/") {
+			return zk.ErrNotEmpty
+		}
+	}
+	delete(f.nodes, p)
+	return nil
+}
+
+func (f *fakeZK) Exists(p string) (bool, *zk.Stat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.nodes[p]
+	return ok, nil, nil
+}
+
+func (f *fakeZK) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+}
+
+// expire ends the session, removing its ephemeral nodes, and starts a new one.
+func (f *fakeZK) expire() {
+	f.mu.Lock()
+	for p, node := range f.nodes {
+		if node.owner == f.session {
+			delete(f.nodes, p)
+		}
+	}
+	f.session++
+	f.mu.Unlock()
+
+	f.events <- zk.Event{Type: zk.EventSession, State: zk.StateExpired}
+	f.events <- zk.Event{Type: zk.EventSession, State: zk.StateHasSession}
+}
+
+func (f *fakeZK) count(parent string) int {
+	children, _, _ := f.Children(parent)
+	return len(children)
+}
+
+func TestZookeeperRegister(t *testing.T) {
+	fake := newFakeZK()
+	z := newZookeeperRegistry(nil, fake, fake.events)
+	defer z.Close()
+
+	v1 := newMetaService()
+	v2 := NewService("task", "2.0.0", "10.0.0.2", 8080)
+	for _, s := range []*Service{v1, v2} {
+		if err := z.Register(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// registering again refreshes instead of creating another znode
+	if err := z.Register(v1); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.count("/airman/task"); n != 2 {
+		t.Fatalf("got %d znodes, want 2", n)
+	}
+
+	ss, err := z.GetService("task", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 2 || ss[0].Version != "1.0.0" || ss[0].Nodes[0].Host != "10.0.0.1" || ss[1].Nodes[0].Port != 8080 {
+		t.Fatalf("unexpected services: %#v", ss)
+	}
+	if ss, _ := z.GetService("task", "v-2.0.0"); len(ss) != 1 || ss[0].Nodes[0].Id != v2.GetId() {
+		t.Fatalf("tag query returned %#v", ss)
+	}
+	if ss, _ := z.GetService("task", "v-1.0.0"); len(ss) != 1 || ss[0].Nodes[0].Weight != 10 || ss[0].Nodes[0].Metadata["region"] != "east" {
+		t.Fatalf("node metadata not stored: %#v", ss[0].Nodes[0])
+	}
+	if ss, err := z.GetService("unknown", ""); err != nil || len(ss) != 0 {
+		t.Fatalf("unknown service returned %v %v", ss, err)
+	}
+	if list, _ := z.ListServices(); len(list) != 1 || list[0].Name != "task" {
+		t.Fatalf("unexpected service list: %#v", list)
+	}
+
+	if err := z.Deregister(v1); err != nil {
+		t.Fatal(err)
+	}
+	if ss, _ := z.GetService("task", ""); len(ss) != 1 || ss[0].Version != "2.0.0" {
+		t.Fatalf("got %#v after deregister", ss)
+	}
+}
+
+func TestZookeeperSessionExpiry(t *testing.T) {
+	fake := newFakeZK()
+	z := newZookeeperRegistry(nil, fake, fake.events)
+	defer z.Close()
+
+	s := NewService("task", "1.0.0", "10.0.0.1", 8080)
+	if err := z.Register(s); err != nil {
+		t.Fatal(err)
+	}
+	fake.expire()
+
+	deadline := time.Now().Add(time.Second)
+	for fake.count("/airman/task") != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("node not registered again after session expiry")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	ss, err := z.GetService("task", "")
+	if err != nil || len(ss) != 1 || ss[0].Nodes[0].Id != s.GetId() {
+		t.Fatalf("got %#v %v after re-registration", ss, err)
+	}
+	// the new znode is owned by the new session and can be deregistered
+	if err := z.Deregister(s); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.count("/airman/task"); n != 0 {
+		t.Fatalf("got %d znodes after deregister", n)
+	}
+}
+
+func TestZookeeperNamespace(t *testing.T) {
+	fake := newFakeZK()
+	prod := newZookeeperRegistry(nil, fake, fake.events)
+	defer prod.Close()
+	staging := newZookeeperRegistry(nil, fake, nil)
+	staging.root = Options{Namespace: "staging"}.root()
+	defer staging.Close()
+
+	if err := prod.Register(NewService("task", "1.0.0", "10.0.0.1", 8080)); err != nil {
+		t.Fatal(err)
+	}
+	if err := staging.Register(NewService("task", "1.1.0", "10.0.0.2", 8080)); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.count("/airman/staging/task"); n != 1 {
+		t.Fatalf("got %d staging znodes, want 1", n)
+	}
+	for _, c := range []struct {
+		z    *ZookeeperRegistry
+		host string
+	}{{prod, "10.0.0.1"}, {staging, "10.0.0.2"}} {
+		ss, err := c.z.GetService("task", "")
+		if err != nil || len(ss) != 1 || ss[0].Nodes[0].Host != c.host {
+			t.Fatalf("%s: unexpected services %v %v", c.z.root, ss, err)
+		}
+		if list, _ := c.z.ListServices(); len(list) != 1 || list[0].Name != "task" {
+			t.Fatalf("%s: unexpected service list %v", c.z.root, list)
+		}
+	}
+}
@@ -25,21 +25,16 @@ import (
 
 // StartHTTPEndpoint starts the HTTP RPC endpoint, configured with cors/vhosts/modules
 func StartHTTPEndpoint(endpoint string, apis []ts.API, modules []string, cors []string) (net.Listener, *Server, error) {
-	// Generate the whitelist based on the allowed modules
-	whitelist := make(map[string]bool)
-	for _, module := range modules {
-		whitelist[module] = true
-	}
 	// Register all the APIs exposed by the services
 	handler := NewServer()
-	for _, api := range apis {
-		if whitelist[api.Namespace] || (len(whitelist) == 0 && api.Public) {
-			if err := handler.RegisterName(api.Namespace, api.Service); err != nil {
-				return nil, nil, err
-			}
-			log.Infof("HTTP registered namespace: %s", api.Namespace)
+	served := handler.servedAPIs(apis, modules)
+	for _, api := range served {
+		if err := handler.RegisterName(api.Namespace, api.Service); err != nil {
+			return nil, nil, err
 		}
+		log.Infof("HTTP registered namespace: %s", api.Namespace)
 	}
+	handler.modules = namespaces(served)
 	// All APIs registered, start the HTTP listener
 	var (
 		listener net.Listener
@@ -54,22 +49,22 @@ func StartHTTPEndpoint(endpoint string, apis []ts.API, modules []string, cors []
 
 // StartWSEndpoint starts a websocket endpoint
 func StartWSEndpoint(endpoint string, apis []ts.API, modules []string, wsOrigins []string) (net.Listener, *Server, error) {
+	return StartWSEndpointWithConfig(endpoint, apis, modules, wsOrigins, DefaultWSConfig)
+}
+
+// StartWSEndpointWithConfig starts a websocket endpoint with the given keepalive settings
+func StartWSEndpointWithConfig(endpoint string, apis []ts.API, modules []string, wsOrigins []string, config WSConfig) (net.Listener, *Server, error) {
 
-	// Generate the whitelist based on the allowed modules
-	whitelist := make(map[string]bool)
-	for _, module := range modules {
-		whitelist[module] = true
-	}
 	// Register all the APIs exposed by the services
 	handler := NewServer()
-	for _, api := range apis {
-		if whitelist[api.Namespace] || (len(whitelist) == 0 && api.Public) {
-			if err := handler.RegisterName(api.Namespace, api.Service); err != nil {
-				return nil, nil, err
-			}
-			log.Debug("WebSocket registered", "service", api.Service, "namespace", api.Namespace)
+	served := handler.servedAPIs(apis, modules)
+	for _, api := range served {
+		if err := handler.RegisterName(api.Namespace, api.Service); err != nil {
+			return nil, nil, err
 		}
+		log.Debug("WebSocket registered", "service", api.Service, "namespace", api.Namespace)
 	}
+	handler.modules = namespaces(served)
 	// All APIs registered, start the HTTP listener
 	var (
 		listener net.Listener
@@ -78,7 +73,69 @@ func StartWSEndpoint(endpoint string, apis []ts.API, modules []string, wsOrigins
 	if listener, err = net.Listen("tcp", endpoint); err != nil {
 		return nil, nil, err
 	}
-	go NewWSServer(wsOrigins, handler).Serve(listener)
+	go NewWSServerWithConfig(wsOrigins, config, handler).Serve(listener)
 	return listener, handler, err
 
 }
+
+// allowedAPIs returns the apis whitelisted by modules, or the public apis if
+// no modules are given.
+func allowedAPIs(apis []ts.API, modules []string) []ts.API {
+	whitelist := make(map[string]bool)
+	for _, module := range modules {
+		whitelist[module] = true
+	}
+	var allowed []ts.API
+	for _, api := range apis {
+		if whitelist[api.Namespace] || (len(whitelist) == 0 && api.Public) {
+			allowed = append(allowed, api)
+		}
+	}
+	return allowed
+}
+
+// servedAPIs returns the apis of srv allowed by modules. The admin api of srv
+// is among them only if modules list it explicitly.
+func (srv *Server) servedAPIs(apis []ts.API, modules []string) []ts.API {
+	return allowedAPIs(append(apis[:len(apis):len(apis)], srv.AdminAPI()), modules)
+}
+
+// namespaces returns the set of namespaces of apis.
+func namespaces(apis []ts.API) map[string]bool {
+	set := make(map[string]bool)
+	for _, api := range apis {
+		set[api.Namespace] = true
+	}
+	return set
+}
+
+// SetModules replaces the services of srv among apis with the ones
+// whitelisted by modules, following the rules of StartHTTPEndpoint. Services
+// registered with RegisterName outside of apis are kept, unless an earlier
+// whitelist served them. Running endpoints serve the new set from the next
+// request on, e.g. after the HTTP modules changed in the configuration store.
+func (srv *Server) SetModules(apis []ts.API, modules []string) error {
+	served := srv.servedAPIs(apis, modules)
+
+	srv.servicesMu.Lock()
+	defer srv.servicesMu.Unlock()
+
+	managed := namespaces(apis)
+	for name := range srv.modules {
+		managed[name] = true
+	}
+	services := make(ServiceRegistry)
+	for name, svc := range srv.Services {
+		if !managed[name] || name == MetadataApi {
+			services[name] = svc
+		}
+	}
+	for _, api := range served {
+		if err := services.register(api.Namespace, api.Service); err != nil {
+			return err
+		}
+	}
+	srv.Services, srv.modules = services, namespaces(served)
+	log.Infof("RPC modules set to %v", modules)
+	return nil
+}
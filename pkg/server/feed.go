@@ -0,0 +1,116 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"reflect"
+
+	"airman.com/airfk/pkg/event"
+)
+
+// ErrSubscriptionSourceClosed is sent on Err() when the event source of a
+// subscription created by SubscribeFeed ends.
+var ErrSubscriptionSourceClosed = errors.New("subscription source closed")
+
+// FeedFilter decides whether a value received from an event source is sent to
+// the client and may transform it. Subscription callbacks usually build the
+// filter as a closure over their parameters.
+type FeedFilter func(value interface{}) (interface{}, bool)
+
+// SubscribeFeed creates a subscription that forwards every value sent on feed
+// to the client. channel must be a bidirectional channel of the feed's element
+// type, it is owned by the subscription afterwards. filter is optional.
+//
+// Teardown is handled on both sides: the feed subscription is cancelled when the
+// client unsubscribes or the connection is closed, and the RPC subscription is
+// terminated with ErrSubscriptionSourceClosed when the feed subscription ends.
+func SubscribeFeed(ctx context.Context, feed *event.Feed, channel interface{}, filter FeedFilter) (*Subscription, error) {
+	return SubscribeEvents(ctx, feed.Subscribe, channel, filter)
+}
+
+// SubscribeEvents is like SubscribeFeed for any event source, subscribe is
+// called once with channel, e.g. a method that tracks the subscription in an
+// event.SubscriptionScope.
+func SubscribeEvents(ctx context.Context, subscribe func(channel interface{}) event.Subscription, channel interface{}, filter FeedFilter) (*Subscription, error) {
+	notifier, supported := NotifierFromContext(ctx)
+	if !supported {
+		return nil, ErrNotificationsUnsupported
+	}
+	chanval := reflect.ValueOf(channel)
+	if chanval.Kind() != reflect.Chan || chanval.Type().ChanDir() != reflect.BothDir {
+		return nil, errors.New("event channel must be a bidirectional channel")
+	}
+
+	eventSub := subscribe(channel)
+	if eventSub == nil {
+		return nil, ErrSubscriptionSourceClosed
+	}
+	rpcSub := notifier.CreateSubscription()
+
+	go forwardEvents(notifier, rpcSub, eventSub, chanval, filter)
+	return rpcSub, nil
+}
+
+// forwardEvents delivers the values received on chanval to the client until
+// either side of the subscription ends.
+func forwardEvents(notifier *Notifier, rpcSub *Subscription, eventSub event.Subscription, chanval reflect.Value, filter FeedFilter) {
+	defer eventSub.Unsubscribe()
+
+	const (
+		valueCase = iota
+		unsubscribeCase
+		closedCase
+		sourceCase
+	)
+	cases := []reflect.SelectCase{
+		valueCase:       {Dir: reflect.SelectRecv, Chan: chanval},
+		unsubscribeCase: {Dir: reflect.SelectRecv, Chan: reflect.ValueOf(rpcSub.Err())},
+		closedCase:      {Dir: reflect.SelectRecv, Chan: reflect.ValueOf(notifier.Closed())},
+		sourceCase:      {Dir: reflect.SelectRecv, Chan: reflect.ValueOf(eventSub.Err())},
+	}
+	for {
+		chosen, recv, ok := reflect.Select(cases)
+		switch chosen {
+		case valueCase:
+			if !ok {
+				notifier.terminate(rpcSub, ErrSubscriptionSourceClosed)
+				return
+			}
+			value := recv.Interface()
+			if filter != nil {
+				var keep bool
+				if value, keep = filter(value); !keep {
+					continue
+				}
+			}
+			if err := notifier.Notify(rpcSub.ID, value); err != nil {
+				return
+			}
+		case unsubscribeCase, closedCase:
+			return
+		case sourceCase:
+			err := ErrSubscriptionSourceClosed
+			if ok {
+				err = recv.Interface().(error)
+			}
+			notifier.terminate(rpcSub, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"airman.com/airfk/pkg/codec"
+	"airman.com/airfk/pkg/event"
+)
+
+type FeedTestService struct {
+	feed  event.Feed
+	scope event.SubscriptionScope
+}
+
+func (s *FeedTestService) Values(ctx context.Context, min int) (*Subscription, error) {
+	filter := func(value interface{}) (interface{}, bool) {
+		v := value.(int)
+		return v * 10, v >= min
+	}
+	subscribe := func(ch interface{}) event.Subscription {
+		return s.scope.Track(s.feed.Subscribe(ch))
+	}
+	return SubscribeEvents(ctx, subscribe, make(chan int, 16), filter)
+}
+
+func (s *FeedTestService) All(ctx context.Context) (*Subscription, error) {
+	return SubscribeFeed(ctx, &s.feed, make(chan int, 16), nil)
+}
+
+func newFeedTestServer(t *testing.T) (*Server, *FeedTestService, net.Conn, *json.Encoder, *json.Decoder) {
+	server := NewServer()
+	service := new(FeedTestService)
+	if err := server.RegisterName("feed", service); err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	go server.ServeCodec(codec.NewJSONCodec(serverConn), OptionMethodInvocation|OptionSubscriptions)
+	return server, service, clientConn, json.NewEncoder(clientConn), json.NewDecoder(clientConn)
+}
+
+func TestSubscribeFeedFilter(t *testing.T) {
+	server, service, conn, out, in := newFeedTestServer(t)
+	defer server.Stop()
+	defer conn.Close()
+
+	resp := rpcCall(t, out, in, "feed_subscribe", "values", 3)
+	subid, ok := resp["result"].(string)
+	if !ok {
+		t.Fatalf("subscription failed: %v", resp)
+	}
+	waitFor(t, "activation", func() bool { return len(server.Subscriptions()) == 1 })
+
+	for i := 0; i < 6; i++ {
+		service.feed.Send(i)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []float64{30, 40, 50} {
+		var notification codec.JsonNotification
+		if err := in.Decode(&notification); err != nil {
+			t.Fatal(err)
+		}
+		if notification.Params.Subscription != subid || notification.Params.Result != want {
+			t.Fatalf("unexpected notification %+v, want %v", notification.Params, want)
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// Unsubscribing on the RPC side cancels the feed subscription.
+	if resp := rpcCall(t, out, in, "feed_unsubscribe", subid); resp["result"] != true {
+		t.Fatalf("unsubscribe failed: %v", resp)
+	}
+	waitFor(t, "feed unsubscribe", func() bool { return service.scope.Count() == 0 })
+}
+
+func TestSubscribeFeedSourceClosed(t *testing.T) {
+	server, service, conn, out, in := newFeedTestServer(t)
+	defer server.Stop()
+	defer conn.Close()
+
+	if resp := rpcCall(t, out, in, "feed_subscribe", "values", 0); resp["error"] != nil {
+		t.Fatalf("subscription failed: %v", resp)
+	}
+	waitFor(t, "activation", func() bool { return len(server.Subscriptions()) == 1 })
+
+	// Closing the event side terminates the RPC subscription.
+	service.scope.Close()
+	waitFor(t, "termination", func() bool { return len(server.Subscriptions()) == 0 })
+}
+
+func TestSubscribeFeedConnectionClosed(t *testing.T) {
+	server, service, conn, out, in := newFeedTestServer(t)
+	defer server.Stop()
+
+	if resp := rpcCall(t, out, in, "feed_subscribe", "all"); resp["error"] != nil {
+		t.Fatalf("subscription failed: %v", resp)
+	}
+	waitFor(t, "activation", func() bool { return len(server.Subscriptions()) == 1 })
+	conn.Close()
+
+	waitFor(t, "feed unsubscribe", func() bool { return service.feed.Send(1) == 0 })
+}
+
+func TestSubscribeFeedUnsupported(t *testing.T) {
+	var feed event.Feed
+	if _, err := SubscribeFeed(context.Background(), &feed, make(chan int), nil); err != ErrNotificationsUnsupported {
+		t.Fatalf("expected %v, got %v", ErrNotificationsUnsupported, err)
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"github.com/rs/cors"
 
 	cc "airman.com/airfk/pkg/codec"
+	"airman.com/airfk/pkg/health"
 )
 
 const (
@@ -50,9 +51,9 @@ func (t *httpReadWriteNopCloser) Close() error {
 // Deprecated: Server implements http.Handler
 func NewHTTPServer(cors []string, srv *Server) *http.Server {
 	// Wrap the CORS-handler within a host-handler
-	handler := newCorsHandler(srv, cors)
+	srv.SetHTTPOrigins(cors)
 	return &http.Server{
-		Handler:      handler,
+		Handler:      corsHandler{srv},
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
@@ -61,6 +62,9 @@ func NewHTTPServer(cors []string, srv *Server) *http.Server {
 
 // ServeHTTP serves JSON-RPC requests over HTTP.
 func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if srv.serveHealth(w, r) {
+		return
+	}
 	// Permit dumb empty requests for remote health-checks (AWS)
 	if r.Method == http.MethodGet && r.ContentLength == 0 && r.URL.RawQuery == "" {
 		return
@@ -85,6 +89,21 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	srv.ServeSingleRequest(ctx, codec, OptionMethodInvocation)
 }
 
+// serveHealth serves GET requests of the health paths and reports whether it
+// did. Without health checks the paths answer 200, so that the HTTP checks a
+// registry runs against an endpoint, a WebSocket one included, pass.
+func (srv *Server) serveHealth(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet || !health.IsHealthPath(r.URL.Path) {
+		return false
+	}
+	if srv.Health == nil {
+		w.WriteHeader(http.StatusOK)
+		return true
+	}
+	srv.Health.ServeHTTP(w, r)
+	return true
+}
+
 // validateRequest returns a non-zero response code and error message if the
 // request is invalid.
 func validateRequest(r *http.Request) (int, error) {
@@ -116,3 +135,27 @@ func newCorsHandler(srv *Server, allowedOrigins []string) http.Handler {
 	})
 	return c.Handler(srv)
 }
+
+// corsValue is stored in Server.cors, atomic.Value needs a consistent type.
+type corsValue struct {
+	handler http.Handler
+}
+
+// corsHandler serves through the CORS handler last set by SetHTTPOrigins.
+type corsHandler struct {
+	srv *Server
+}
+
+func (h corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if v, ok := h.srv.cors.Load().(corsValue); ok {
+		v.handler.ServeHTTP(w, r)
+		return
+	}
+	h.srv.ServeHTTP(w, r)
+}
+
+// SetHTTPOrigins replaces the CORS origins allowed by the HTTP server of
+// NewHTTPServer. An empty list disables CORS support.
+func (srv *Server) SetHTTPOrigins(origins []string) {
+	srv.cors.Store(corsValue{newCorsHandler(srv, origins)})
+}
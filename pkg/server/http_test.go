@@ -17,10 +17,14 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"airman.com/airfk/pkg/health"
 )
 
 func TestHTTPErrorResponseWithDelete(t *testing.T) {
@@ -52,3 +56,52 @@ func testHTTPErrorResponse(t *testing.T, method, contentType, body string, expec
 		t.Fatalf("response code should be %d not %d", expected, code)
 	}
 }
+
+func TestHTTPHealth(t *testing.T) {
+	srv := NewServer()
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://url.com"+path, nil))
+		return w.Code
+	}
+	// without health checks any GET passes
+	if code := get(health.ReadyPath); code != http.StatusOK {
+		t.Fatalf("got %d without health checks", code)
+	}
+
+	srv.Health = health.New(0)
+	srv.Health.AddReadinessCheck("db", health.CheckerFunc(func(ctx context.Context) error {
+		return errors.New("down")
+	}))
+	if code := get(health.ReadyPath); code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d for failing readiness", code)
+	}
+	if code := get(health.LivePath); code != http.StatusOK {
+		t.Fatalf("got %d for liveness", code)
+	}
+}
+
+func TestHTTPOrigins(t *testing.T) {
+	srv := NewServer()
+	handler := NewHTTPServer([]string{"http://a.com"}, srv).Handler
+	allowed := func(origin string) string {
+		body := `{"jsonrpc":"2.0","id":1,"method":"rpc_modules"}`
+		request := httptest.NewRequest(http.MethodPost, "http://url.com", strings.NewReader(body))
+		request.Header.Set("content-type", contentType)
+		request.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request)
+		return w.Header().Get("Access-Control-Allow-Origin")
+	}
+
+	if got := allowed("http://a.com"); got != "http://a.com" {
+		t.Fatalf("a.com allowed as %q", got)
+	}
+	srv.SetHTTPOrigins([]string{"http://b.com"})
+	if got := allowed("http://a.com"); got != "" {
+		t.Fatalf("a.com still allowed as %q", got)
+	}
+	if got := allowed("http://b.com"); got != "http://b.com" {
+		t.Fatalf("b.com allowed as %q", got)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"airman.com/airfk/pkg/common"
+	"airman.com/airfk/pkg/registry"
+	ts "airman.com/airfk/pkg/types"
+)
+
+// RegistrationConfig describes how an endpoint registers itself with a
+// service registry.
+type RegistrationConfig struct {
+	Registry           registry.Registry
+	Name               string // service name
+	Version            string
+	Host               string        // advertised host, defaults to the listening or the first non-loopback address
+	TTL                time.Duration // registration TTL kept alive by a heartbeat, 0 registers permanently
+	Weight             int
+	Zone               string
+	Metadata           map[string]string
+	DeregisterOnSignal bool // deregister on SIGINT and SIGTERM, see RegisterEndpoint
+}
+
+// registration is an endpoint registered by RegisterEndpoint.
+type registration struct {
+	registry  registry.Registry
+	service   *registry.Service
+	heartbeat *registry.Heartbeat
+	once      sync.Once
+	done      chan struct{}
+}
+
+// RegisterEndpoint registers the node serving protocol ("http" or "ws") on
+// listener and returns its service. TTL registrations are refreshed by a
+// heartbeat reporting the readiness of srv.Health if it is set. The node is
+// deregistered when srv is stopped.
+//
+// With DeregisterOnSignal the node is also deregistered when the process is
+// interrupted or terminated. The signal is raised again afterwards, so the
+// process ends as it would have, or the application handling the signal sees
+// it a second time.
+func RegisterEndpoint(srv *Server, listener net.Listener, protocol string, config RegistrationConfig) (*registry.Service, error) {
+	if config.Registry == nil || config.Name == "" {
+		return nil, errors.New("registration requires a registry and a service name")
+	}
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("can't register %s listener", listener.Addr().Network())
+	}
+	host := config.Host
+	if host == "" {
+		host = advertisedHost(addr.IP)
+	}
+
+	s := registry.NewServiceFor(config.Registry, config.Name, config.Version, host, addr.Port)
+	node := s.Nodes[0]
+	node.Weight = config.Weight
+	node.Zone = config.Zone
+	node.Metadata = config.Metadata
+	node.Endpoints = []registry.Endpoint{{
+		Protocol: protocol,
+		Address:  fmt.Sprintf("%s://%s", protocol, net.JoinHostPort(host, fmt.Sprint(addr.Port))),
+	}}
+
+	reg := &registration{registry: config.Registry, service: s, done: make(chan struct{})}
+	if config.TTL > 0 {
+		check := func() error {
+			if srv.Health == nil {
+				return nil
+			}
+			return srv.Health.Ready(context.Background()).Err()
+		}
+		hb, err := registry.StartHeartbeat(config.Registry, s, config.TTL, check)
+		if err != nil {
+			return nil, err
+		}
+		reg.heartbeat = hb
+	} else if err := config.Registry.Register(s); err != nil {
+		return nil, err
+	}
+	log.Infof("registered %s endpoint %s as %s", protocol, node.Endpoints[0].Address, node.Id)
+
+	srv.regMu.Lock()
+	srv.registrations = append(srv.registrations, reg)
+	srv.regMu.Unlock()
+	if config.DeregisterOnSignal {
+		go reg.deregisterOnSignal()
+	}
+	return s, nil
+}
+
+// deregister removes the node from the registry, it can be called repeatedly.
+func (reg *registration) deregister() {
+	reg.once.Do(func() {
+		close(reg.done)
+		var err error
+		if reg.heartbeat != nil {
+			err = reg.heartbeat.Stop()
+		} else {
+			err = reg.registry.Deregister(reg.service)
+		}
+		if err != nil {
+			log.Errorf("deregistering %s failed: %v", reg.service.GetId(), err)
+			return
+		}
+		log.Infof("deregistered %s", reg.service.GetId())
+	})
+}
+
+func (reg *registration) deregisterOnSignal() {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+
+	select {
+	case sig := <-sigc:
+		reg.deregister()
+		signal.Stop(sigc)
+		if p, err := os.FindProcess(os.Getpid()); err == nil {
+			p.Signal(sig)
+		}
+	case <-reg.done:
+	}
+}
+
+// deregisterAll removes the registrations of the endpoints served by srv.
+func (srv *Server) deregisterAll() {
+	srv.regMu.Lock()
+	regs := srv.registrations
+	srv.registrations = nil
+	srv.regMu.Unlock()
+
+	for _, reg := range regs {
+		reg.deregister()
+	}
+}
+
+// advertisedHost returns the host peers reach a listener bound to ip at.
+func advertisedHost(ip net.IP) string {
+	if ip != nil && !ip.IsUnspecified() {
+		return ip.String()
+	}
+	if addrs, err := common.GetLocalAddress(); err == nil && len(addrs) > 0 {
+		return addrs[0]
+	}
+	return "127.0.0.1"
+}
+
+// StartHTTPEndpointWithRegistration starts the HTTP RPC endpoint and registers
+// it, see RegisterEndpoint.
+func StartHTTPEndpointWithRegistration(endpoint string, apis []ts.API, modules []string, cors []string, config RegistrationConfig) (net.Listener, *Server, error) {
+	listener, handler, err := StartHTTPEndpoint(endpoint, apis, modules, cors)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := RegisterEndpoint(handler, listener, registry.ProtocolHTTP, config); err != nil {
+		listener.Close()
+		handler.Stop()
+		return nil, nil, err
+	}
+	return listener, handler, nil
+}
+
+// StartWSEndpointWithRegistration starts the websocket RPC endpoint and
+// registers it, see RegisterEndpoint.
+func StartWSEndpointWithRegistration(endpoint string, apis []ts.API, modules []string, wsOrigins []string, config RegistrationConfig) (net.Listener, *Server, error) {
+	listener, handler, err := StartWSEndpoint(endpoint, apis, modules, wsOrigins)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := RegisterEndpoint(handler, listener, registry.ProtocolWS, config); err != nil {
+		listener.Close()
+		handler.Stop()
+		return nil, nil, err
+	}
+	return listener, handler, nil
+}
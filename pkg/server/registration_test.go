@@ -0,0 +1,189 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"airman.com/airfk/pkg/health"
+	"airman.com/airfk/pkg/registry"
+)
+
+func registeredNodes(t *testing.T, r registry.Registry) []*registry.Node {
+	ss, err := r.GetService("task", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nodes []*registry.Node
+	for _, s := range ss {
+		nodes = append(nodes, s.Nodes...)
+	}
+	return nodes
+}
+
+func TestRegisterEndpoint(t *testing.T) {
+	r := registry.NewMemoryRegistry()
+	defer r.Close()
+
+	config := RegistrationConfig{Registry: r, Name: "task", Version: "1.0.0", Zone: "a"}
+	listener, srv, err := StartHTTPEndpointWithRegistration("127.0.0.1:0", nil, nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	wsListener, wsSrv, err := StartWSEndpointWithRegistration("127.0.0.1:0", nil, nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wsListener.Close()
+
+	nodes := registeredNodes(t, r)
+	if len(nodes) != 2 {
+		t.Fatalf("got %d nodes, want 2", len(nodes))
+	}
+	want := map[string]string{
+		protocolAddress(registry.ProtocolHTTP, listener): registry.ProtocolHTTP,
+		protocolAddress(registry.ProtocolWS, wsListener): registry.ProtocolWS,
+	}
+	for _, node := range nodes {
+		if node.Host != "127.0.0.1" || node.Zone != "a" || len(node.Endpoints) != 1 {
+			t.Fatalf("unexpected node %#v", node)
+		}
+		ep := node.Endpoints[0]
+		if want[ep.Address] != ep.Protocol {
+			t.Fatalf("unexpected endpoint %v, want one of %v", ep, want)
+		}
+	}
+
+	srv.Stop()
+	if nodes := registeredNodes(t, r); len(nodes) != 1 || nodes[0].Endpoints[0].Protocol != registry.ProtocolWS {
+		t.Fatalf("http node not deregistered on stop: %v", nodes)
+	}
+	wsSrv.Stop()
+	if nodes := registeredNodes(t, r); len(nodes) != 0 {
+		t.Fatalf("ws node not deregistered on stop: %v", nodes)
+	}
+}
+
+// protocolAddress returns the endpoint address registered for a listener.
+func protocolAddress(protocol string, listener net.Listener) string {
+	return fmt.Sprintf("%s://%s", protocol, listener.Addr())
+}
+
+func TestRegisterEndpointTTL(t *testing.T) {
+	defer func(d time.Duration) { registry.MinHeartbeatTTL = d }(registry.MinHeartbeatTTL)
+	registry.MinHeartbeatTTL = 0
+
+	r := registry.NewMemoryRegistry()
+	defer r.Close()
+
+	srv := NewServer()
+	var failing int32
+	srv.Health = health.New(0)
+	srv.Health.AddReadinessCheck("db", health.CheckerFunc(func(ctx context.Context) error {
+		if atomic.LoadInt32(&failing) == 1 {
+			return errors.New("down")
+		}
+		return nil
+	}))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	config := RegistrationConfig{Registry: r, Name: "task", TTL: 60 * time.Millisecond}
+	if _, err := RegisterEndpoint(srv, listener, registry.ProtocolHTTP, config); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if nodes := registeredNodes(t, r); len(nodes) != 1 {
+		t.Fatal("registration expired while healthy")
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(registeredNodes(t, r)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("unready node still registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	srv.Stop()
+	time.Sleep(100 * time.Millisecond)
+	if nodes := registeredNodes(t, r); len(nodes) != 0 {
+		t.Fatalf("node registered after stop: %v", nodes)
+	}
+}
+
+// Registries like consul check a registered node by a GET of its readiness
+// path, which WebSocket endpoints answer as well.
+func TestRegisterWSEndpointHealth(t *testing.T) {
+	r := registry.NewMemoryRegistry()
+	defer r.Close()
+
+	config := RegistrationConfig{Registry: r, Name: "task", Version: "1.0.0"}
+	listener, srv, err := StartWSEndpointWithRegistration("127.0.0.1:0", nil, nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	nodes := registeredNodes(t, r)
+	if len(nodes) != 1 {
+		t.Fatalf("got %d nodes, want 1", len(nodes))
+	}
+	check := fmt.Sprintf("http://%s:%d%s", nodes[0].Host, nodes[0].Port, health.ReadyPath)
+	get := func() int {
+		resp, err := http.Get(check)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("got %d without health checks", code)
+	}
+
+	srv.Health = health.New(0)
+	srv.Health.AddReadinessCheck("db", health.CheckerFunc(func(ctx context.Context) error {
+		return errors.New("down")
+	}))
+	if code := get(); code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d for failing readiness", code)
+	}
+}
+
+func TestRegisterEndpointErrors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if _, err := RegisterEndpoint(NewServer(), listener, registry.ProtocolHTTP, RegistrationConfig{Name: "task"}); err == nil {
+		t.Fatal("registered without registry")
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrResumeAhead is returned by ReplayBuffer.Subscribe for a resume point
+// after the last notification sent, e.g. one seen before a restart.
+var ErrResumeAhead = errors.New("resume point is ahead of the notifications sent")
+
+// DefaultReplaySize is the number of notifications kept by a ReplayBuffer
+// when no size is configured.
+const DefaultReplaySize = 256
+
+// seqNotification is a notification payload tagged with its sequence number.
+type seqNotification struct {
+	seq  uint64
+	data interface{}
+}
+
+// ReplaySource loads the notifications with sequence numbers from first to
+// last that no longer fit in a ReplayBuffer, e.g. from a persistent log. It
+// returns the sequence number of the first loaded notification, which is
+// greater than first if the oldest ones are gone as well.
+type ReplaySource func(first, last uint64) (uint64, []interface{}, error)
+
+// ReplayBuffer is a subscription source that numbers its notifications and
+// keeps the most recent ones, so a client that lost its connection can
+// subscribe again and resume from the last sequence number it has seen.
+//
+// Sequence numbers start at 1 and increase by one for every notification.
+type ReplayBuffer struct {
+	mu      sync.Mutex
+	size    int
+	seq     uint64            // sequence number of the last notification
+	entries []seqNotification // buffered notifications, oldest first
+	source  ReplaySource      // loads notifications older than entries, may be nil
+	subs    map[*Subscription]*Notifier
+	resumes map[*Subscription]bool // subscriptions still catching up, skipped by Send
+}
+
+// NewReplayBuffer creates a subscription source keeping the last size
+// notifications.
+func NewReplayBuffer(size int) *ReplayBuffer {
+	if size <= 0 {
+		size = DefaultReplaySize
+	}
+	return &ReplayBuffer{
+		size:    size,
+		entries: make([]seqNotification, 0, size),
+		subs:    make(map[*Subscription]*Notifier),
+		resumes: make(map[*Subscription]bool),
+	}
+}
+
+// Seq returns the sequence number of the last notification sent.
+func (b *ReplayBuffer) Seq() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.seq
+}
+
+// SetSource sets the source of the notifications a resuming client missed
+// that are no longer buffered. The source is called without the buffer
+// locked, so Send doesn't wait for it.
+func (b *ReplayBuffer) SetSource(source ReplaySource) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.source = source
+}
+
+// Send assigns the next sequence number to data, buffers it and queues it
+// for all attached subscriptions. It returns the assigned sequence number.
+func (b *ReplayBuffer) Send(data interface{}) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	sn := seqNotification{seq: b.seq, data: data}
+	if len(b.entries) == b.size {
+		copy(b.entries, b.entries[1:])
+		b.entries = b.entries[:b.size-1]
+	}
+	b.entries = append(b.entries, sn)
+
+	for sub, notifier := range b.subs {
+		if b.resumes[sub] {
+			continue
+		}
+		if !notifier.notifySeq(sub, sn) {
+			delete(b.subs, sub)
+		}
+	}
+	return b.seq
+}
+
+// Subscribe creates a subscription on the notifier that receives all future
+// notifications of the buffer. If from is not nil, the notifications with a
+// sequence number greater than *from are delivered first, from the buffer or
+// the source. They are queued as fast as the client reads them, so none is
+// dropped, and live notifications follow once the client caught up. Clients
+// can detect that notifications were lost, because neither the buffer nor the
+// source had them, by a gap in the sequence numbers. A from greater than the
+// sequence number of the last notification is rejected with ErrResumeAhead.
+//
+// Like CreateSubscription, the returned subscription must be returned by the
+// subscription callback so the server can activate it.
+func (b *ReplayBuffer) Subscribe(notifier *Notifier, from *uint64) (*Subscription, error) {
+	b.mu.Lock()
+	if from != nil && *from > b.seq {
+		b.mu.Unlock()
+		return nil, ErrResumeAhead
+	}
+	sub := notifier.CreateSubscription()
+	b.subs[sub] = notifier
+	if from != nil && *from < b.seq {
+		b.resumes[sub] = true
+		go b.resume(notifier, sub, *from+1)
+	}
+	b.mu.Unlock()
+
+	go func() {
+		select {
+		case <-sub.quit:
+		case <-notifier.Closed():
+		}
+		b.mu.Lock()
+		delete(b.subs, sub)
+		delete(b.resumes, sub)
+		b.mu.Unlock()
+	}()
+	return sub, nil
+}
+
+// resume queues the notifications from sequence number next on until sub has
+// caught up with the buffer, then Send takes over.
+func (b *ReplayBuffer) resume(notifier *Notifier, sub *Subscription, next uint64) {
+	for {
+		b.mu.Lock()
+		if !b.resumes[sub] {
+			b.mu.Unlock()
+			return
+		}
+		if next > b.seq {
+			delete(b.resumes, sub)
+			b.mu.Unlock()
+			return
+		}
+		oldest := b.seq + 1
+		if len(b.entries) > 0 {
+			oldest = b.entries[0].seq
+		}
+		var batch []seqNotification
+		for _, sn := range b.entries {
+			if sn.seq >= next {
+				batch = append(batch, sn)
+			}
+		}
+		source := b.source
+		b.mu.Unlock()
+
+		if next < oldest {
+			batch = load(source, next, oldest-1)
+			if len(batch) == 0 {
+				next = oldest
+				continue
+			}
+		}
+		for _, sn := range batch {
+			if !sub.waitSpace(notifier.Closed()) || !notifier.notifySeq(sub, sn) {
+				return
+			}
+		}
+		next = batch[len(batch)-1].seq + 1
+	}
+}
+
+// load returns the notifications from first to last that source still has.
+func load(source ReplaySource, first, last uint64) []seqNotification {
+	if source == nil {
+		return nil
+	}
+	start, items, err := source(first, last)
+	if err != nil {
+		log.Warnf("Failed to load notifications %d-%d: %v", first, last, err)
+		return nil
+	}
+	var batch []seqNotification
+	for i, data := range items {
+		sn := seqNotification{seq: start + uint64(i), data: data}
+		if sn.seq < first {
+			continue
+		}
+		if sn.seq > last {
+			break
+		}
+		batch = append(batch, sn)
+	}
+	return batch
+}
+
+// Count returns the number of attached subscriptions.
+func (b *ReplayBuffer) Count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
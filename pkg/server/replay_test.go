@@ -0,0 +1,253 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"airman.com/airfk/pkg/codec"
+)
+
+type ReplayTestService struct {
+	events *ReplayBuffer
+}
+
+func (s *ReplayTestService) Events(ctx context.Context, from *uint64) (*Subscription, error) {
+	notifier, supported := NotifierFromContext(ctx)
+	if !supported {
+		return nil, ErrNotificationsUnsupported
+	}
+	return s.events.Subscribe(notifier, from)
+}
+
+// subscribeReplay subscribes to the test service over a fresh connection and
+// returns the decoder to read notifications from.
+func subscribeReplay(t *testing.T, server *Server, params []interface{}) (net.Conn, *json.Decoder) {
+	clientConn, serverConn := net.Pipe()
+	go server.ServeCodec(codec.NewJSONCodec(serverConn), OptionMethodInvocation|OptionSubscriptions)
+
+	request := map[string]interface{}{
+		"id":      1,
+		"method":  "replay_subscribe",
+		"version": "2.0",
+		"params":  params,
+	}
+	if err := json.NewEncoder(clientConn).Encode(request); err != nil {
+		t.Fatal(err)
+	}
+	in := json.NewDecoder(clientConn)
+	var response codec.JsonSuccessResponse
+	if err := in.Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := response.Result.(string); !ok {
+		t.Fatalf("expected subscription id, got %v", response.Result)
+	}
+	return clientConn, in
+}
+
+func expectSeqs(t *testing.T, conn net.Conn, in *json.Decoder, seqs ...uint64) {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, seq := range seqs {
+		var notification codec.JsonNotification
+		if err := in.Decode(&notification); err != nil {
+			t.Fatal(err)
+		}
+		if notification.Params.Seq != seq {
+			t.Fatalf("expected sequence %d, got %d", seq, notification.Params.Seq)
+		}
+		if int(notification.Params.Result.(float64)) != int(seq)*10 {
+			t.Fatalf("unexpected payload %v for sequence %d", notification.Params.Result, seq)
+		}
+	}
+}
+
+func TestReplayBufferResume(t *testing.T) {
+	server := NewServer()
+	service := &ReplayTestService{events: NewReplayBuffer(3)}
+	if err := server.RegisterName("replay", service); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	for i := 1; i <= 5; i++ {
+		service.events.Send(i * 10)
+	}
+
+	// Resuming within the buffer replays the missed notifications.
+	conn, in := subscribeReplay(t, server, []interface{}{"events", 3})
+	defer conn.Close()
+	expectSeqs(t, conn, in, 4, 5)
+
+	// Resuming beyond the buffer replays what is left, leaving a gap.
+	conn2, in2 := subscribeReplay(t, server, []interface{}{"events", 0})
+	defer conn2.Close()
+	expectSeqs(t, conn2, in2, 3, 4, 5)
+
+	// Without a resume point only live notifications are delivered.
+	conn3, in3 := subscribeReplay(t, server, []interface{}{"events"})
+	defer conn3.Close()
+
+	service.events.Send(60)
+	expectSeqs(t, conn, in, 6)
+	expectSeqs(t, conn2, in2, 6)
+	expectSeqs(t, conn3, in3, 6)
+}
+
+func TestReplayBufferSource(t *testing.T) {
+	server := NewServer()
+	service := &ReplayTestService{events: NewReplayBuffer(2)}
+	if err := server.RegisterName("replay", service); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// The source lost the first notification already.
+	var loaded [2]uint64
+	service.events.SetSource(func(first, last uint64) (uint64, []interface{}, error) {
+		loaded = [2]uint64{first, last}
+		return 2, []interface{}{20, 30}, nil
+	})
+	for i := 1; i <= 5; i++ {
+		service.events.Send(i * 10)
+	}
+
+	conn, in := subscribeReplay(t, server, []interface{}{"events", 0})
+	defer conn.Close()
+	expectSeqs(t, conn, in, 2, 3, 4, 5)
+	if loaded != [2]uint64{1, 3} {
+		t.Fatalf("source loaded %v, want [1 3]", loaded)
+	}
+}
+
+func TestReplayBufferDetach(t *testing.T) {
+	server := NewServer()
+	service := &ReplayTestService{events: NewReplayBuffer(0)}
+	if err := server.RegisterName("replay", service); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	conn, _ := subscribeReplay(t, server, []interface{}{"events"})
+	if n := service.events.Count(); n != 1 {
+		t.Fatalf("expected 1 attached subscription, got %d", n)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for service.events.Count() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("subscription not detached after connection close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplayBufferLargeGap(t *testing.T) {
+	server := NewServer()
+	server.SubConfig = SubscriptionConfig{QueueSize: 4, Overflow: DropOldest}
+	service := &ReplayTestService{events: NewReplayBuffer(2)}
+	if err := server.RegisterName("replay", service); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// The source keeps everything, far more than the queue of a subscription.
+	service.events.SetSource(func(first, last uint64) (uint64, []interface{}, error) {
+		var items []interface{}
+		for seq := first; seq <= last; seq++ {
+			items = append(items, int(seq)*10)
+		}
+		return first, items, nil
+	})
+	var seqs []uint64
+	for i := 1; i <= 100; i++ {
+		service.events.Send(i * 10)
+		seqs = append(seqs, uint64(i))
+	}
+
+	conn, in := subscribeReplay(t, server, []interface{}{"events", 0})
+	defer conn.Close()
+	expectSeqs(t, conn, in, seqs...)
+	service.events.Send(1010)
+	expectSeqs(t, conn, in, 101)
+}
+
+func TestReplayBufferSourceUnlocked(t *testing.T) {
+	server := NewServer()
+	service := &ReplayTestService{events: NewReplayBuffer(1)}
+	if err := server.RegisterName("replay", service); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	loading, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	service.events.SetSource(func(first, last uint64) (uint64, []interface{}, error) {
+		once.Do(func() {
+			close(loading)
+			<-release
+		})
+		var items []interface{}
+		for seq := first; seq <= last; seq++ {
+			items = append(items, int(seq)*10)
+		}
+		return first, items, nil
+	})
+	service.events.Send(10)
+	service.events.Send(20)
+
+	conn, in := subscribeReplay(t, server, []interface{}{"events", 0})
+	defer conn.Close()
+	<-loading
+
+	// Sending doesn't wait for the source.
+	sent := make(chan struct{})
+	go func() {
+		service.events.Send(30)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("send blocked by the source")
+	}
+	close(release)
+	expectSeqs(t, conn, in, 1, 2, 3)
+}
+
+func TestReplayBufferResumeAhead(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	notifier := newNotifier(codec.NewJSONCodec(serverConn), DefaultSubscriptionConfig)
+
+	events := NewReplayBuffer(0)
+	events.Send(10)
+	from := uint64(2)
+	if _, err := events.Subscribe(notifier, &from); err != ErrResumeAhead {
+		t.Fatalf("expected %v, got %v", ErrResumeAhead, err)
+	}
+	from = 1
+	if _, err := events.Subscribe(notifier, &from); err != nil {
+		t.Fatal(err)
+	}
+}
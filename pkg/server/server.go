@@ -28,11 +28,16 @@ import (
 	set "github.com/deckarep/golang-set"
 
 	cc "airman.com/airfk/pkg/codec"
+	"airman.com/airfk/pkg/health"
 	ts "airman.com/airfk/pkg/types"
 )
 
 const MetadataApi = "rpc"
 
+// AdminApi is the namespace of the AdminService. Endpoints only serve it when
+// it is listed in their modules.
+const AdminApi = "rpcadmin"
+
 const (
 	serviceMethodSeparator   = "_"
 	subscribeMethodSuffix    = "_subscribe"
@@ -86,19 +91,34 @@ type ServiceRegistry map[string]*Service // collection of services
 
 // Server represents a RPC server
 type Server struct {
-	Services ServiceRegistry
-
-	Run      int32
-	CodecsMu sync.Mutex
-	Codecs   set.Set
+	Services   ServiceRegistry
+	servicesMu sync.RWMutex    // guards Services, which SetModules replaces while serving
+	modules    map[string]bool // namespaces served from a module whitelist
+
+	Run       int32
+	CodecsMu  sync.Mutex
+	Codecs    set.Set
+	SubConfig SubscriptionConfig // delivery settings of subscriptions
+	SubLimits SubscriptionLimits // maximum number of subscriptions
+	Health    *health.Health     // served at the health paths, nil answers them with 200
+	cors      atomic.Value       // corsValue of SetHTTPOrigins
+	wsOrigins atomic.Value       // originCheck of SetWSOrigins
+
+	notifiersMu sync.Mutex // guards notifiers and subscription reservations
+	notifiers   map[*Notifier]struct{}
+
+	regMu         sync.Mutex
+	registrations []*registration // registry entries removed on Stop
 }
 
 // NewServer will create a new server instance with no registered handlers.
 func NewServer() *Server {
 	server := &Server{
-		Services: make(ServiceRegistry),
-		Codecs:   set.NewSet(),
-		Run:      1,
+		Services:  make(ServiceRegistry),
+		Codecs:    set.NewSet(),
+		Run:       1,
+		SubConfig: DefaultSubscriptionConfig,
+		notifiers: make(map[*Notifier]struct{}),
 	}
 
 	// register a default service which will provide meta information about the RPC service such as the services and
@@ -117,6 +137,9 @@ type RPCService struct {
 
 // Modules returns the list of RPC services with their version number
 func (s *RPCService) Modules() map[string]string {
+	s.server.servicesMu.RLock()
+	defer s.server.servicesMu.RUnlock()
+
 	modules := make(map[string]string)
 	for name := range s.server.Services {
 		modules[name] = "1.0"
@@ -124,14 +147,48 @@ func (s *RPCService) Modules() map[string]string {
 	return modules
 }
 
+// AdminService lets operators inspect and end the subscriptions of all
+// connections. It is not registered by default, see AdminAPI.
+type AdminService struct {
+	server *Server
+}
+
+// Subscriptions returns the active subscriptions of all connections.
+func (s *AdminService) Subscriptions() []SubscriptionInfo {
+	return s.server.Subscriptions()
+}
+
+// TerminateSubscription ends the subscription with the given id.
+func (s *AdminService) TerminateSubscription(id ID) error {
+	return s.server.TerminateSubscription(id)
+}
+
+// AdminAPI returns the AdminService of s under AdminApi. The api is not
+// public, so it is only served when whitelisted by modules.
+func (s *Server) AdminAPI() ts.API {
+	return ts.API{
+		Namespace: AdminApi,
+		Version:   "1.0",
+		Service:   &AdminService{s},
+		Public:    false,
+	}
+}
+
 // RegisterName will create a service for the given rcvr type under the given name. When no methods on the given rcvr
 // match the criteria to be either a RPC method or a subscription an error is returned. Otherwise a new service is
 // created and added to the service collection this server instance serves.
 func (s *Server) RegisterName(name string, rcvr interface{}) error {
+	s.servicesMu.Lock()
+	defer s.servicesMu.Unlock()
+
 	if s.Services == nil {
 		s.Services = make(ServiceRegistry)
 	}
+	return s.Services.register(name, rcvr)
+}
 
+// register adds the methods and subscriptions of rcvr to the service name.
+func (r ServiceRegistry) register(name string, rcvr interface{}) error {
 	svc := new(Service)
 	svc.Typ = reflect.TypeOf(rcvr)
 	rcvrVal := reflect.ValueOf(rcvr)
@@ -146,7 +203,7 @@ func (s *Server) RegisterName(name string, rcvr interface{}) error {
 	methods, subscriptions := suitableCallbacks(rcvrVal, svc.Typ)
 
 	// already a previous service register under given sname, merge methods/Subscriptions
-	if regsvc, present := s.Services[name]; present {
+	if regsvc, present := r[name]; present {
 		if len(methods) == 0 && len(subscriptions) == 0 {
 			return fmt.Errorf("Service %T doesn't have any suitable methods/Subscriptions to expose", rcvr)
 		}
@@ -166,10 +223,18 @@ func (s *Server) RegisterName(name string, rcvr interface{}) error {
 		return fmt.Errorf("Service %T doesn't have any suitable methods/Subscriptions to expose", rcvr)
 	}
 
-	s.Services[svc.Name] = svc
+	r[svc.Name] = svc
 	return nil
 }
 
+// service returns the registered service name.
+func (s *Server) service(name string) (*Service, bool) {
+	s.servicesMu.RLock()
+	defer s.servicesMu.RUnlock()
+	svc, ok := s.Services[name]
+	return svc, ok
+}
+
 // serveRequest will reads requests from the cc, calls the RPC callback and
 // writes the response to the given cc.
 //
@@ -199,7 +264,10 @@ func (s *Server) serveRequest(ctx context.Context, cc cc.ServerCodec, singleShot
 	// to send notification to clients. It is tied to the cc/connection. If the
 	// connection is closed the notifier will stop and cancels all active Subscriptions.
 	if options&OptionSubscriptions == OptionSubscriptions {
-		ctx = context.WithValue(ctx, notifierKey{}, newNotifier(cc))
+		notifier := newNotifier(cc, s.SubConfig)
+		ctx = context.WithValue(ctx, notifierKey{}, notifier)
+		s.trackNotifier(notifier)
+		defer s.untrackNotifier(notifier)
 	}
 	s.CodecsMu.Lock()
 	if atomic.LoadInt32(&s.Run) != 1 { // server stopped
@@ -283,16 +351,106 @@ func (s *Server) Stop() {
 	if atomic.CompareAndSwapInt32(&s.Run, 1, 0) {
 		log.Debug("RPC Server shutdown initiatied")
 		s.CodecsMu.Lock()
-		defer s.CodecsMu.Unlock()
 		s.Codecs.Each(func(c interface{}) bool {
 			c.(cc.ServerCodec).Close()
 			return true
 		})
+		s.CodecsMu.Unlock()
+		s.deregisterAll()
+	}
+}
+
+// trackNotifier adds the notifier of a connection to the set used for
+// subscription limits and administration.
+func (s *Server) trackNotifier(n *Notifier) {
+	s.notifiersMu.Lock()
+	defer s.notifiersMu.Unlock()
+	if s.notifiers == nil {
+		s.notifiers = make(map[*Notifier]struct{})
+	}
+	s.notifiers[n] = struct{}{}
+}
+
+// untrackNotifier removes the notifier of a closed connection.
+func (s *Server) untrackNotifier(n *Notifier) {
+	s.notifiersMu.Lock()
+	defer s.notifiersMu.Unlock()
+	delete(s.notifiers, n)
+}
+
+// reserveSubscription checks the subscription limits and reserves a slot on
+// the notifier for a subscription callback. The slot must be released with
+// releaseSubscription after the callback returned.
+func (s *Server) reserveSubscription(n *Notifier) error {
+	s.notifiersMu.Lock()
+	defer s.notifiersMu.Unlock()
+
+	n.subMu.Lock()
+	defer n.subMu.Unlock()
+
+	if s.SubLimits.PerConn > 0 && n.count() >= s.SubLimits.PerConn {
+		return ErrSubscriptionLimit
+	}
+	if s.SubLimits.Total > 0 {
+		total := n.count()
+		for other := range s.notifiers {
+			if other != n {
+				other.subMu.RLock()
+				total += other.count()
+				other.subMu.RUnlock()
+			}
+		}
+		if total >= s.SubLimits.Total {
+			return ErrSubscriptionLimit
+		}
+	}
+	n.reserved++
+	return nil
+}
+
+// releaseSubscription releases a slot taken by reserveSubscription.
+func (s *Server) releaseSubscription(n *Notifier) {
+	n.subMu.Lock()
+	n.reserved--
+	n.subMu.Unlock()
+}
+
+// Subscriptions returns the active subscriptions of all connections.
+func (s *Server) Subscriptions() []SubscriptionInfo {
+	s.notifiersMu.Lock()
+	defer s.notifiersMu.Unlock()
+
+	infos := []SubscriptionInfo{}
+	for n := range s.notifiers {
+		infos = append(infos, n.subscriptions()...)
+	}
+	return infos
+}
+
+// TerminateSubscription ends the active subscription with the given id. The
+// subscription receives ErrSubscriptionTerminated on its error channel.
+func (s *Server) TerminateSubscription(id ID) error {
+	s.notifiersMu.Lock()
+	defer s.notifiersMu.Unlock()
+
+	for n := range s.notifiers {
+		if sub, found := n.lookup(id); found {
+			n.terminate(sub, ErrSubscriptionTerminated)
+			return nil
+		}
 	}
+	return ErrSubscriptionNotFound
 }
 
 // createSubscription will call the subscription callback and returns the subscription id or error.
 func (s *Server) createSubscription(ctx context.Context, c cc.ServerCodec, req *ServerRequest) (ID, error) {
+	if notifier, supported := NotifierFromContext(ctx); supported {
+		if err := s.reserveSubscription(notifier); err != nil {
+			return "", err
+		}
+		defer s.releaseSubscription(notifier)
+	}
+
 	// subscription have as first argument the context following optional arguments
 	args := []reflect.Value{req.Callb.Rcvr, reflect.ValueOf(ctx)}
 	args = append(args, req.Args...)
@@ -454,7 +612,7 @@ func (s *Server) readRequest(cc cc.ServerCodec) ([]*ServerRequest, bool, ts.Erro
 			continue
 		}
 
-		if svc, ok = s.Services[r.Service]; !ok { // rpc method isn't available
+		if svc, ok = s.service(r.Service); !ok { // rpc method isn't available
 			requests[i] = &ServerRequest{Id: r.Id, Err: &ts.MethodNotFoundError{r.Service, r.Method}}
 			continue
 		}
@@ -21,10 +21,12 @@ import (
 	"encoding/json"
 	"net"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 
 	"airman.com/airfk/pkg/codec"
+	ts "airman.com/airfk/pkg/types"
 )
 
 type DemoServer struct{}
@@ -155,6 +157,62 @@ func testServerMethodExecution(t *testing.T, method string) {
 	}
 }
 
+func TestServerSetModules(t *testing.T) {
+	server := NewServer()
+	apis := []ts.API{
+		{Namespace: "calc", Service: new(DemoServer), Public: true},
+		{Namespace: "admin", Service: new(DemoServer)},
+	}
+	modules := func() []string {
+		var names []string
+		for name := range (&RPCService{server}).Modules() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	if err := server.SetModules(apis, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := modules(); !reflect.DeepEqual(got, []string{"calc", MetadataApi}) {
+		t.Fatalf("public modules %v", got)
+	}
+	if err := server.SetModules(apis, []string{"admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := modules(); !reflect.DeepEqual(got, []string{"admin", MetadataApi}) {
+		t.Fatalf("whitelisted modules %v", got)
+	}
+	if err := server.SetModules(apis, []string{"calc", AdminApi}); err != nil {
+		t.Fatal(err)
+	}
+	if got := modules(); !reflect.DeepEqual(got, []string{"calc", MetadataApi, AdminApi}) {
+		t.Fatalf("admin modules %v", got)
+	}
+
+	// Services registered outside of apis are kept.
+	if err := server.RegisterName("app", new(DemoServer)); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetModules(apis, []string{"admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := modules(); !reflect.DeepEqual(got, []string{"admin", "app", MetadataApi}) {
+		t.Fatalf("modules after registering app %v", got)
+	}
+	admin := server.AdminAPI()
+	if err := server.RegisterName(admin.Namespace, admin.Service); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetModules(apis, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := modules(); !reflect.DeepEqual(got, []string{"app", "calc", MetadataApi, AdminApi}) {
+		t.Fatalf("modules after registering admin %v", got)
+	}
+}
+
 func TestServerMethodExecution(t *testing.T) {
 	testServerMethodExecution(t, "echo")
 }
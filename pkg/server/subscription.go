@@ -22,6 +22,7 @@ import (
 	"math/rand"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"airman.com/airfk/pkg/codec"
@@ -32,24 +33,195 @@ var (
 	ErrNotificationsUnsupported = errors.New("notifications not supported")
 	// ErrNotificationNotFound is returned when the notification for the given id is not found
 	ErrSubscriptionNotFound = errors.New("subscription not found")
+	// ErrSubscriptionQueueOverflow is sent on Err() when a subscription with the
+	// Terminate policy can't keep up with its notifications
+	ErrSubscriptionQueueOverflow = errors.New("subscription queue overflow")
+	// ErrSubscriptionLimit is returned when a connection or server has too many subscriptions
+	ErrSubscriptionLimit = errors.New("too many subscriptions")
+	// ErrSubscriptionTerminated is sent on Err() when a subscription is terminated by an administrator
+	ErrSubscriptionTerminated = errors.New("subscription terminated")
 )
 
+// OverflowPolicy determines what happens to a notification when the outbound
+// queue of a subscription is full.
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest queued notification to make room
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the notification that doesn't fit
+	DropNewest
+	// Terminate ends the subscription and reports ErrSubscriptionQueueOverflow on Err()
+	Terminate
+)
+
+// DefaultQueueSize is the number of notifications buffered per subscription
+// when no size is configured.
+const DefaultQueueSize = 1024
+
+// SubscriptionConfig holds the delivery settings of a subscription.
+type SubscriptionConfig struct {
+	QueueSize int            // maximum number of undelivered notifications
+	Overflow  OverflowPolicy // what to do when the queue is full
+}
+
+// DefaultSubscriptionConfig contains reasonable default delivery settings.
+var DefaultSubscriptionConfig = SubscriptionConfig{
+	QueueSize: DefaultQueueSize,
+	Overflow:  DropOldest,
+}
+
+// SubscriptionLimits caps the number of subscriptions, zero means unlimited.
+type SubscriptionLimits struct {
+	PerConn int // maximum number of subscriptions of a single connection
+	Total   int // maximum number of subscriptions of the server
+}
+
+// SubscriptionInfo describes an active subscription.
+type SubscriptionInfo struct {
+	ID        ID        `json:"id"`
+	Namespace string    `json:"namespace"`
+	Created   time.Time `json:"created"`
+	Delivered uint64    `json:"delivered"`
+	Dropped   uint64    `json:"dropped"`
+}
+
 // ID defines a pseudo random number that is used to identify RPC subscriptions.
 type ID string
 
 // a Subscription is created by a notifier and tight to that notifier. The client can use
 // this subscription to wait for an unsubscribe request for the client, see Err().
+//
+// Notifications are queued per subscription and written to the connection by a
+// dedicated goroutine, so a slow client never blocks the producer.
 type Subscription struct {
+	dropped   uint64 // number of discarded notifications, accessed atomically
+	delivered uint64 // number of written notifications, accessed atomically
+
 	ID        ID
 	namespace string
-	err       chan error // closed on unsubscribe
+	created   time.Time
+	err       chan error // closed on unsubscribe, receives an error on termination
+
+	config SubscriptionConfig
+	mu     sync.Mutex    // guards queue
+	queue  []interface{} // undelivered notification payloads
+	wakeup chan struct{} // signals the delivery loop about new notifications
+	space  chan struct{} // signals waitSpace that notifications were written
+	quit   chan struct{} // closed when the subscription ends
+}
+
+func newSubscription(config SubscriptionConfig) *Subscription {
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultQueueSize
+	}
+	return &Subscription{
+		ID:      NewID(),
+		created: time.Now(),
+		err:     make(chan error, 1),
+		config:  config,
+		wakeup:  make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
 }
 
 // Err returns a channel that is closed when the client send an unsubscribe request.
+// If the subscription is terminated because of a queue overflow the error is
+// sent on the channel instead.
 func (s *Subscription) Err() <-chan error {
 	return s.err
 }
 
+// Dropped returns the number of notifications that were discarded because the
+// outbound queue was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Delivered returns the number of notifications written to the connection.
+func (s *Subscription) Delivered() uint64 {
+	return atomic.LoadUint64(&s.delivered)
+}
+
+// info returns a description of the subscription.
+func (s *Subscription) info() SubscriptionInfo {
+	return SubscriptionInfo{
+		ID:        s.ID,
+		Namespace: s.namespace,
+		Created:   s.created,
+		Delivered: s.Delivered(),
+		Dropped:   s.Dropped(),
+	}
+}
+
+// enqueue adds data to the outbound queue and applies the overflow policy.
+// It returns false if the subscription must be terminated.
+func (s *Subscription) enqueue(data interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) >= s.config.QueueSize {
+		atomic.AddUint64(&s.dropped, 1)
+		switch s.config.Overflow {
+		case DropOldest:
+			copy(s.queue, s.queue[1:])
+			s.queue[len(s.queue)-1] = data
+			return true
+		case DropNewest:
+			return true
+		default:
+			return false
+		}
+	}
+	s.queue = append(s.queue, data)
+
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// dequeue removes and returns the oldest queued notification.
+func (s *Subscription) dequeue() (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) == 0 {
+		return nil, false
+	}
+	data := s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+
+	select {
+	case s.space <- struct{}{}:
+	default:
+	}
+	return data, true
+}
+
+// waitSpace blocks until the queue has room for a notification. It returns
+// false if the subscription ended or the connection was closed.
+func (s *Subscription) waitSpace(closed <-chan interface{}) bool {
+	for {
+		s.mu.Lock()
+		full := len(s.queue) >= s.config.QueueSize
+		s.mu.Unlock()
+		if !full {
+			return true
+		}
+		select {
+		case <-s.space:
+		case <-s.quit:
+			return false
+		case <-closed:
+			return false
+		}
+	}
+}
+
 // notifierKey is used to store a notifier within the connection context.
 type notifierKey struct{}
 
@@ -57,16 +229,19 @@ type notifierKey struct{}
 // Server callbacks use the notifier to send notifications.
 type Notifier struct {
 	codec    codec.ServerCodec
-	subMu    sync.RWMutex // guards active and inactive maps
+	config   SubscriptionConfig // delivery settings of new subscriptions
+	subMu    sync.RWMutex       // guards active and inactive maps and reserved
 	active   map[ID]*Subscription
 	inactive map[ID]*Subscription
+	reserved int // subscription callbacks in progress
 }
 
 // newNotifier creates a new notifier that can be used to send subscription
 // notifications to the client.
-func newNotifier(codec codec.ServerCodec) *Notifier {
+func newNotifier(codec codec.ServerCodec, config SubscriptionConfig) *Notifier {
 	return &Notifier{
 		codec:    codec,
+		config:   config,
 		active:   make(map[ID]*Subscription),
 		inactive: make(map[ID]*Subscription),
 	}
@@ -83,41 +258,147 @@ func NotifierFromContext(ctx context.Context) (*Notifier, bool) {
 // are dropped until the subscription is marked as active. This is done
 // by the RPC server after the subscription ID is send to the client.
 func (n *Notifier) CreateSubscription() *Subscription {
-	s := &Subscription{ID: NewID(), err: make(chan error)}
+	return n.CreateSubscriptionWithConfig(n.config)
+}
+
+// CreateSubscriptionWithConfig is like CreateSubscription but overrides the
+// delivery settings of the connection for this subscription.
+func (n *Notifier) CreateSubscriptionWithConfig(config SubscriptionConfig) *Subscription {
+	s := newSubscription(config)
 	n.subMu.Lock()
 	n.inactive[s.ID] = s
 	n.subMu.Unlock()
 	return s
 }
 
-// Notify sends a notification to the client with the given data as payload.
-// If an error occurs the RPC connection is closed and the error is returned.
+// Notify queues a notification to the client with the given data as payload.
+// It never blocks on the connection; when the queue of the subscription is full
+// the overflow policy is applied. ErrSubscriptionQueueOverflow is returned if
+// the subscription was terminated as a result.
 func (n *Notifier) Notify(id ID, data interface{}) error {
 	n.subMu.RLock()
-	defer n.subMu.RUnlock()
-
 	sub, active := n.active[id]
-	if active {
-		notification := n.codec.CreateNotification(string(id), sub.namespace, data)
-		if err := n.codec.Write(notification); err != nil {
-			n.codec.Close()
-			return err
-		}
+	n.subMu.RUnlock()
+
+	if active && !sub.enqueue(data) {
+		n.terminate(sub, ErrSubscriptionQueueOverflow)
+		return ErrSubscriptionQueueOverflow
 	}
 	return nil
 }
 
+// deliver writes the queued notifications of sub to the connection until the
+// subscription ends or the connection is closed. If an error occurs the RPC
+// connection is closed.
+func (n *Notifier) deliver(sub *Subscription) {
+	for {
+		select {
+		case <-sub.wakeup:
+		case <-sub.quit:
+			return
+		case <-n.codec.Closed():
+			return
+		}
+		for {
+			select {
+			case <-sub.quit:
+				return
+			default:
+			}
+			data, ok := sub.dequeue()
+			if !ok {
+				break
+			}
+			var notification interface{}
+			if sn, ok := data.(seqNotification); ok {
+				if sc, ok := n.codec.(codec.SeqNotifier); ok {
+					notification = sc.CreateNotificationWithSeq(string(sub.ID), sub.namespace, sn.seq, sn.data)
+				} else {
+					notification = n.codec.CreateNotification(string(sub.ID), sub.namespace, sn.data)
+				}
+			} else {
+				notification = n.codec.CreateNotification(string(sub.ID), sub.namespace, data)
+			}
+			if err := n.codec.Write(notification); err != nil {
+				n.codec.Close()
+				return
+			}
+			atomic.AddUint64(&sub.delivered, 1)
+		}
+	}
+}
+
+// notifySeq queues a sequenced notification. Unlike Notify it also queues for
+// subscriptions that are not active yet, delivery starts once they are. It
+// returns false if the subscription has ended.
+func (n *Notifier) notifySeq(sub *Subscription, sn seqNotification) bool {
+	n.subMu.RLock()
+	_, active := n.active[sub.ID]
+	_, inactive := n.inactive[sub.ID]
+	n.subMu.RUnlock()
+
+	if !active && !inactive {
+		return false
+	}
+	if !sub.enqueue(sn) {
+		n.terminate(sub, ErrSubscriptionQueueOverflow)
+		return false
+	}
+	return true
+}
+
+// terminate ends a subscription and reports err on its error channel.
+func (n *Notifier) terminate(sub *Subscription, err error) {
+	n.subMu.Lock()
+	defer n.subMu.Unlock()
+	_, active := n.active[sub.ID]
+	_, inactive := n.inactive[sub.ID]
+	if active || inactive {
+		delete(n.active, sub.ID)
+		delete(n.inactive, sub.ID)
+		close(sub.quit)
+		sub.err <- err
+	}
+}
+
 // Closed returns a channel that is closed when the RPC connection is closed.
 func (n *Notifier) Closed() <-chan interface{} {
 	return n.codec.Closed()
 }
 
+// count returns the number of subscriptions of the connection, including the
+// ones being created. Callers must hold subMu.
+func (n *Notifier) count() int {
+	return len(n.active) + len(n.inactive) + n.reserved
+}
+
+// subscriptions returns a description of all active subscriptions.
+func (n *Notifier) subscriptions() []SubscriptionInfo {
+	n.subMu.RLock()
+	defer n.subMu.RUnlock()
+
+	infos := make([]SubscriptionInfo, 0, len(n.active))
+	for _, sub := range n.active {
+		infos = append(infos, sub.info())
+	}
+	return infos
+}
+
+// lookup returns the active subscription with the given id.
+func (n *Notifier) lookup(id ID) (*Subscription, bool) {
+	n.subMu.RLock()
+	defer n.subMu.RUnlock()
+	sub, found := n.active[id]
+	return sub, found
+}
+
 // unsubscribe a subscription.
 // If the subscription could not be found ErrSubscriptionNotFound is returned.
 func (n *Notifier) unsubscribe(id ID) error {
 	n.subMu.Lock()
 	defer n.subMu.Unlock()
 	if s, found := n.active[id]; found {
+		close(s.quit)
 		close(s.err)
 		delete(n.active, id)
 		return nil
@@ -136,6 +417,7 @@ func (n *Notifier) activate(id ID, namespace string) {
 		sub.namespace = namespace
 		n.active[id] = sub
 		delete(n.inactive, id)
+		go n.deliver(sub)
 	}
 }
 
@@ -19,6 +19,7 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
@@ -26,6 +27,7 @@ import (
 	"time"
 
 	"airman.com/airfk/pkg/codec"
+	ts "airman.com/airfk/pkg/types"
 )
 
 type NotificationTestService struct {
@@ -216,7 +218,7 @@ func waitForMessages(t *testing.T, in *json.Decoder, successes chan<- codec.Json
 				notifications <- codec.JsonNotification{
 					Version: msg["jsonrpc"].(string),
 					Method:  msg["method"].(string),
-					Params:  codec.JsonSubscription{params["subscription"].(string), params["result"]},
+					Params:  codec.JsonSubscription{Subscription: params["subscription"].(string), Result: params["result"]},
 				}
 				continue
 			}
@@ -330,3 +332,244 @@ func TestSubscriptionMultipleNamespaces(t *testing.T) {
 		}
 	}
 }
+
+// blockingCodec hands every written message to the test and blocks until the
+// test receives it, simulating a slow client.
+type blockingCodec struct {
+	codec.ServerCodec
+	writing chan struct{}
+	written chan interface{}
+}
+
+func newBlockingCodec() *blockingCodec {
+	_, serverConn := net.Pipe()
+	return &blockingCodec{
+		ServerCodec: codec.NewJSONCodec(serverConn),
+		writing:     make(chan struct{}, 100),
+		written:     make(chan interface{}),
+	}
+}
+
+func (c *blockingCodec) Write(msg interface{}) error {
+	c.writing <- struct{}{}
+	select {
+	case c.written <- msg:
+		return nil
+	case <-c.Closed():
+		return errors.New("closed")
+	}
+}
+
+func (c *blockingCodec) result(t *testing.T) interface{} {
+	select {
+	case msg := <-c.written:
+		return msg.(*codec.JsonNotification).Params.Result
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for notification")
+	}
+	return nil
+}
+
+// newQueuedSubscription creates an active subscription whose first notification
+// is in flight, so the queue itself is empty.
+func newQueuedSubscription(t *testing.T, config SubscriptionConfig) (*Notifier, *Subscription, *blockingCodec) {
+	c := newBlockingCodec()
+	notifier := newNotifier(c, config)
+	sub := notifier.CreateSubscription()
+	notifier.activate(sub.ID, "test")
+
+	if err := notifier.Notify(sub.ID, -1); err != nil {
+		t.Fatal(err)
+	}
+	<-c.writing
+	return notifier, sub, c
+}
+
+func TestSubscriptionDropOldest(t *testing.T) {
+	notifier, sub, c := newQueuedSubscription(t, SubscriptionConfig{QueueSize: 3, Overflow: DropOldest})
+	defer c.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := notifier.Notify(sub.ID, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dropped := sub.Dropped(); dropped != 2 {
+		t.Fatalf("dropped %d notifications, want 2", dropped)
+	}
+	for _, want := range []int{-1, 2, 3, 4} {
+		if got := c.result(t); got != want {
+			t.Fatalf("received %v, want %d", got, want)
+		}
+	}
+}
+
+func TestSubscriptionDropNewest(t *testing.T) {
+	notifier, sub, c := newQueuedSubscription(t, SubscriptionConfig{QueueSize: 3, Overflow: DropNewest})
+	defer c.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := notifier.Notify(sub.ID, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dropped := sub.Dropped(); dropped != 2 {
+		t.Fatalf("dropped %d notifications, want 2", dropped)
+	}
+	for _, want := range []int{-1, 0, 1, 2} {
+		if got := c.result(t); got != want {
+			t.Fatalf("received %v, want %d", got, want)
+		}
+	}
+}
+
+func TestSubscriptionTerminateOnOverflow(t *testing.T) {
+	notifier, sub, c := newQueuedSubscription(t, SubscriptionConfig{QueueSize: 2, Overflow: Terminate})
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := notifier.Notify(sub.ID, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := notifier.Notify(sub.ID, 2); err != ErrSubscriptionQueueOverflow {
+		t.Fatalf("expected %v, got %v", ErrSubscriptionQueueOverflow, err)
+	}
+	select {
+	case err := <-sub.Err():
+		if err != ErrSubscriptionQueueOverflow {
+			t.Fatalf("expected %v on Err(), got %v", ErrSubscriptionQueueOverflow, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscription not terminated")
+	}
+	if err := notifier.unsubscribe(sub.ID); err != ErrSubscriptionNotFound {
+		t.Fatalf("terminated subscription still active: %v", err)
+	}
+	// Further notifications for the terminated subscription are ignored.
+	if err := notifier.Notify(sub.ID, 3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor polls cond until it holds or a second passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// rpcCall writes a request to the connection and decodes the response.
+func rpcCall(t *testing.T, out *json.Encoder, in *json.Decoder, method string, params ...interface{}) map[string]interface{} {
+	request := map[string]interface{}{"id": 1, "method": method, "version": "2.0", "params": params}
+	if err := out.Encode(request); err != nil {
+		t.Fatal(err)
+	}
+	var response map[string]interface{}
+	if err := in.Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestSubscriptionLimits(t *testing.T) {
+	server := NewServer()
+	server.SubLimits = SubscriptionLimits{PerConn: 2, Total: 3}
+	if err := server.RegisterName("replay", &ReplayTestService{events: NewReplayBuffer(0)}); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	connect := func() (net.Conn, *json.Encoder, *json.Decoder) {
+		clientConn, serverConn := net.Pipe()
+		go server.ServeCodec(codec.NewJSONCodec(serverConn), OptionMethodInvocation|OptionSubscriptions)
+		return clientConn, json.NewEncoder(clientConn), json.NewDecoder(clientConn)
+	}
+	conn1, out1, in1 := connect()
+	defer conn1.Close()
+	conn2, out2, in2 := connect()
+	defer conn2.Close()
+
+	for i := 0; i < 2; i++ {
+		if resp := rpcCall(t, out1, in1, "replay_subscribe", "events"); resp["error"] != nil {
+			t.Fatalf("subscription %d failed: %v", i, resp["error"])
+		}
+	}
+	// The connection limit is reached.
+	if resp := rpcCall(t, out1, in1, "replay_subscribe", "events"); resp["error"] == nil {
+		t.Fatal("expected connection subscription limit error")
+	}
+	// The second connection can take the last slot of the server.
+	if resp := rpcCall(t, out2, in2, "replay_subscribe", "events"); resp["error"] != nil {
+		t.Fatalf("subscription failed: %v", resp["error"])
+	}
+	if resp := rpcCall(t, out2, in2, "replay_subscribe", "events"); resp["error"] == nil {
+		t.Fatal("expected server subscription limit error")
+	}
+
+	// Terminating a subscription frees a slot.
+	waitFor(t, "activation", func() bool { return len(server.Subscriptions()) == 3 })
+	subs := server.Subscriptions()
+	if err := server.TerminateSubscription(subs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.TerminateSubscription(subs[0].ID); err != ErrSubscriptionNotFound {
+		t.Fatalf("expected %v, got %v", ErrSubscriptionNotFound, err)
+	}
+	if resp := rpcCall(t, out2, in2, "replay_subscribe", "events"); resp["error"] != nil {
+		t.Fatalf("subscription failed after termination: %v", resp["error"])
+	}
+}
+
+func TestSubscriptionAdminAPI(t *testing.T) {
+	server := NewServer()
+	service := &ReplayTestService{events: NewReplayBuffer(0)}
+	apis := []ts.API{{Namespace: "replay", Service: service, Public: true}}
+	if err := server.SetModules(apis, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.ServeCodec(codec.NewJSONCodec(serverConn), OptionMethodInvocation|OptionSubscriptions)
+	out, in := json.NewEncoder(clientConn), json.NewDecoder(clientConn)
+
+	resp := rpcCall(t, out, in, "replay_subscribe", "events")
+	subid, _ := resp["result"].(string)
+	waitFor(t, "activation", func() bool { return len(server.Subscriptions()) == 1 })
+
+	// The admin api is not served unless whitelisted.
+	for _, method := range []string{"rpc_subscriptions", "rpcadmin_subscriptions"} {
+		if resp = rpcCall(t, out, in, method); resp["error"] == nil {
+			t.Fatalf("%s served without whitelisting: %v", method, resp)
+		}
+	}
+	if err := server.SetModules(apis, []string{"replay", AdminApi}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp = rpcCall(t, out, in, "rpcadmin_subscriptions")
+	subs, ok := resp["result"].([]interface{})
+	if !ok || len(subs) != 1 {
+		t.Fatalf("expected 1 subscription, got %v", resp)
+	}
+	info := subs[0].(map[string]interface{})
+	if info["id"] != subid || info["namespace"] != "replay" || info["created"] == nil {
+		t.Fatalf("unexpected subscription info %v", info)
+	}
+
+	resp = rpcCall(t, out, in, "rpcadmin_terminateSubscription", subid)
+	if resp["error"] != nil {
+		t.Fatalf("terminate failed: %v", resp["error"])
+	}
+	resp = rpcCall(t, out, in, "rpcadmin_subscriptions")
+	if subs, _ := resp["result"].([]interface{}); len(subs) != 0 {
+		t.Fatalf("expected no subscriptions after termination, got %v", subs)
+	}
+	waitFor(t, "detach", func() bool { return service.events.Count() == 0 })
+}
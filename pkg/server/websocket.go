@@ -16,35 +16,39 @@
 package server
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	log "github.com/sirupsen/logrus"
-	"golang.org/x/net/websocket"
 	set "github.com/deckarep/golang-set"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
 
 	cc "airman.com/airfk/pkg/codec"
 )
 
-// websocketJSONCodec is a custom JSON codec with payload size enforcement and
-// special number parsing.
-var websocketJSONCodec = websocket.Codec{
-	// Marshal is the stock JSON marshaller used by the websocket library too.
-	Marshal: func(v interface{}) ([]byte, byte, error) {
-		msg, err := json.Marshal(v)
-		return msg, websocket.TextFrame, err
-	},
-	// Unmarshal is a specialized unmarshaller to properly convert numbers.
-	Unmarshal: func(msg []byte, payloadType byte, v interface{}) error {
-		dec := json.NewDecoder(bytes.NewReader(msg))
-		dec.UseNumber()
+const wsReadBufferSize = 1024
 
-		return dec.Decode(v)
-	},
+// WSConfig holds the keepalive settings of WebSocket connections. A zero
+// duration disables the corresponding check.
+type WSConfig struct {
+	PingInterval time.Duration // interval between pings sent to the peer
+	PongTimeout  time.Duration // time to wait for a pong before the peer is considered gone
+	IdleTimeout  time.Duration // close the connection after no messages in either direction
+	WriteTimeout time.Duration // deadline for writing a single message or ping
+}
+
+// DefaultWSConfig contains reasonable default keepalive settings.
+var DefaultWSConfig = WSConfig{
+	PingInterval: 30 * time.Second,
+	PongTimeout:  30 * time.Second,
+	WriteTimeout: 10 * time.Second,
 }
 
 // WebsocketHandler returns a handler that serves JSON-RPC to WebSocket connections.
@@ -52,32 +56,250 @@ var websocketJSONCodec = websocket.Codec{
 // allowedOrigins should be a comma-separated list of allowed origin URLs.
 // To allow connections with any origin, pass "*".
 func (srv *Server) WebsocketHandler(allowedOrigins []string) http.Handler {
-	return websocket.Server{
-		Handshake: wsHandshakeValidator(allowedOrigins),
-		Handler: func(conn *websocket.Conn) {
-			// Create a custom encode/decode pair to enforce payload size and number encoding
-			conn.MaxPayloadBytes = maxRequestContentLength
-
-			encoder := func(v interface{}) error {
-				return websocketJSONCodec.Send(conn, v)
-			}
-			decoder := func(v interface{}) error {
-				return websocketJSONCodec.Receive(conn, v)
-			}
-			srv.ServeCodec(cc.NewCodec(conn, encoder, decoder), OptionMethodInvocation|OptionSubscriptions)
-		},
+	return srv.WebsocketHandlerWithConfig(allowedOrigins, DefaultWSConfig)
+}
+
+// WebsocketHandlerWithConfig returns a handler that serves JSON-RPC to WebSocket
+// connections and applies the given keepalive settings to every connection.
+func (srv *Server) WebsocketHandlerWithConfig(allowedOrigins []string, config WSConfig) http.Handler {
+	srv.SetWSOrigins(allowedOrigins)
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  wsReadBufferSize,
+		WriteBufferSize: wsReadBufferSize,
+		CheckOrigin:     srv.checkWSOrigin,
 	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if srv.serveHealth(w, r) {
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Debugf("WebSocket upgrade failed: %v", err)
+			return
+		}
+		wc := newWebsocketConn(conn, config)
+		defer wc.Close()
+
+		codec := cc.NewCodec(wc, wc.writeJSON, wc.readJSON)
+		go wc.keepaliveLoop(codec)
+		srv.ServeCodec(codec, OptionMethodInvocation|OptionSubscriptions)
+	})
+}
+
+// originCheck is stored in Server.wsOrigins, atomic.Value needs a consistent
+// type.
+type originCheck func(*http.Request) bool
+
+// SetWSOrigins replaces the origins allowed by the WebSocket handler of srv
+// for new connections.
+func (srv *Server) SetWSOrigins(origins []string) {
+	srv.wsOrigins.Store(originCheck(wsHandshakeValidator(origins)))
+}
+
+func (srv *Server) checkWSOrigin(r *http.Request) bool {
+	check, _ := srv.wsOrigins.Load().(originCheck)
+	return check != nil && check(r)
 }
 
 // NewWSServer creates a new websocket RPC server around an API provider.
 func NewWSServer(allowedOrigins []string, srv *Server) *http.Server {
-	return &http.Server{Handler: srv.WebsocketHandler(allowedOrigins)}
+	return NewWSServerWithConfig(allowedOrigins, DefaultWSConfig, srv)
+}
+
+// NewWSServerWithConfig creates a new websocket RPC server around an API provider
+// with the given keepalive settings.
+func NewWSServerWithConfig(allowedOrigins []string, config WSConfig, srv *Server) *http.Server {
+	return &http.Server{Handler: srv.WebsocketHandlerWithConfig(allowedOrigins, config)}
+}
+
+// websocketConn wraps a WebSocket connection with payload size enforcement,
+// special number parsing and keepalive handling.
+type websocketConn struct {
+	active  int64 // unix nano of the last message read or written, accessed atomically
+	conn    *websocket.Conn
+	config  WSConfig
+	pongs   chan struct{} // signals received pongs to the keepalive loop
+	closed  chan struct{}
+	closing int32
+
+	reader  io.Reader  // remainder of the message being read by Read
+	writeMu sync.Mutex // gorilla allows a single writer at a time
+}
+
+func newWebsocketConn(conn *websocket.Conn, config WSConfig) *websocketConn {
+	wc := &websocketConn{
+		conn:   conn,
+		config: config,
+		active: time.Now().UnixNano(),
+		pongs:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	conn.SetReadLimit(maxRequestContentLength)
+	conn.SetPongHandler(func(string) error {
+		select {
+		case wc.pongs <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	return wc
+}
+
+// readJSON decodes the next message, converting numbers to json.Number.
+func (wc *websocketConn) readJSON(v interface{}) error {
+	wc.reader = nil
+	_, r, err := wc.conn.NextReader()
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&wc.active, time.Now().UnixNano())
+
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// writeJSON encodes v as a text message, honouring the write deadline.
+func (wc *websocketConn) writeJSON(v interface{}) error {
+	wc.writeMu.Lock()
+	defer wc.writeMu.Unlock()
+
+	if wc.config.WriteTimeout > 0 {
+		wc.conn.SetWriteDeadline(time.Now().Add(wc.config.WriteTimeout))
+	}
+	atomic.StoreInt64(&wc.active, time.Now().UnixNano())
+	return wc.conn.WriteJSON(v)
+}
+
+// Read implements io.Reader over the stream of messages, it is not used by
+// the JSON codec. A message is read to its end before the next one starts.
+func (wc *websocketConn) Read(p []byte) (int, error) {
+	for {
+		if wc.reader == nil {
+			_, r, err := wc.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			atomic.StoreInt64(&wc.active, time.Now().UnixNano())
+			wc.reader = r
+		}
+		n, err := wc.reader.Read(p)
+		if err == io.EOF {
+			wc.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write implements io.Writer, it sends p as a single text message.
+func (wc *websocketConn) Write(p []byte) (int, error) {
+	wc.writeMu.Lock()
+	defer wc.writeMu.Unlock()
+
+	if wc.config.WriteTimeout > 0 {
+		wc.conn.SetWriteDeadline(time.Now().Add(wc.config.WriteTimeout))
+	}
+	atomic.StoreInt64(&wc.active, time.Now().UnixNano())
+	if err := wc.conn.WriteMessage(websocket.TextMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the underlying connection, it is safe to call multiple times.
+func (wc *websocketConn) Close() error {
+	if atomic.CompareAndSwapInt32(&wc.closing, 0, 1) {
+		close(wc.closed)
+		return wc.conn.Close()
+	}
+	return nil
+}
+
+// keepaliveLoop pings the peer and closes the codec when the peer stops
+// answering or the connection has been idle for too long. Closing the codec
+// makes the notifier cancel all subscriptions of the connection.
+func (wc *websocketConn) keepaliveLoop(codec cc.ServerCodec) {
+	var (
+		pingC    <-chan time.Time
+		idleC    <-chan time.Time
+		pongWait *time.Timer
+		pongC    <-chan time.Time
+	)
+	if wc.config.PingInterval > 0 {
+		ticker := time.NewTicker(wc.config.PingInterval)
+		defer ticker.Stop()
+		pingC = ticker.C
+	}
+	if wc.config.IdleTimeout > 0 {
+		ticker := time.NewTicker(wc.config.IdleTimeout / 4)
+		defer ticker.Stop()
+		idleC = ticker.C
+	}
+	defer func() {
+		if pongWait != nil {
+			pongWait.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-pingC:
+			deadline := time.Time{}
+			if wc.config.WriteTimeout > 0 {
+				deadline = time.Now().Add(wc.config.WriteTimeout)
+			}
+			if err := wc.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				log.Debugf("WebSocket ping failed: %v", err)
+				wc.shutdown(codec)
+				return
+			}
+			if wc.config.PongTimeout > 0 && pongC == nil {
+				pongWait = time.NewTimer(wc.config.PongTimeout)
+				pongC = pongWait.C
+			}
+
+		case <-wc.pongs:
+			if pongWait != nil {
+				pongWait.Stop()
+				pongWait, pongC = nil, nil
+			}
+
+		case <-pongC:
+			log.Debugf("WebSocket peer %v did not answer ping, closing", wc.conn.RemoteAddr())
+			wc.shutdown(codec)
+			return
+
+		case <-idleC:
+			last := time.Unix(0, atomic.LoadInt64(&wc.active))
+			if time.Since(last) >= wc.config.IdleTimeout {
+				log.Debugf("WebSocket peer %v idle since %v, closing", wc.conn.RemoteAddr(), last)
+				wc.shutdown(codec)
+				return
+			}
+
+		case <-codec.Closed():
+			return
+		case <-wc.closed:
+			return
+		}
+	}
+}
+
+// shutdown closes the codec and the underlying connection, which unblocks
+// the pending read of the server loop.
+func (wc *websocketConn) shutdown(codec cc.ServerCodec) {
+	codec.Close()
+	wc.Close()
 }
 
 // wsHandshakeValidator returns a handler that verifies the origin during the
 // websocket upgrade process. When a '*' is specified as an allowed origins all
 // connections are accepted.
-func wsHandshakeValidator(allowedOrigins []string) func(*websocket.Config, *http.Request) error {
+func wsHandshakeValidator(allowedOrigins []string) func(*http.Request) bool {
 	origins := set.NewSet()
 	allowAllOrigins := false
 
@@ -100,13 +322,13 @@ func wsHandshakeValidator(allowedOrigins []string) func(*websocket.Config, *http
 
 	log.Debug(fmt.Sprintf("Allowed origin(s) for WS RPC interface %v\n", origins.ToSlice()))
 
-	f := func(cfg *websocket.Config, req *http.Request) error {
+	f := func(req *http.Request) bool {
 		origin := strings.ToLower(req.Header.Get("Origin"))
 		if allowAllOrigins || origins.Contains(origin) {
-			return nil
+			return true
 		}
 		log.Warn(fmt.Sprintf("origin '%s' not allowed on WS-RPC interface\n", origin))
-		return fmt.Errorf("origin %s not allowed", origin)
+		return false
 	}
 
 	return f
@@ -0,0 +1,220 @@
+// Copyright 2018 The huayulei_2003@hotmail.com Authors
+// This file is part of the airfk library.
+//
+// The airfk library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The airfk library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the airfk library. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestWSServer(t *testing.T, config WSConfig) (*httptest.Server, string) {
+	srv := NewServer()
+	if err := srv.RegisterName("test", new(DemoServer)); err != nil {
+		t.Fatal(err)
+	}
+	hs := httptest.NewServer(srv.WebsocketHandlerWithConfig([]string{"*"}, config))
+	return hs, "ws" + strings.TrimPrefix(hs.URL, "http")
+}
+
+func dialTestWS(t *testing.T, url string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://localhost"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// expectClosed waits until the server has closed the connection.
+func expectClosed(t *testing.T, conn *websocket.Conn, within time.Duration) {
+	conn.SetReadDeadline(time.Now().Add(within))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+				t.Fatalf("connection not closed within %v", within)
+			}
+			return
+		}
+	}
+}
+
+func TestWebsocketCall(t *testing.T) {
+	hs, url := newTestWSServer(t, DefaultWSConfig)
+	defer hs.Close()
+
+	conn := dialTestWS(t, url)
+	defer conn.Close()
+
+	req := map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": "test_rets"}
+	if err := conn.WriteJSON(req); err != nil {
+		t.Fatal(err)
+	}
+	var resp map[string]interface{}
+	if err := conn.ReadJSON(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp["result"] != "" {
+		t.Fatalf("unexpected response %v", resp)
+	}
+}
+
+func TestWebsocketOriginRejected(t *testing.T) {
+	srv := NewServer()
+	hs := httptest.NewServer(srv.WebsocketHandler([]string{"http://allowed"}))
+	defer hs.Close()
+
+	url := "ws" + strings.TrimPrefix(hs.URL, "http")
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://other"}})
+	if err == nil {
+		t.Fatal("expected handshake failure")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %v", http.StatusForbidden, resp)
+	}
+}
+
+func TestWebsocketSetOrigins(t *testing.T) {
+	srv := NewServer()
+	hs := httptest.NewServer(srv.WebsocketHandler([]string{"http://a.com"}))
+	defer hs.Close()
+
+	url := "ws" + strings.TrimPrefix(hs.URL, "http")
+	dial := func(origin string) error {
+		conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {origin}})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	if err := dial("http://a.com"); err != nil {
+		t.Fatal(err)
+	}
+	srv.SetWSOrigins([]string{"http://b.com"})
+	if err := dial("http://a.com"); err == nil {
+		t.Fatal("a.com still allowed")
+	}
+	if err := dial("http://b.com"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebsocketPongTimeout(t *testing.T) {
+	hs, url := newTestWSServer(t, WSConfig{
+		PingInterval: 50 * time.Millisecond,
+		PongTimeout:  100 * time.Millisecond,
+		WriteTimeout: time.Second,
+	})
+	defer hs.Close()
+
+	// A client that never reads won't answer pings.
+	conn := dialTestWS(t, url)
+	defer conn.Close()
+
+	time.Sleep(500 * time.Millisecond)
+	expectClosed(t, conn, time.Second)
+}
+
+func TestWebsocketPongKeepsAlive(t *testing.T) {
+	hs, url := newTestWSServer(t, WSConfig{
+		PingInterval: 50 * time.Millisecond,
+		PongTimeout:  100 * time.Millisecond,
+		WriteTimeout: time.Second,
+	})
+	defer hs.Close()
+
+	conn := dialTestWS(t, url)
+	defer conn.Close()
+
+	// Reading makes the client answer pings with pongs.
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, _, err := conn.ReadMessage()
+	if ne, ok := err.(interface{ Timeout() bool }); !ok || !ne.Timeout() {
+		t.Fatalf("expected read timeout on live connection, got %v", err)
+	}
+}
+
+func TestWebsocketIdleTimeout(t *testing.T) {
+	hs, url := newTestWSServer(t, WSConfig{
+		IdleTimeout:  100 * time.Millisecond,
+		WriteTimeout: time.Second,
+	})
+	defer hs.Close()
+
+	conn := dialTestWS(t, url)
+	defer conn.Close()
+
+	expectClosed(t, conn, time.Second)
+}
+
+func TestWebsocketConnReadWrite(t *testing.T) {
+	conns := make(chan *websocketConn, 1)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- newWebsocketConn(conn, DefaultWSConfig)
+	}))
+	defer hs.Close()
+	client := dialTestWS(t, "ws"+strings.TrimPrefix(hs.URL, "http"))
+	defer client.Close()
+	wc := <-conns
+	defer wc.Close()
+
+	// Read continues within a message and across messages.
+	client.WriteMessage(websocket.TextMessage, []byte("hello "))
+	client.WriteMessage(websocket.TextMessage, []byte("world"))
+	var got []byte
+	buf := make([]byte, 3)
+	for len(got) < len("hello world") {
+		n, err := wc.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("read %q", got)
+	}
+
+	// Write and writeJSON may be used concurrently.
+	const writes = 20
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < writes; i++ {
+			wc.writeJSON(i)
+		}
+	}()
+	for i := 0; i < writes; i++ {
+		if _, err := wc.Write([]byte(`"raw"`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	for i := 0; i < 2*writes; i++ {
+		if _, _, err := client.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"strings"
 
 	"{{ .LibDir }}/pkg/common"
+	"{{ .LibDir }}/pkg/config"
 	"{{ .LibDir }}/pkg/types"
 )
 
@@ -154,3 +155,10 @@ func (c *Config) GetWSHost() string {
 func (c *Config) GetWSPort() int {
 	return c.WSPort
 }
+
+// Reload overlays the values of the distributed configuration store on c, the
+// keys are the json names of the fields, e.g. http_modules. Node.FollowConfig
+// applies later changes of the modules and origins to the running endpoints.
+func (c *Config) Reload(store *config.Store) error {
+	return store.Decode(c)
+}
@@ -46,6 +46,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
+	"{{ .LibDir }}/pkg/config"
 	"{{ .LibDir }}/pkg/server"
 	"{{ .LibDir }}/pkg/service"
 	"{{ .LibDir }}/pkg/types"
@@ -270,6 +271,59 @@ func (n *Node) StartWS(c *conf.Config, apis []types.API) error {
 	return nil
 }
 
+// FollowConfig keeps the modules and origins of the RPC endpoints in sync with
+// the http_modules, http_origins, ws_modules and ws_origins values of store
+// until the store is closed. Running endpoints are updated in place and
+// restarted ones use the latest values. A removed value restores the one the
+// node was configured with.
+func (n *Node) FollowConfig(store *config.Store) {
+	n.lock.RLock()
+	initial := *n.conf
+	n.lock.RUnlock()
+
+	follow := func(key string, fallback []string, apply func([]string)) {
+		store.FollowList(key, func(list []string) {
+			if list == nil {
+				list = fallback
+			}
+			n.lock.Lock()
+			defer n.lock.Unlock()
+			apply(list)
+		})
+	}
+	follow("http_modules", initial.HTTPModules, func(modules []string) {
+		n.conf.HTTPModules = modules
+		n.setModules(n.httpHandler, modules)
+	})
+	follow("http_origins", initial.HTTPOrigins, func(origins []string) {
+		n.conf.HTTPOrigins = origins
+		if n.httpHandler != nil {
+			n.httpHandler.SetHTTPOrigins(origins)
+		}
+	})
+	follow("ws_modules", initial.WSModules, func(modules []string) {
+		n.conf.WSModules = modules
+		n.setModules(n.wsHandler, modules)
+	})
+	follow("ws_origins", initial.WSOrigins, func(origins []string) {
+		n.conf.WSOrigins = origins
+		if n.wsHandler != nil {
+			n.wsHandler.SetWSOrigins(origins)
+		}
+	})
+}
+
+// setModules serves the apis of the node whitelisted by modules on a running
+// endpoint.
+func (n *Node) setModules(handler *server.Server, modules []string) {
+	if handler == nil {
+		return
+	}
+	if err := handler.SetModules(n.rpcAPIs, modules); err != nil {
+		log.Errorf("setting modules %v failed: %v", modules, err)
+	}
+}
+
 // StopWS terminates the websocket RPC endpoint.
 func (n *Node) StopWS() {
 	if n.wsListener != nil {